@@ -1,17 +1,86 @@
 package internal
 
 import (
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
+	"time"
 )
 
-const MAX_STRING_SIZE = 255 // uint8 MAX
+const MAX_STRING_SIZE uint64 = math.MaxUint32
+
+// Every string is preceded by its length as a big endian uint32
+const LENGTH_PREFIX_SIZE = 4
 
 const (
 	GET_COMMAND    = 0
 	SET_COMMAND    = 1
 	DELETE_COMMAND = 2
+	HELLO_COMMAND  = 3
+	BGSAVE_COMMAND = 4
+	// SET with a TTL
+	SETEX_COMMAND   = 5
+	EXPIRE_COMMAND  = 6
+	PERSIST_COMMAND = 7
+	TTL_COMMAND     = 8
+	RANGE_COMMAND   = 9
+	SCAN_COMMAND    = 10
+	// Multi key commands send a count followed by the keys, and values for MSET, instead of a single key
+	MGET_COMMAND = 11
+	MSET_COMMAND = 12
+	MDEL_COMMAND = 13
+	// Counters. The server stores them as base 10 signed 64 bit integers
+	INCR_COMMAND   = 14
+	DECR_COMMAND   = 15
+	INCRBY_COMMAND = 16
+	// Conditional writes
+	SETNX_COMMAND = 17
+	SETXX_COMMAND = 18
+	CAS_COMMAND   = 19
+	// Transactions. GET, SET and DELETE sent between MULTI and EXEC are queued and committed together
+	MULTI_COMMAND   = 20
+	EXEC_COMMAND    = 21
+	DISCARD_COMMAND = 22
+	// Makes the next EXEC fail if any of the keys change first
+	WATCH_COMMAND   = 23
+	UNWATCH_COMMAND = 24
+	// Snapshot reads. GET_AT and SCAN_AT read keys as they were when SNAPSHOT was sent
+	SNAPSHOT_COMMAND = 25
+	GET_AT_COMMAND   = 26
+	SCAN_AT_COMMAND  = 27
+	// Key history read back from the server's write log
+	HISTORY_COMMAND   = 28
+	GET_AS_OF_COMMAND = 29
+	BACKUP_COMMAND    = 30
 )
 
+// TTLs are sent as big endian unsigned milliseconds
+const TTL_SIZE = 8
+
+// Limits are sent as big endian unsigned integers
+const LIMIT_SIZE = 4
+
+// Versions are sent as big endian unsigned integers
+const VERSION_SIZE = 8
+
+// Snapshot read timestamps are sent as big endian unsigned integers
+const READ_TIMESTAMP_SIZE = 8
+
+// Wall clock times are sent as big endian signed Unix milliseconds
+const TIMESTAMP_SIZE = 8
+
+// INCRBY's delta is sent as a big endian signed integer. Counter commands respond with the new value in the same format
+const DELTA_SIZE = 8
+
+// Only protocol version this client speaks. See docs/protocol.md
+// It doesn't negotiate down so it only works with servers that speak version 4. Every request is encoded with
+// version 4 framing, and version 1 responses can't be read without knowing which command they answer
+const PROTOCOL_VERSION = 4
+
+// Every request and response starts with a big endian uint32 request id
+const REQUEST_ID_SIZE = 4
+
 type Command interface {
 	Encode() ([]byte, error)
 }
@@ -21,6 +90,11 @@ func encodeString(toEncode string) (int, []byte) {
 	return len(encoded), encoded
 }
 
+func putLength(buf []byte, length int) {
+	binary.BigEndian.PutUint32(buf, uint32(length))
+}
+
+// Responds with the key's version followed by its value. See DecodeVersionedValue
 type GetCommand struct {
 	Key string
 }
@@ -28,15 +102,15 @@ type GetCommand struct {
 func (g *GetCommand) Encode() ([]byte, error) {
 	keySize, encodedKey := encodeString(g.Key)
 
-	if keySize > MAX_STRING_SIZE {
-		return nil, errors.New("get_command: Key size is greater then max size allowed (255)")
+	if uint64(keySize) > MAX_STRING_SIZE {
+		return nil, errors.New("get_command: Key size is greater then max size allowed (4294967295)")
 	}
 
 	var encodedMessage []byte
-	encodedMessage = make([]byte, len(encodedKey)+2) // 2 bytes used for Command type + length
+	encodedMessage = make([]byte, 1+LENGTH_PREFIX_SIZE+keySize) // Command type + length + key
 	encodedMessage[0] = GET_COMMAND
-	encodedMessage[1] = byte(keySize)
-	numCopied := copy(encodedMessage[2:], encodedKey)
+	putLength(encodedMessage[1:], keySize)
+	numCopied := copy(encodedMessage[1+LENGTH_PREFIX_SIZE:], encodedKey)
 
 	if numCopied != keySize {
 		return nil, errors.New("get_command: failed to copy full key into encoded message")
@@ -45,63 +119,461 @@ func (g *GetCommand) Encode() ([]byte, error) {
 	return encodedMessage, nil
 }
 
+// Only sets Key if it's currently at ExpectedVersion, unless that's 0. The server responds with CONDITION_FAILED if it isn't
+// Responds with the key's new version. See DecodeVersion
 type SetCommand struct {
-	Key   string
-	Value string
+	Key             string
+	Value           []byte
+	ExpectedVersion uint64
 }
 
 func (s *SetCommand) Encode() ([]byte, error) {
 	keySize, encodedKey := encodeString(s.Key)
-	if keySize > MAX_STRING_SIZE {
-		return nil, errors.New("set_command: Key size is greater then max size allowed (255)")
+	if uint64(keySize) > MAX_STRING_SIZE {
+		return nil, errors.New("set_command: Key size is greater then max size allowed (4294967295)")
 	}
 
-	valueSize, encodedValue := encodeString(s.Value)
-	if valueSize > MAX_STRING_SIZE {
-		return nil, errors.New("set_command: Value size is greater then max size allowed (255)")
+	valueSize, encodedValue := len(s.Value), s.Value
+	if uint64(valueSize) > MAX_STRING_SIZE {
+		return nil, errors.New("set_command: Value size is greater then max size allowed (4294967295)")
 	}
 
-	totalMessageSize := 1 + 1 + keySize + 1 + valueSize
+	totalMessageSize := 1 + LENGTH_PREFIX_SIZE + keySize + LENGTH_PREFIX_SIZE + valueSize + VERSION_SIZE
 
 	var encodedMessage []byte
-	encodedMessage = make([]byte, totalMessageSize) // 2 bytes used for Command type + length
+	encodedMessage = make([]byte, totalMessageSize)
 	encodedMessage[0] = SET_COMMAND
-	encodedMessage[1] = byte(keySize)
-	numCopied := copy(encodedMessage[2:], encodedKey)
+	putLength(encodedMessage[1:], keySize)
+	numCopied := copy(encodedMessage[1+LENGTH_PREFIX_SIZE:], encodedKey)
 	if numCopied != keySize {
 		return nil, errors.New("set_command: failed to copy full key into encoded message")
 	}
 
-	startValueIndex := 1 + 1 + keySize
-	encodedMessage[startValueIndex] = byte(valueSize)
-	numCopied = copy(encodedMessage[startValueIndex+1:], encodedValue)
+	startValueIndex := 1 + LENGTH_PREFIX_SIZE + keySize
+	putLength(encodedMessage[startValueIndex:], valueSize)
+	numCopied = copy(encodedMessage[startValueIndex+LENGTH_PREFIX_SIZE:], encodedValue)
 	if numCopied != valueSize {
 		return nil, errors.New("set_command: failed to copy full value into encoded message")
 	}
+	binary.BigEndian.PutUint64(encodedMessage[startValueIndex+LENGTH_PREFIX_SIZE+valueSize:], s.ExpectedVersion)
 
 	return encodedMessage, nil
 }
 
+// Only deletes Key if it's currently at ExpectedVersion, unless that's 0. The server responds with CONDITION_FAILED if it isn't
 type DeleteCommand struct {
-	Key string
+	Key             string
+	ExpectedVersion uint64
 }
 
 func (d *DeleteCommand) Encode() ([]byte, error) {
 	keySize, encodedKey := encodeString(d.Key)
-	if keySize > MAX_STRING_SIZE {
-		return nil, errors.New("delete_command: Key size is greater then max size allowed (255)")
+	if uint64(keySize) > MAX_STRING_SIZE {
+		return nil, errors.New("delete_command: Key size is greater then max size allowed (4294967295)")
 	}
 
-	totalMessageSize := 1 + 1 + keySize
+	totalMessageSize := 1 + LENGTH_PREFIX_SIZE + keySize + VERSION_SIZE
 
 	var encodedMessage []byte
-	encodedMessage = make([]byte, totalMessageSize) // 2 bytes used for Command type + length
+	encodedMessage = make([]byte, totalMessageSize) // Command type + length + key + expected version
 	encodedMessage[0] = DELETE_COMMAND
-	encodedMessage[1] = byte(keySize)
-	numCopied := copy(encodedMessage[2:], encodedKey)
+	putLength(encodedMessage[1:], keySize)
+	numCopied := copy(encodedMessage[1+LENGTH_PREFIX_SIZE:], encodedKey)
 	if numCopied != keySize {
 		return nil, errors.New("delete_command: failed to copy full key into encoded message")
 	}
+	binary.BigEndian.PutUint64(encodedMessage[1+LENGTH_PREFIX_SIZE+keySize:], d.ExpectedVersion)
+
+	return encodedMessage, nil
+}
+
+// Asks the server to snapshot in the background. Sent with an empty key
+type BgsaveCommand struct{}
+
+func (b *BgsaveCommand) Encode() ([]byte, error) {
+	encodedMessage := make([]byte, 1+LENGTH_PREFIX_SIZE) // Command type + empty key length
+	encodedMessage[0] = BGSAVE_COMMAND
+	putLength(encodedMessage[1:], 0)
+	return encodedMessage, nil
+}
+
+// Starts a transaction. Sent with an empty key
+type MultiCommand struct{}
+
+func (m *MultiCommand) Encode() ([]byte, error) {
+	return encodeEmptyKeyCommand(MULTI_COMMAND), nil
+}
+
+// Commits the commands queued since MULTI. Sent with an empty key
+type ExecCommand struct{}
+
+func (e *ExecCommand) Encode() ([]byte, error) {
+	return encodeEmptyKeyCommand(EXEC_COMMAND), nil
+}
+
+// Drops the commands queued since MULTI. Sent with an empty key
+type DiscardCommand struct{}
+
+func (d *DiscardCommand) Encode() ([]byte, error) {
+	return encodeEmptyKeyCommand(DISCARD_COMMAND), nil
+}
+
+// Watches keys so the next EXEC fails if any of them change first. Sent like MGET
+type WatchCommand struct {
+	Keys []string
+}
+
+func (w *WatchCommand) Encode() ([]byte, error) {
+	return encodeMultiKeyCommand("watch_command", WATCH_COMMAND, w.Keys, nil)
+}
+
+// Stops watching every key. Sent with an empty key
+type UnwatchCommand struct{}
+
+func (u *UnwatchCommand) Encode() ([]byte, error) {
+	return encodeEmptyKeyCommand(UNWATCH_COMMAND), nil
+}
+
+func encodeEmptyKeyCommand(opcode byte) []byte {
+	encodedMessage := make([]byte, 1+LENGTH_PREFIX_SIZE) // Command type + empty key length
+	encodedMessage[0] = opcode
+	putLength(encodedMessage[1:], 0)
+	return encodedMessage
+}
+
+// Encodes a command made up of the opcode, a key and optionally a value and TTL
+func encodeKeyCommand(name string, opcode byte, key string, value []byte, ttl *time.Duration) ([]byte, error) {
+	keySize, encodedKey := encodeString(key)
+	if uint64(keySize) > MAX_STRING_SIZE {
+		return nil, fmt.Errorf("%s: Key size is greater then max size allowed (4294967295)", name)
+	}
+	if uint64(len(value)) > MAX_STRING_SIZE {
+		return nil, fmt.Errorf("%s: Value size is greater then max size allowed (4294967295)", name)
+	}
+
+	encodedMessage := []byte{opcode}
+	encodedMessage = binary.BigEndian.AppendUint32(encodedMessage, uint32(keySize))
+	encodedMessage = append(encodedMessage, encodedKey...)
+	if value != nil {
+		encodedMessage = binary.BigEndian.AppendUint32(encodedMessage, uint32(len(value)))
+		encodedMessage = append(encodedMessage, value...)
+	}
+	if ttl != nil {
+		if *ttl < time.Millisecond {
+			return nil, fmt.Errorf("%s: TTL must be at least 1 millisecond", name)
+		}
+		encodedMessage = binary.BigEndian.AppendUint64(encodedMessage, uint64(ttl.Milliseconds()))
+	}
 
 	return encodedMessage, nil
 }
+
+// SET that expires after TTL
+type SetWithTTLCommand struct {
+	Key   string
+	Value []byte
+	TTL   time.Duration
+}
+
+func (s *SetWithTTLCommand) Encode() ([]byte, error) {
+	value := s.Value
+	if value == nil {
+		value = []byte{}
+	}
+	return encodeKeyCommand("setex_command", SETEX_COMMAND, s.Key, value, &s.TTL)
+}
+
+type ExpireCommand struct {
+	Key string
+	TTL time.Duration
+}
+
+func (e *ExpireCommand) Encode() ([]byte, error) {
+	return encodeKeyCommand("expire_command", EXPIRE_COMMAND, e.Key, nil, &e.TTL)
+}
+
+// Removes a key's expiry
+type PersistCommand struct {
+	Key string
+}
+
+func (p *PersistCommand) Encode() ([]byte, error) {
+	return encodeKeyCommand("persist_command", PERSIST_COMMAND, p.Key, nil, nil)
+}
+
+// Asks how long a key has left. See DecodeTTL
+type TTLCommand struct {
+	Key string
+}
+
+func (t *TTLCommand) Encode() ([]byte, error) {
+	return encodeKeyCommand("ttl_command", TTL_COMMAND, t.Key, nil, nil)
+}
+
+// Fetches up to Limit keys and values from Start (inclusive) to End (exclusive) in order
+// An empty End has no upper bound. A Limit of 0 lets the server choose. See DecodeRangeResponse
+type RangeCommand struct {
+	Start string
+	End   string
+	Limit uint32
+}
+
+func (r *RangeCommand) Encode() ([]byte, error) {
+	encoded, err := encodeKeyCommand("range_command", RANGE_COMMAND, r.Start, []byte(r.End), nil)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint32(encoded, r.Limit), nil
+}
+
+// Returns the range covering every key that starts with prefix
+// e.g. "user:123:" gives "user:123:" to "user:123;"
+func PrefixRange(prefix string) (string, string) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return prefix, string(end[:i+1])
+		}
+	}
+	// Every byte is 0xff so nothing sorts after the prefix
+	return prefix, ""
+}
+
+// Starts a new scan when Cursor is empty. An empty Match matches every key. A Count of 0 lets the server choose
+// Count is how many keys the server looks at, not how many match, so a batch can be empty part way through. See DecodeScanResponse
+type ScanCommand struct {
+	Cursor []byte
+	Match  string
+	Count  uint32
+}
+
+func (s *ScanCommand) Encode() ([]byte, error) {
+	encoded, err := encodeKeyCommand("scan_command", SCAN_COMMAND, string(s.Cursor), []byte(s.Match), nil)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint32(encoded, s.Count), nil
+}
+
+// Fetches the last Limit values of Key newest first. A Limit of 0 lets the server choose. See DecodeHistoryResponse
+type HistoryCommand struct {
+	Key   string
+	Limit uint32
+}
+
+func (h *HistoryCommand) Encode() ([]byte, error) {
+	encoded, err := encodeKeyCommand("history_command", HISTORY_COMMAND, h.Key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint32(encoded, h.Limit), nil
+}
+
+// Like GET but fetches Key as it was at At. Only accurate to the millisecond
+type GetAsOfCommand struct {
+	Key string
+	At  time.Time
+}
+
+func (g *GetAsOfCommand) Encode() ([]byte, error) {
+	encoded, err := encodeKeyCommand("get_as_of_command", GET_AS_OF_COMMAND, g.Key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint64(encoded, uint64(g.At.UnixMilli())), nil
+}
+
+// Copies the server's data while it carries on serving
+// Backs up to the directory Dir under the server's --backup-dir and responds with the sequence number of the last write included. See DecodeVersion
+// With an empty Dir responds with the backup as a tar archive split over many responses instead. See TCPServerConnection.SendMessageStream
+type BackupCommand struct {
+	Dir string
+}
+
+func (b *BackupCommand) Encode() ([]byte, error) {
+	return encodeKeyCommand("backup_command", BACKUP_COMMAND, b.Dir, nil, nil)
+}
+
+// Opens a snapshot. Responds with the read timestamp to send with GET_AT and SCAN_AT. See DecodeVersion
+type SnapshotCommand struct{}
+
+func (s *SnapshotCommand) Encode() ([]byte, error) {
+	return encodeEmptyKeyCommand(SNAPSHOT_COMMAND), nil
+}
+
+// Like GET but reads Key as it was at the snapshot with the Timestamp
+type GetAtCommand struct {
+	Key       string
+	Timestamp uint64
+}
+
+func (g *GetAtCommand) Encode() ([]byte, error) {
+	encoded, err := encodeKeyCommand("get_at_command", GET_AT_COMMAND, g.Key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint64(encoded, g.Timestamp), nil
+}
+
+// Like SCAN but visits keys as they were at the snapshot with the Timestamp
+type ScanAtCommand struct {
+	Cursor    []byte
+	Match     string
+	Count     uint32
+	Timestamp uint64
+}
+
+func (s *ScanAtCommand) Encode() ([]byte, error) {
+	encoded, err := encodeKeyCommand("scan_at_command", SCAN_AT_COMMAND, string(s.Cursor), []byte(s.Match), nil)
+	if err != nil {
+		return nil, err
+	}
+	encoded = binary.BigEndian.AppendUint32(encoded, s.Count)
+	return binary.BigEndian.AppendUint64(encoded, s.Timestamp), nil
+}
+
+// Encodes the opcode, the number of keys and then each key followed by its value if values isn't nil
+func encodeMultiKeyCommand(name string, opcode byte, keys []string, values [][]byte) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: at least one key is needed", name)
+	}
+	if values != nil && len(values) != len(keys) {
+		return nil, fmt.Errorf("%s: got %d keys but %d values", name, len(keys), len(values))
+	}
+
+	encodedMessage := []byte{opcode}
+	encodedMessage = binary.BigEndian.AppendUint32(encodedMessage, uint32(len(keys)))
+	for i, key := range keys {
+		if uint64(len(key)) > MAX_STRING_SIZE {
+			return nil, fmt.Errorf("%s: Key size is greater then max size allowed (4294967295)", name)
+		}
+		encodedMessage = binary.BigEndian.AppendUint32(encodedMessage, uint32(len(key)))
+		encodedMessage = append(encodedMessage, key...)
+		if values == nil {
+			continue
+		}
+		if uint64(len(values[i])) > MAX_STRING_SIZE {
+			return nil, fmt.Errorf("%s: Value size is greater then max size allowed (4294967295)", name)
+		}
+		encodedMessage = binary.BigEndian.AppendUint32(encodedMessage, uint32(len(values[i])))
+		encodedMessage = append(encodedMessage, values[i]...)
+	}
+
+	return encodedMessage, nil
+}
+
+// Fetches several keys in one request. See DecodeList for how missing keys come back
+type MGetCommand struct {
+	Keys []string
+}
+
+func (m *MGetCommand) Encode() ([]byte, error) {
+	return encodeMultiKeyCommand("mget_command", MGET_COMMAND, m.Keys, nil)
+}
+
+// Sets several keys in one request. The server applies them together
+type MSetCommand struct {
+	Pairs []KeyValue
+}
+
+func (m *MSetCommand) Encode() ([]byte, error) {
+	keys := make([]string, len(m.Pairs))
+	values := make([][]byte, len(m.Pairs))
+	for i, pair := range m.Pairs {
+		keys[i] = pair.Key
+		values[i] = pair.Value
+		if values[i] == nil {
+			values[i] = []byte{}
+		}
+	}
+	return encodeMultiKeyCommand("mset_command", MSET_COMMAND, keys, values)
+}
+
+// Deletes several keys in one request. The server applies them together
+type MDelCommand struct {
+	Keys []string
+}
+
+func (m *MDelCommand) Encode() ([]byte, error) {
+	return encodeMultiKeyCommand("mdel_command", MDEL_COMMAND, m.Keys, nil)
+}
+
+// Adds one to the counter at Key, which starts at 0 if it doesn't exist. See DecodeInteger
+type IncrCommand struct {
+	Key string
+}
+
+func (i *IncrCommand) Encode() ([]byte, error) {
+	return encodeKeyCommand("incr_command", INCR_COMMAND, i.Key, nil, nil)
+}
+
+// Takes one from the counter at Key, which starts at 0 if it doesn't exist. See DecodeInteger
+type DecrCommand struct {
+	Key string
+}
+
+func (d *DecrCommand) Encode() ([]byte, error) {
+	return encodeKeyCommand("decr_command", DECR_COMMAND, d.Key, nil, nil)
+}
+
+// Adds Delta, which may be negative, to the counter at Key. See DecodeInteger
+type IncrByCommand struct {
+	Key   string
+	Delta int64
+}
+
+func (i *IncrByCommand) Encode() ([]byte, error) {
+	encoded, err := encodeKeyCommand("incrby_command", INCRBY_COMMAND, i.Key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return binary.BigEndian.AppendUint64(encoded, uint64(i.Delta)), nil
+}
+
+// Sets Key only if it doesn't exist. The server responds with CONDITION_FAILED if it does
+type SetNXCommand struct {
+	Key   string
+	Value []byte
+}
+
+func (s *SetNXCommand) Encode() ([]byte, error) {
+	return encodeKeyCommand("setnx_command", SETNX_COMMAND, s.Key, nonNil(s.Value), nil)
+}
+
+// Sets Key only if it already exists. The server responds with CONDITION_FAILED if it doesn't
+type SetXXCommand struct {
+	Key   string
+	Value []byte
+}
+
+func (s *SetXXCommand) Encode() ([]byte, error) {
+	return encodeKeyCommand("setxx_command", SETXX_COMMAND, s.Key, nonNil(s.Value), nil)
+}
+
+// Sets Key to Value only if its current value is Expected. The server responds with CONDITION_FAILED if it isn't or Key doesn't exist
+type CASCommand struct {
+	Key      string
+	Expected []byte
+	Value    []byte
+}
+
+func (c *CASCommand) Encode() ([]byte, error) {
+	encoded, err := encodeKeyCommand("cas_command", CAS_COMMAND, c.Key, nonNil(c.Value), nil)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(c.Expected)) > MAX_STRING_SIZE {
+		return nil, errors.New("cas_command: Expected value size is greater then max size allowed (4294967295)")
+	}
+	encoded = binary.BigEndian.AppendUint32(encoded, uint32(len(c.Expected)))
+	return append(encoded, c.Expected...), nil
+}
+
+// encodeKeyCommand leaves out nil values so empty values have to be sent as an empty slice
+func nonNil(value []byte) []byte {
+	if value == nil {
+		return []byte{}
+	}
+	return value
+}
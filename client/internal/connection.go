@@ -2,20 +2,57 @@ package internal
 
 import (
 	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
 type ServerConnection interface {
 	SendMessage([]byte) ([]byte, error)
+	SendMessageAsync([]byte) (*PendingResponse, error)
+	SendMessageStream([]byte, func([]byte) error) error
+	Close() error
 }
 
+type responseResult struct {
+	response []byte
+	err      error
+}
+
+// A request that has been sent but whose response may not have arrived yet
+type PendingResponse struct {
+	result chan responseResult
+	// Expects a sequence of responses rather than one. See SendMessageStream
+	stream bool
+}
+
+// Blocks until the response arrives or the connection fails
+func (p *PendingResponse) Wait() ([]byte, error) {
+	result := <-p.result
+	return result.response, result.err
+}
+
+// Requests are tagged with an id so many can be in flight at once on one connection
+// Responses are read in the background and handed to whichever request they belong to
 type TCPServerConnection struct {
 	serverAddress    string
 	socketConnection net.Conn
 	reader           *bufio.Reader
 	writer           *bufio.Writer
+	// Server's reply to the handshake sent when the connection was created
+	Hello *HelloResponse
+
+	writeLock     sync.Mutex
+	nextRequestID atomic.Uint32
+	pendingLock   sync.Mutex
+	pending       map[uint32]*PendingResponse
+	// Set once the connection can no longer be used
+	closedErr error
 }
 
 func CreateTCPServerConnection(serverAddress string) (*TCPServerConnection, error) {
@@ -32,38 +69,208 @@ func CreateTCPServerConnection(serverAddress string) (*TCPServerConnection, erro
 		socketConnection: conn,
 		reader:           reader,
 		writer:           writer,
+		pending:          make(map[uint32]*PendingResponse),
+	}
+
+	err = tcpServerConnection.handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
+
+	go tcpServerConnection.receiveResponses()
+
 	return &tcpServerConnection, nil
 }
 
+func (c *TCPServerConnection) Close() error {
+	return c.socketConnection.Close()
+}
+
+// Announces the protocol version this client speaks and checks the server agreed to it
+// Fails against servers that only speak an older version rather than negotiating down. See PROTOCOL_VERSION
+func (c *TCPServerConnection) handshake() error {
+	_, err := c.writer.Write([]byte{HELLO_COMMAND, PROTOCOL_VERSION})
+	if err != nil {
+		return fmt.Errorf("tcp_conn: error writing HELLO to connection. %w", err)
+	}
+	err = c.writer.Flush()
+	if err != nil {
+		return fmt.Errorf("tcp_conn: error writing HELLO to connection. %w", err)
+	}
+
+	hello, err := ReadHelloResponse(c.reader)
+	if err != nil {
+		return fmt.Errorf("tcp_conn: failed to read HELLO response. %w", err)
+	}
+
+	if hello.ErrorCode != NO_ERROR {
+		return fmt.Errorf("tcp_conn: server rejected HELLO with error code %d", hello.ErrorCode)
+	}
+
+	if hello.Version != PROTOCOL_VERSION {
+		return fmt.Errorf("tcp_conn: server only supports up to protocol version %d. This client only works with servers that speak version %d", hello.Version, PROTOCOL_VERSION)
+	}
+
+	c.Hello = hello
+	return nil
+}
+
+// Sends a message and waits for its response
 func (c *TCPServerConnection) SendMessage(message []byte) ([]byte, error) {
+	pending, err := c.SendMessageAsync(message)
+	if err != nil {
+		return nil, err
+	}
+
+	return pending.Wait()
+}
+
+// Sends a message without waiting for its response so requests can be pipelined
+// Responses may arrive in any order. The server keeps requests on the same key in order but not requests on different keys
+// so wait for a response before sending anything on another key that depends on it
+func (c *TCPServerConnection) SendMessageAsync(message []byte) (*PendingResponse, error) {
+	return c.send(message, false)
+}
+
+// Sends a message answered by a sequence of responses and calls fn with each of them in order
+// The sequence ends with an empty or error response, which fn is also called with
+// Every response is read even if fn fails, and the first error fn returns is returned
+func (c *TCPServerConnection) SendMessageStream(message []byte, fn func(response []byte) error) error {
+	pending, err := c.send(message, true)
+	if err != nil {
+		return err
+	}
+
+	var fnErr error
+	for {
+		response, err := pending.Wait()
+		if err != nil {
+			return err
+		}
+		if fnErr == nil {
+			fnErr = fn(response)
+		}
+		if endsStream(response) {
+			return fnErr
+		}
+	}
+}
+
+// Whether a response is the last of a sequence sent to SendMessageStream
+func endsStream(response []byte) bool {
+	return response[0] != NO_ERROR || len(response) == RESPONSE_HEADER_SIZE
+}
+
+func (c *TCPServerConnection) send(message []byte, stream bool) (*PendingResponse, error) {
+	requestID := c.nextRequestID.Add(1)
+	pending := &PendingResponse{result: make(chan responseResult, 1), stream: stream}
+
+	c.pendingLock.Lock()
+	if c.closedErr != nil {
+		c.pendingLock.Unlock()
+		return nil, c.closedErr
+	}
+	c.pending[requestID] = pending
+	c.pendingLock.Unlock()
+
+	err := c.writeRequest(requestID, message)
+	if err != nil {
+		c.pendingLock.Lock()
+		delete(c.pending, requestID)
+		c.pendingLock.Unlock()
+		return nil, err
+	}
+
+	return pending, nil
+}
+
+func (c *TCPServerConnection) writeRequest(requestID uint32, message []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	requestIDBuf := make([]byte, REQUEST_ID_SIZE)
+	binary.BigEndian.PutUint32(requestIDBuf, requestID)
+	_, err := c.writer.Write(requestIDBuf)
+	if err != nil {
+		return fmt.Errorf("tcp_conn: error writing request id to connection. %w", err)
+	}
+
 	numWritten, err := c.writer.Write(message)
 	if err != nil {
-		return nil, fmt.Errorf("tcp_conn: error writing message to connection. %w", err)
+		return fmt.Errorf("tcp_conn: error writing message to connection. %w", err)
 	}
 	err = c.writer.Flush()
 	if err != nil {
-		return nil, fmt.Errorf("tcp_conn: error writing message to connection. %w", err)
+		return fmt.Errorf("tcp_conn: error writing message to connection. %w", err)
 	}
 
 	if numWritten != len(message) {
-		return nil, errors.New("tcp_conn: failed to write entire message to connection")
+		return errors.New("tcp_conn: failed to write entire message to connection")
 	}
 
-	var readBuffer []byte
-	// Allocating way too much memory
-	// Max message size in theory is 257 bytes
-	readBuffer = make([]byte, 512)
-	// _, err = c.reader.Read(readBuffer)
-	nRead, err := c.socketConnection.Read(readBuffer)
+	return nil
+}
+
+// Runs for the lifetime of the connection handing each response to the request waiting on it
+func (c *TCPServerConnection) receiveResponses() {
+	for {
+		requestID, response, err := c.readResponse()
+		if err != nil {
+			c.failPending(err)
+			return
+		}
+
+		c.pendingLock.Lock()
+		pending, exists := c.pending[requestID]
+		if exists && (!pending.stream || endsStream(response)) {
+			delete(c.pending, requestID)
+		}
+		c.pendingLock.Unlock()
+
+		if !exists {
+			log.Printf("tcp_conn: received response for unknown request id %d\n", requestID)
+			continue
+		}
+		pending.result <- responseResult{response: response}
+	}
+}
 
-	if nRead == 0 {
-		return nil, errors.New("tcp_conn: no bytes read")
+// Fails every request still waiting on a response
+func (c *TCPServerConnection) failPending(err error) {
+	c.pendingLock.Lock()
+	defer c.pendingLock.Unlock()
+
+	c.closedErr = fmt.Errorf("tcp_conn: connection closed. %w", err)
+	for requestID, pending := range c.pending {
+		pending.result <- responseResult{err: c.closedErr}
+		delete(c.pending, requestID)
+	}
+}
+
+// Reads exactly one framed response from the connection
+// The request id is stripped from the returned response
+func (c *TCPServerConnection) readResponse() (uint32, []byte, error) {
+	requestIDBuf := make([]byte, REQUEST_ID_SIZE)
+	_, err := io.ReadFull(c.reader, requestIDBuf)
+	if err != nil {
+		return 0, nil, fmt.Errorf("tcp_conn: failed to read request id from connection. %w", err)
+	}
+	requestID := binary.BigEndian.Uint32(requestIDBuf)
+
+	header := make([]byte, RESPONSE_HEADER_SIZE)
+	_, err = io.ReadFull(c.reader, header)
+	if err != nil {
+		return 0, nil, fmt.Errorf("tcp_conn: failed to read response header from connection. %w", err)
 	}
 
+	messageSize := binary.BigEndian.Uint32(header[1:])
+	response := make([]byte, RESPONSE_HEADER_SIZE+int(messageSize))
+	copy(response, header)
+	_, err = io.ReadFull(c.reader, response[RESPONSE_HEADER_SIZE:])
 	if err != nil {
-		return nil, fmt.Errorf("tcp_conn: failed to read from connection. %w", err)
+		return 0, nil, fmt.Errorf("tcp_conn: failed to read response message from connection. %w", err)
 	}
 
-	return readBuffer, nil
+	return requestID, response, nil
 }
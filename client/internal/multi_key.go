@@ -0,0 +1,57 @@
+package internal
+
+import "fmt"
+
+// Sends command and waits for its response
+// Returns an error if the server responds with anything other than NO_ERROR
+func (c *TCPServerConnection) roundTrip(name string, command Command) ([]byte, error) {
+	encoded, err := command.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.SendMessage(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := DecodeResponse(res)
+	if err != nil {
+		return nil, err
+	}
+	if decoded.ErrorCode != NO_ERROR {
+		return nil, fmt.Errorf("%s: server responded with error code %d. %s", name, decoded.ErrorCode, decoded.Value)
+	}
+
+	return decoded.Value, nil
+}
+
+// Fetches every key in one round trip
+// Returns the values in the same order as keys. Keys that don't exist have a nil value
+func (c *TCPServerConnection) MGet(keys ...string) ([][]byte, error) {
+	value, err := c.roundTrip("mget", &MGetCommand{Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := DecodeList(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(keys) {
+		return nil, fmt.Errorf("mget: asked for %d keys got %d values", len(keys), len(values))
+	}
+	return values, nil
+}
+
+// Sets every pair in one round trip. The server logs and applies them together
+func (c *TCPServerConnection) MSet(pairs ...KeyValue) error {
+	_, err := c.roundTrip("mset", &MSetCommand{Pairs: pairs})
+	return err
+}
+
+// Deletes every key in one round trip. Keys that don't exist are ignored
+func (c *TCPServerConnection) MDel(keys ...string) error {
+	_, err := c.roundTrip("mdel", &MDelCommand{Keys: keys})
+	return err
+}
@@ -1,11 +1,30 @@
 package internal
 
-import "errors"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
 
 const (
-	NO_ERROR = 0
+	NO_ERROR     = 0
+	SERVER_ERROR = 1
+	USER_ERROR   = 2
+	UNKNOWN      = 3
+	NOT_FOUND    = 4
+	// A conditional write's condition didn't hold so nothing was written
+	CONDITION_FAILED = 5
 )
 
+// Length of a list element that's missing rather than empty
+const MISSING_ELEMENT_LENGTH = math.MaxUint32
+
+// Error code + message length
+const RESPONSE_HEADER_SIZE = 1 + LENGTH_PREFIX_SIZE
+
 func DecodeResponse(res []byte) (*Response, error) {
 	resSize := len(res)
 
@@ -13,27 +32,244 @@ func DecodeResponse(res []byte) (*Response, error) {
 		return nil, errors.New("decode_response: no bytes to decode!")
 	}
 
+	if resSize < RESPONSE_HEADER_SIZE {
+		return nil, errors.New("decode_response: response is shorter than the response header")
+	}
+
 	errorCode := int(res[0])
 
-	var value string
-	if resSize == 1 {
-		value = ""
-	} else {
-		valueSize := int(res[1])
-		var valueBytes []byte
-		valueBytes = make([]byte, valueSize)
-		numCopied := copy(valueBytes[0:], res[2:])
-		if numCopied != valueSize {
-			return nil, errors.New("decode_response: an unexpected number of bytes was returned.")
+	valueSize := int(binary.BigEndian.Uint32(res[1:RESPONSE_HEADER_SIZE]))
+	var valueBytes []byte
+	valueBytes = make([]byte, valueSize)
+	numCopied := copy(valueBytes[0:], res[RESPONSE_HEADER_SIZE:])
+	if numCopied != valueSize {
+		return nil, errors.New("decode_response: an unexpected number of bytes was returned.")
+	}
+
+	return &Response{ErrorCode: errorCode, Value: valueBytes}, nil
+}
+
+// Decodes the value of a successful TTL response
+// Returns false if the key never expires
+func DecodeTTL(value []byte) (time.Duration, bool, error) {
+	if len(value) != TTL_SIZE {
+		return 0, false, fmt.Errorf("decode_ttl: expected %d bytes got %d", TTL_SIZE, len(value))
+	}
+
+	ttl := int64(binary.BigEndian.Uint64(value))
+	if ttl < 0 {
+		return 0, false, nil
+	}
+	return time.Duration(ttl) * time.Millisecond, true, nil
+}
+
+// Decodes the value of a successful GET response into the key's version and value
+func DecodeVersionedValue(value []byte) (uint64, []byte, error) {
+	if len(value) < VERSION_SIZE {
+		return 0, nil, fmt.Errorf("decode_versioned_value: expected at least %d bytes got %d", VERSION_SIZE, len(value))
+	}
+	return binary.BigEndian.Uint64(value), value[VERSION_SIZE:], nil
+}
+
+// Decodes the value of a successful SET response into the key's new version
+func DecodeVersion(value []byte) (uint64, error) {
+	if len(value) != VERSION_SIZE {
+		return 0, fmt.Errorf("decode_version: expected %d bytes got %d", VERSION_SIZE, len(value))
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+// Decodes the value of a successful EXEC response into the response of each queued command in order
+// Each element is the command's error code followed by the value it would have responded with on its own
+func DecodeTransactionResults(value []byte) ([]*Response, error) {
+	elements, err := DecodeList(value)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*Response, len(elements))
+	for i, element := range elements {
+		if len(element) == 0 {
+			return nil, fmt.Errorf("decode_transaction_results: result %d has no error code", i)
 		}
+		results[i] = &Response{ErrorCode: int(element[0]), Value: element[1:]}
+	}
+	return results, nil
+}
 
-		value = string(valueBytes)
+// Decodes the value of a successful INCR, DECR or INCRBY response
+func DecodeInteger(value []byte) (int64, error) {
+	if len(value) != DELTA_SIZE {
+		return 0, fmt.Errorf("decode_integer: expected %d bytes got %d", DELTA_SIZE, len(value))
 	}
+	return int64(binary.BigEndian.Uint64(value)), nil
+}
+
+// Decodes a response value made up of a list of elements
+// Missing elements, like keys MGET didn't find, are nil. Empty elements are empty but not nil
+//
+// | Element Count (4) | Element Length (4) | Element (n) | ... |
+func DecodeList(value []byte) ([][]byte, error) {
+	if len(value) < LENGTH_PREFIX_SIZE {
+		return nil, errors.New("decode_list: value is shorter than the element count")
+	}
+	count := binary.BigEndian.Uint32(value)
+	value = value[LENGTH_PREFIX_SIZE:]
 
-	return &Response{ErrorCode: errorCode, Value: value}, nil
+	var elements [][]byte
+	for i := range count {
+		if len(value) < LENGTH_PREFIX_SIZE {
+			return nil, fmt.Errorf("decode_list: element %d is missing its length", i)
+		}
+		length := binary.BigEndian.Uint32(value)
+		value = value[LENGTH_PREFIX_SIZE:]
+		if length == MISSING_ELEMENT_LENGTH {
+			elements = append(elements, nil)
+			continue
+		}
+		if uint64(len(value)) < uint64(length) {
+			return nil, fmt.Errorf("decode_list: element %d is cut short", i)
+		}
+		elements = append(elements, value[:length])
+		value = value[length:]
+	}
+	if len(value) != 0 {
+		return nil, fmt.Errorf("decode_list: %d unexpected bytes after the last element", len(value))
+	}
+
+	return elements, nil
 }
 
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// Decodes the value of a successful RANGE response
+// Returns the pairs in order and the start key of the next page, which is empty once there are no more keys
+func DecodeRangeResponse(value []byte) ([]KeyValue, string, error) {
+	elements, err := DecodeList(value)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(elements)%2 != 1 {
+		return nil, "", fmt.Errorf("decode_range_response: expected a cursor then key value pairs. Got %d elements", len(elements))
+	}
+
+	pairs := make([]KeyValue, 0, len(elements)/2)
+	for i := 1; i < len(elements); i += 2 {
+		pairs = append(pairs, KeyValue{Key: string(elements[i]), Value: elements[i+1]})
+	}
+	return pairs, string(elements[0]), nil
+}
+
+// Decodes the value of a successful SCAN response
+// Returns the matching keys and the cursor to send for the next batch, which is empty once the scan is complete
+func DecodeScanResponse(value []byte) ([]string, []byte, error) {
+	elements, err := DecodeList(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(elements) == 0 {
+		return nil, nil, errors.New("decode_scan_response: expected a cursor")
+	}
+
+	keys := make([]string, 0, len(elements)-1)
+	for _, key := range elements[1:] {
+		keys = append(keys, string(key))
+	}
+	return keys, elements[0], nil
+}
+
+// One value a key had. Value is nil if the key was deleted
+type HistoryEntry struct {
+	LoggedAt time.Time
+	Version  uint64
+	Value    []byte
+}
+
+// Decodes the value of a successful HISTORY response. Entries are newest first
+func DecodeHistoryResponse(value []byte) ([]HistoryEntry, error) {
+	elements, err := DecodeList(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(elements)%2 != 0 {
+		return nil, fmt.Errorf("decode_history_response: expected pairs of header and value. Got %d elements", len(elements))
+	}
+
+	history := make([]HistoryEntry, 0, len(elements)/2)
+	for i := 0; i < len(elements); i += 2 {
+		header := elements[i]
+		if len(header) != TIMESTAMP_SIZE+VERSION_SIZE {
+			return nil, fmt.Errorf("decode_history_response: expected a %d byte header got %d", TIMESTAMP_SIZE+VERSION_SIZE, len(header))
+		}
+		history = append(history, HistoryEntry{
+			LoggedAt: time.UnixMilli(int64(binary.BigEndian.Uint64(header))),
+			Version:  binary.BigEndian.Uint64(header[TIMESTAMP_SIZE:]),
+			Value:    elements[i+1],
+		})
+	}
+	return history, nil
+}
+
+// On error Value holds the server's description of what went wrong
 type Response struct {
 	ErrorCode int
-	Value     string
+	Value     []byte
+}
+
+type HelloResponse struct {
+	ErrorCode int
+	Version   int
+	Commands  []int
+	Features  []string
+}
+
+func (h *HelloResponse) SupportsCommand(command int) bool {
+	for _, supported := range h.Commands {
+		if supported == command {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads a HELLO response from the stream
+// | Error Code (1) | Version (1) | Command Count (1) | Commands (n) | Feature Count (1) | Features (length (1) + name)... |
+func ReadHelloResponse(reader io.Reader) (*HelloResponse, error) {
+	header := make([]byte, 3)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, fmt.Errorf("hello_response: failed to read header. %w", err)
+	}
+
+	hello := HelloResponse{ErrorCode: int(header[0]), Version: int(header[1])}
+
+	// Commands are followed by the feature count so read it alongside them
+	commands := make([]byte, int(header[2])+1)
+	_, err = io.ReadFull(reader, commands)
+	if err != nil {
+		return nil, fmt.Errorf("hello_response: failed to read commands. %w", err)
+	}
+	for _, command := range commands[:len(commands)-1] {
+		hello.Commands = append(hello.Commands, int(command))
+	}
+
+	featureCount := int(commands[len(commands)-1])
+	lengthBuf := make([]byte, 1)
+	for range featureCount {
+		_, err = io.ReadFull(reader, lengthBuf)
+		if err != nil {
+			return nil, fmt.Errorf("hello_response: failed to read feature length. %w", err)
+		}
+		feature := make([]byte, int(lengthBuf[0]))
+		_, err = io.ReadFull(reader, feature)
+		if err != nil {
+			return nil, fmt.Errorf("hello_response: failed to read feature. %w", err)
+		}
+		hello.Features = append(hello.Features, string(feature))
+	}
+
+	return &hello, nil
 }
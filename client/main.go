@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/willcruse/kvdb/client/v2/internal"
 )
@@ -13,20 +15,216 @@ import (
 const SERVER_ADDRESS = "localhost:1337"
 
 const HELP_MESSAGE = `Commands
-	GET <KEY>: Fetch value of <KEY> from server
-	SET <KEY> <VALUE>: Set <KEY> to <VALUE>
-	DELETE <KEY>: Delete <KEY> from server
+	GET <KEY>: Fetch value and version of <KEY> from server
+	SET <KEY> <VALUE> [VERSION]: Set <KEY> to <VALUE>. With <VERSION> only if <KEY> is still at that version
+	SETEX <KEY> <TTL_MS> <VALUE>: Set <KEY> to <VALUE> expiring after <TTL_MS> milliseconds
+	DELETE <KEY> [VERSION]: Delete <KEY> from server. With <VERSION> only if <KEY> is still at that version
+	EXPIRE <KEY> <TTL_MS>: Expire <KEY> after <TTL_MS> milliseconds
+	PERSIST <KEY>: Stop <KEY> from expiring
+	TTL <KEY>: Print how long <KEY> has left before it expires
+	RANGE <START> <END> [LIMIT]: List keys from <START> up to but not including <END> in order. Use - for no end
+	PREFIX <PREFIX> [LIMIT]: List keys starting with <PREFIX> in order e.g. PREFIX user:123:
+	NEXT: Fetch the next page of the last RANGE or PREFIX
+	SETNX <KEY> <VALUE>: Set <KEY> to <VALUE> only if <KEY> doesn't exist
+	SETXX <KEY> <VALUE>: Set <KEY> to <VALUE> only if <KEY> already exists
+	CAS <KEY> <EXPECTED> <VALUE>: Set <KEY> to <VALUE> only if its current value is <EXPECTED>
+	INCR <KEY>: Add 1 to the counter <KEY>. Counters that don't exist start at 0
+	DECR <KEY>: Take 1 from the counter <KEY>
+	INCRBY <KEY> <DELTA>: Add <DELTA>, which may be negative, to the counter <KEY>
+	MGET <KEY> [KEY...]: Fetch the values of several keys in one request
+	MSET <KEY> <VALUE> [KEY VALUE...]: Set several keys in one request
+	MDEL <KEY> [KEY...]: Delete several keys in one request
+	MULTI: Start a transaction. GET, SET and DELETE are queued until EXEC
+	EXEC: Commit the queued commands together and print each one's result
+	DISCARD: Drop the queued commands
+	WATCH <KEY> [KEY...]: Make the next EXEC fail if any of the keys change before it
+	UNWATCH: Stop watching every key
+	SCAN [PATTERN]: List every key matching the glob <PATTERN> e.g. SCAN user:*. Lists every key without a pattern
+	SNAPSHOT: Print a read timestamp that GETAT and SCANAT can read the current data at while writes carry on
+	GETAT <TIMESTAMP> <KEY>: Fetch <KEY> as it was when the snapshot with <TIMESTAMP> was taken
+	SCANAT <TIMESTAMP> [PATTERN]: Like SCAN but lists keys as they were when the snapshot with <TIMESTAMP> was taken
+	HISTORY <KEY> [LIMIT]: List the last values of <KEY> newest first with when they were set
+	GETASOF <TIME> <KEY>: Fetch <KEY> as it was at <TIME>, either RFC 3339 e.g. 2026-01-02T15:04:05Z or Unix milliseconds
+	BGSAVE: Snapshot the server's data in the background and compact its write log
+	BACKUP <NAME>: Copy the server's data to the directory <NAME> under the server's --backup-dir. Start a server with --restore-from pointing at it to restore it
+	DUMP <FILE>: Download a backup of the server's data to <FILE> as a tar archive that --restore-from also accepts
 	HELP: Print this message
 
 	Note: Commands are case insensitive
 `
 
+// Encodes and sends command then decodes the response
+// Prints what went wrong and returns false if any step fails or the server responds with an error
+// NOT_FOUND and CONDITION_FAILED responses are returned to the caller to handle
+func sendCommand(tcpConn *internal.TCPServerConnection, name string, command internal.Command) (*internal.Response, bool) {
+	encoded, err := command.Encode()
+	if err != nil {
+		fmt.Printf("ERROR: Failed to encode %s command. Command: '%+v'. Error: %v\n", name, command, err)
+		return nil, false
+	}
+
+	res, err := tcpConn.SendMessage(encoded)
+	if err != nil {
+		fmt.Printf("ERROR: Failed to send %s command. Command: '%+v'. Error: %v\n", name, command, err)
+		return nil, false
+	}
+
+	decoded, err := internal.DecodeResponse(res)
+	if err != nil {
+		fmt.Printf("ERROR: Failed to decode response. Error: %v\n", err)
+		return nil, false
+	}
+
+	if decoded.ErrorCode != internal.NO_ERROR && decoded.ErrorCode != internal.NOT_FOUND && decoded.ErrorCode != internal.CONDITION_FAILED {
+		fmt.Printf("ERROR: Server responded with error code %d. %s\n", decoded.ErrorCode, decoded.Value)
+		return nil, false
+	}
+
+	return decoded, true
+}
+
+func parseTTL(arg string) (time.Duration, error) {
+	ttlMs, err := strconv.ParseUint(arg, 10, 63)
+	if err != nil || ttlMs == 0 {
+		return 0, fmt.Errorf("expected a positive number of milliseconds. Got '%s'", arg)
+	}
+	return time.Duration(ttlMs) * time.Millisecond, nil
+}
+
+// Accepts RFC 3339 e.g. 2026-01-02T15:04:05Z or Unix milliseconds
+func parseTime(arg string) (time.Time, error) {
+	at, err := time.Parse(time.RFC3339Nano, arg)
+	if err == nil {
+		return at, nil
+	}
+	unixMs, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected an RFC 3339 time or Unix milliseconds. Got '%s'", arg)
+	}
+	return time.UnixMilli(unixMs), nil
+}
+
+func parseVersion(arg string) (uint64, error) {
+	version, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil || version == 0 {
+		return 0, fmt.Errorf("expected a positive version. Got '%s'", arg)
+	}
+	return version, nil
+}
+
+// Prints every key a SCAN or SCANAT finds. cursor is the command's cursor which is moved on after each batch
+// Keeps asking for batches until the server hands back an empty cursor
+func printScan(tcpConn *internal.TCPServerConnection, name string, command internal.Command, cursor *[]byte) {
+	found := 0
+	for {
+		decoded, ok := sendCommand(tcpConn, name, command)
+		if !ok {
+			return
+		}
+
+		keys, next, err := internal.DecodeScanResponse(decoded.Value)
+		if err != nil {
+			fmt.Printf("ERROR: Failed to decode %s response. Error: %v\n", name, err)
+			return
+		}
+		for _, key := range keys {
+			fmt.Println(key)
+		}
+		found += len(keys)
+
+		if len(next) == 0 {
+			fmt.Printf("(%d keys)\n", found)
+			return
+		}
+		*cursor = next
+	}
+}
+
+// Prints the result of each command in a transaction. names are the commands in the order they were queued
+func printTransactionResults(names []string, results []*internal.Response) {
+	for i, result := range results {
+		name := "?"
+		if i < len(names) {
+			name = names[i]
+		}
+		fmt.Printf("%d) %s: ", i+1, name)
+
+		switch {
+		case result.ErrorCode == internal.NOT_FOUND:
+			fmt.Println("(nil)")
+		case result.ErrorCode != internal.NO_ERROR:
+			fmt.Printf("ERROR: error code %d. %s\n", result.ErrorCode, result.Value)
+		case name == "GET":
+			version, value, err := internal.DecodeVersionedValue(result.Value)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to decode GET result. Error: %v\n", err)
+				continue
+			}
+			fmt.Printf("%s (version %d)\n", value, version)
+		case name == "SET":
+			version, err := internal.DecodeVersion(result.Value)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to decode SET result. Error: %v\n", err)
+				continue
+			}
+			fmt.Printf("Success! (version %d)\n", version)
+		default:
+			fmt.Println("Success!")
+		}
+	}
+}
+
+// Writes a backup streamed back by the server to path as it arrives and returns its size
+// Removes path if the backup doesn't arrive in full
+func dumpBackup(tcpConn *internal.TCPServerConnection, path string) (int, error) {
+	encoded, err := (&internal.BackupCommand{}).Encode()
+	if err != nil {
+		return 0, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	size := 0
+	err = tcpConn.SendMessageStream(encoded, func(res []byte) error {
+		decoded, err := internal.DecodeResponse(res)
+		if err != nil {
+			return err
+		}
+		if decoded.ErrorCode != internal.NO_ERROR {
+			return fmt.Errorf("server responded with error code %d. %s", decoded.ErrorCode, decoded.Value)
+		}
+		size += len(decoded.Value)
+		_, err = file.Write(decoded.Value)
+		return err
+	})
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return 0, err
+	}
+	return size, nil
+}
+
 func main() {
 	fmt.Printf("Connecting to server on %s\n", SERVER_ADDRESS)
 	tcpConn, err := internal.CreateTCPServerConnection(SERVER_ADDRESS)
 	if err != nil {
 		log.Fatalf("Failed to start TCP Server Connection. Error: %v\n", err)
 	}
+	fmt.Printf("Connected using protocol version %d. Server features: %v\n", tcpConn.Hello.Version, tcpConn.Hello.Features)
+
+	// The last RANGE or PREFIX so NEXT can carry on from its cursor
+	var lastRange *internal.RangeCommand
+	// Commands queued since MULTI so EXEC knows how to print each result. nil outside a transaction
+	var queued []string
 
 	scanner := bufio.NewScanner(os.Stdin)
 	fmt.Print("> ")
@@ -49,96 +247,637 @@ func main() {
 				continue
 			}
 
-			getCommand := internal.GetCommand{Key: splitLine[1]}
-			encoded, err := getCommand.Encode()
+			decoded, ok := sendCommand(tcpConn, command, &internal.GetCommand{Key: splitLine[1]})
+			if !ok {
+				continue
+			}
+
+			if queued != nil {
+				queued = append(queued, command)
+				fmt.Printf("%s\n", decoded.Value)
+				continue
+			}
+
+			if decoded.ErrorCode == internal.NOT_FOUND {
+				fmt.Println("(nil)")
+				continue
+			}
+
+			version, value, err := internal.DecodeVersionedValue(decoded.Value)
 			if err != nil {
-				fmt.Printf("ERROR: Failed to encode GET command. Command: '%+v'. Error: %v\n", getCommand, err)
+				fmt.Printf("ERROR: Failed to decode GET response. Error: %v\n", err)
+				continue
+			}
+
+			fmt.Printf("%s (version %d)\n", value, version)
+
+		case "SET":
+			if len(splitLine) != 3 && len(splitLine) != 4 {
+				fmt.Printf("SET command takes two or three arguments. Got %d.\n", len(splitLine)-1)
 				continue
 			}
 
-			res, err := tcpConn.SendMessage(encoded)
+			setCommand := internal.SetCommand{Key: splitLine[1], Value: []byte(splitLine[2])}
+			if len(splitLine) == 4 {
+				expectedVersion, err := parseVersion(splitLine[3])
+				if err != nil {
+					fmt.Printf("SET command %v\n", err)
+					continue
+				}
+				setCommand.ExpectedVersion = expectedVersion
+			}
+
+			decoded, ok := sendCommand(tcpConn, command, &setCommand)
+			if !ok {
+				continue
+			}
+
+			if queued != nil {
+				queued = append(queued, command)
+				fmt.Printf("%s\n", decoded.Value)
+				continue
+			}
+
+			if decoded.ErrorCode == internal.CONDITION_FAILED {
+				fmt.Println("Not set. Key has changed")
+				continue
+			}
+
+			version, err := internal.DecodeVersion(decoded.Value)
 			if err != nil {
-				fmt.Printf("ERROR: Failed to send GET command. Command: '%+v'. Error: %v\n", getCommand, err)
+				fmt.Printf("ERROR: Failed to decode SET response. Error: %v\n", err)
+				continue
+			}
+
+			fmt.Printf("Success! (version %d)\n", version)
+
+		case "SETEX":
+			if len(splitLine) != 4 {
+				fmt.Printf("SETEX command takes three arguments. Got %d.\n", len(splitLine)-1)
 				continue
 			}
 
-			decoded, err := internal.DecodeResponse(res)
+			ttl, err := parseTTL(splitLine[2])
 			if err != nil {
-				fmt.Printf("ERROR: Failed to decode response. Error: %v\n", err)
+				fmt.Printf("SETEX command %v\n", err)
 				continue
 			}
 
-			if decoded.ErrorCode != internal.NO_ERROR {
-				fmt.Printf("ERROR: Server responeded with Error code %d\n", decoded.ErrorCode)
+			_, ok := sendCommand(tcpConn, command, &internal.SetWithTTLCommand{Key: splitLine[1], Value: []byte(splitLine[3]), TTL: ttl})
+			if !ok {
 				continue
 			}
 
-			fmt.Printf("%s\n", decoded.Value)
+			fmt.Println("Success!")
 
-		case "SET":
+		case "DELETE":
+			if len(splitLine) != 2 && len(splitLine) != 3 {
+				fmt.Printf("DELETE command takes one or two arguments. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			deleteCommand := internal.DeleteCommand{Key: splitLine[1]}
+			if len(splitLine) == 3 {
+				expectedVersion, err := parseVersion(splitLine[2])
+				if err != nil {
+					fmt.Printf("DELETE command %v\n", err)
+					continue
+				}
+				deleteCommand.ExpectedVersion = expectedVersion
+			}
+
+			decoded, ok := sendCommand(tcpConn, command, &deleteCommand)
+			if !ok {
+				continue
+			}
+
+			if queued != nil {
+				queued = append(queued, command)
+				fmt.Printf("%s\n", decoded.Value)
+				continue
+			}
+
+			if decoded.ErrorCode == internal.CONDITION_FAILED {
+				fmt.Println("Not deleted. Key has changed")
+				continue
+			}
+
+			fmt.Println("Success!")
+
+		case "EXPIRE":
 			if len(splitLine) != 3 {
-				fmt.Printf("SET command takes two arguments. Got %d.\n", len(splitLine)-1)
+				fmt.Printf("EXPIRE command takes two arguments. Got %d.\n", len(splitLine)-1)
 				continue
 			}
 
-			setCommand := internal.SetCommand{Key: splitLine[1], Value: splitLine[2]}
-			encoded, err := setCommand.Encode()
+			ttl, err := parseTTL(splitLine[2])
 			if err != nil {
-				fmt.Printf("ERROR: Failed to encode SET command. Command: '%+v'. Error: %v\n", setCommand, err)
+				fmt.Printf("EXPIRE command %v\n", err)
+				continue
+			}
+
+			decoded, ok := sendCommand(tcpConn, command, &internal.ExpireCommand{Key: splitLine[1], TTL: ttl})
+			if !ok {
+				continue
+			}
+
+			if decoded.ErrorCode == internal.NOT_FOUND {
+				fmt.Println("(nil)")
+				continue
+			}
+
+			fmt.Println("Success!")
+
+		case "PERSIST":
+			if len(splitLine) != 2 {
+				fmt.Printf("PERSIST command takes one argument. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			decoded, ok := sendCommand(tcpConn, command, &internal.PersistCommand{Key: splitLine[1]})
+			if !ok {
+				continue
+			}
+
+			if decoded.ErrorCode == internal.NOT_FOUND {
+				fmt.Println("(nil)")
+				continue
+			}
+
+			fmt.Println("Success!")
+
+		case "TTL":
+			if len(splitLine) != 2 {
+				fmt.Printf("TTL command takes one argument. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			decoded, ok := sendCommand(tcpConn, command, &internal.TTLCommand{Key: splitLine[1]})
+			if !ok {
 				continue
 			}
 
-			res, err := tcpConn.SendMessage(encoded)
+			if decoded.ErrorCode == internal.NOT_FOUND {
+				fmt.Println("(nil)")
+				continue
+			}
+
+			ttl, expires, err := internal.DecodeTTL(decoded.Value)
 			if err != nil {
-				fmt.Printf("ERROR: Failed to send SET command. Command: '%+v'. Error: %v\n", setCommand, err)
+				fmt.Printf("ERROR: Failed to decode TTL. Error: %v\n", err)
+				continue
+			}
+
+			if !expires {
+				fmt.Println("(no expiry)")
+				continue
+			}
+
+			fmt.Printf("%dms\n", ttl.Milliseconds())
+
+		case "RANGE", "PREFIX", "NEXT":
+			var rangeCommand internal.RangeCommand
+			var limitArg string
+			switch {
+			case command == "RANGE" && (len(splitLine) == 3 || len(splitLine) == 4):
+				rangeCommand.Start, rangeCommand.End = splitLine[1], splitLine[2]
+				if rangeCommand.End == "-" {
+					rangeCommand.End = ""
+				}
+				if len(splitLine) == 4 {
+					limitArg = splitLine[3]
+				}
+			case command == "PREFIX" && (len(splitLine) == 2 || len(splitLine) == 3):
+				rangeCommand.Start, rangeCommand.End = internal.PrefixRange(splitLine[1])
+				if len(splitLine) == 3 {
+					limitArg = splitLine[2]
+				}
+			case command == "NEXT" && len(splitLine) == 1:
+				if lastRange == nil || lastRange.Start == "" {
+					fmt.Println("No more keys. Run RANGE or PREFIX first")
+					continue
+				}
+				rangeCommand = *lastRange
+			default:
+				fmt.Printf("Wrong number of arguments for %s. Got %d.\n", command, len(splitLine)-1)
 				continue
 			}
 
-			decoded, err := internal.DecodeResponse(res)
+			if limitArg != "" {
+				limit, err := strconv.ParseUint(limitArg, 10, 32)
+				if err != nil {
+					fmt.Printf("%s command expected a number for the limit. Got '%s'\n", command, limitArg)
+					continue
+				}
+				rangeCommand.Limit = uint32(limit)
+			}
+
+			decoded, ok := sendCommand(tcpConn, command, &rangeCommand)
+			if !ok {
+				continue
+			}
+
+			pairs, cursor, err := internal.DecodeRangeResponse(decoded.Value)
 			if err != nil {
-				fmt.Printf("ERROR: Failed to decode response. Error: %v\n", err)
+				fmt.Printf("ERROR: Failed to decode %s response. Error: %v\n", command, err)
 				continue
 			}
 
-			if decoded.ErrorCode != internal.NO_ERROR {
-				fmt.Printf("ERROR: Server responeded with Error code %d\n", decoded.ErrorCode)
+			for _, pair := range pairs {
+				fmt.Printf("%s: %s\n", pair.Key, pair.Value)
+			}
+			if len(pairs) == 0 {
+				fmt.Println("(empty)")
+			}
+
+			rangeCommand.Start = cursor
+			lastRange = &rangeCommand
+			if cursor != "" {
+				fmt.Println("More keys available. Run NEXT for the next page")
+			}
+
+		case "SETNX", "SETXX", "CAS":
+			var conditionalCommand internal.Command
+			switch {
+			case command == "SETNX" && len(splitLine) == 3:
+				conditionalCommand = &internal.SetNXCommand{Key: splitLine[1], Value: []byte(splitLine[2])}
+			case command == "SETXX" && len(splitLine) == 3:
+				conditionalCommand = &internal.SetXXCommand{Key: splitLine[1], Value: []byte(splitLine[2])}
+			case command == "CAS" && len(splitLine) == 4:
+				conditionalCommand = &internal.CASCommand{Key: splitLine[1], Expected: []byte(splitLine[2]), Value: []byte(splitLine[3])}
+			default:
+				fmt.Printf("Wrong number of arguments for %s. Got %d.\n", command, len(splitLine)-1)
+				continue
+			}
+
+			decoded, ok := sendCommand(tcpConn, command, conditionalCommand)
+			if !ok {
+				continue
+			}
+
+			if decoded.ErrorCode == internal.CONDITION_FAILED {
+				fmt.Println("Not set. Condition failed")
 				continue
 			}
 
 			fmt.Println("Success!")
 
-		case "DELETE":
-			if len(splitLine) != 2 {
-				fmt.Printf("DELETE command takes one argument. Got %d.\n", len(splitLine)-1)
+		case "INCR", "DECR", "INCRBY":
+			var counterCommand internal.Command
+			switch {
+			case command == "INCR" && len(splitLine) == 2:
+				counterCommand = &internal.IncrCommand{Key: splitLine[1]}
+			case command == "DECR" && len(splitLine) == 2:
+				counterCommand = &internal.DecrCommand{Key: splitLine[1]}
+			case command == "INCRBY" && len(splitLine) == 3:
+				delta, err := strconv.ParseInt(splitLine[2], 10, 64)
+				if err != nil {
+					fmt.Printf("INCRBY command expected a whole number for the delta. Got '%s'\n", splitLine[2])
+					continue
+				}
+				counterCommand = &internal.IncrByCommand{Key: splitLine[1], Delta: delta}
+			default:
+				fmt.Printf("Wrong number of arguments for %s. Got %d.\n", command, len(splitLine)-1)
 				continue
 			}
 
-			deleteCommand := internal.DeleteCommand{Key: splitLine[1]}
-			encoded, err := deleteCommand.Encode()
+			decoded, ok := sendCommand(tcpConn, command, counterCommand)
+			if !ok {
+				continue
+			}
+
+			value, err := internal.DecodeInteger(decoded.Value)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to decode %s response. Error: %v\n", command, err)
+				continue
+			}
+
+			fmt.Println(value)
+
+		case "MGET":
+			if len(splitLine) < 2 {
+				fmt.Println("MGET command takes at least one argument.")
+				continue
+			}
+
+			keys := splitLine[1:]
+			values, err := tcpConn.MGet(keys...)
+			if err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+				continue
+			}
+
+			for i, key := range keys {
+				if values[i] == nil {
+					fmt.Printf("%s: (nil)\n", key)
+					continue
+				}
+				fmt.Printf("%s: %s\n", key, values[i])
+			}
+
+		case "MSET":
+			if len(splitLine) < 3 || len(splitLine)%2 != 1 {
+				fmt.Printf("MSET command takes pairs of keys and values. Got %d arguments.\n", len(splitLine)-1)
+				continue
+			}
+
+			var pairs []internal.KeyValue
+			for i := 1; i < len(splitLine); i += 2 {
+				pairs = append(pairs, internal.KeyValue{Key: splitLine[i], Value: []byte(splitLine[i+1])})
+			}
+			err := tcpConn.MSet(pairs...)
+			if err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+				continue
+			}
+
+			fmt.Println("Success!")
+
+		case "MDEL":
+			if len(splitLine) < 2 {
+				fmt.Println("MDEL command takes at least one argument.")
+				continue
+			}
+
+			err := tcpConn.MDel(splitLine[1:]...)
+			if err != nil {
+				fmt.Printf("ERROR: %v\n", err)
+				continue
+			}
+
+			fmt.Println("Success!")
+
+		case "SCAN":
+			if len(splitLine) > 2 {
+				fmt.Printf("SCAN command expects at most 1 argument. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			scanCommand := internal.ScanCommand{}
+			if len(splitLine) == 2 {
+				scanCommand.Match = splitLine[1]
+			}
+
+			printScan(tcpConn, command, &scanCommand, &scanCommand.Cursor)
+
+		case "SNAPSHOT":
+			if len(splitLine) != 1 {
+				fmt.Printf("SNAPSHOT command takes no arguments. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			decoded, ok := sendCommand(tcpConn, command, &internal.SnapshotCommand{})
+			if !ok {
+				continue
+			}
+
+			timestamp, err := internal.DecodeVersion(decoded.Value)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to decode SNAPSHOT response. Error: %v\n", err)
+				continue
+			}
+
+			fmt.Printf("Read timestamp %d\n", timestamp)
+
+		case "GETAT":
+			if len(splitLine) != 3 {
+				fmt.Printf("GETAT command takes exactly two arguments. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			timestamp, err := strconv.ParseUint(splitLine[1], 10, 64)
+			if err != nil {
+				fmt.Printf("GETAT command expected a read timestamp. Got '%s'\n", splitLine[1])
+				continue
+			}
+
+			decoded, ok := sendCommand(tcpConn, command, &internal.GetAtCommand{Key: splitLine[2], Timestamp: timestamp})
+			if !ok {
+				continue
+			}
+
+			if decoded.ErrorCode == internal.NOT_FOUND {
+				fmt.Println("(nil)")
+				continue
+			}
+
+			version, value, err := internal.DecodeVersionedValue(decoded.Value)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to decode GETAT response. Error: %v\n", err)
+				continue
+			}
+
+			fmt.Printf("%s (version %d)\n", value, version)
+
+		case "SCANAT":
+			if len(splitLine) != 2 && len(splitLine) != 3 {
+				fmt.Printf("SCANAT command takes one or two arguments. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			timestamp, err := strconv.ParseUint(splitLine[1], 10, 64)
+			if err != nil {
+				fmt.Printf("SCANAT command expected a read timestamp. Got '%s'\n", splitLine[1])
+				continue
+			}
+
+			scanAtCommand := internal.ScanAtCommand{Timestamp: timestamp}
+			if len(splitLine) == 3 {
+				scanAtCommand.Match = splitLine[2]
+			}
+
+			printScan(tcpConn, command, &scanAtCommand, &scanAtCommand.Cursor)
+
+		case "HISTORY":
+			if len(splitLine) != 2 && len(splitLine) != 3 {
+				fmt.Printf("HISTORY command takes one or two arguments. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			historyCommand := internal.HistoryCommand{Key: splitLine[1]}
+			if len(splitLine) == 3 {
+				limit, err := strconv.ParseUint(splitLine[2], 10, 32)
+				if err != nil {
+					fmt.Printf("HISTORY command expected a number for the limit. Got '%s'\n", splitLine[2])
+					continue
+				}
+				historyCommand.Limit = uint32(limit)
+			}
+
+			decoded, ok := sendCommand(tcpConn, command, &historyCommand)
+			if !ok {
+				continue
+			}
+
+			history, err := internal.DecodeHistoryResponse(decoded.Value)
 			if err != nil {
-				fmt.Printf("ERROR: Failed to encode DELETE command. Command: '%+v'. Error: %v\n", deleteCommand, err)
+				fmt.Printf("ERROR: Failed to decode HISTORY response. Error: %v\n", err)
 				continue
 			}
+			for _, entry := range history {
+				value := "(deleted)"
+				if entry.Value != nil {
+					value = string(entry.Value)
+				}
+				fmt.Printf("%s version %d: %s\n", entry.LoggedAt.Format(time.RFC3339Nano), entry.Version, value)
+			}
+			fmt.Printf("(%d values)\n", len(history))
 
-			res, err := tcpConn.SendMessage(encoded)
+		case "GETASOF":
+			if len(splitLine) != 3 {
+				fmt.Printf("GETASOF command takes exactly two arguments. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			at, err := parseTime(splitLine[1])
 			if err != nil {
-				fmt.Printf("ERROR: Failed to send DELETE command. Command: '%+v'. Error: %v\n", deleteCommand, err)
+				fmt.Printf("GETASOF command %v\n", err)
+				continue
+			}
+
+			decoded, ok := sendCommand(tcpConn, command, &internal.GetAsOfCommand{Key: splitLine[2], At: at})
+			if !ok {
+				continue
+			}
+
+			if decoded.ErrorCode == internal.NOT_FOUND {
+				fmt.Println("(nil)")
+				continue
+			}
+
+			version, value, err := internal.DecodeVersionedValue(decoded.Value)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to decode GETASOF response. Error: %v\n", err)
+				continue
+			}
+
+			fmt.Printf("%s (version %d)\n", value, version)
+
+		case "MULTI":
+			if len(splitLine) != 1 {
+				fmt.Printf("MULTI command takes no arguments. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			_, ok := sendCommand(tcpConn, command, &internal.MultiCommand{})
+			if !ok {
 				continue
 			}
 
-			decoded, err := internal.DecodeResponse(res)
+			queued = []string{}
+			fmt.Println("Success!")
+
+		case "EXEC":
+			if len(splitLine) != 1 {
+				fmt.Printf("EXEC command takes no arguments. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			// The server ends the transaction whether or not EXEC succeeds
+			names := queued
+			queued = nil
+			decoded, ok := sendCommand(tcpConn, command, &internal.ExecCommand{})
+			if !ok {
+				continue
+			}
+
+			if decoded.ErrorCode == internal.CONDITION_FAILED {
+				fmt.Println("Transaction aborted. A key has changed")
+				continue
+			}
+
+			results, err := internal.DecodeTransactionResults(decoded.Value)
 			if err != nil {
-				fmt.Printf("ERROR: Failed to decode response. Error: %v\n", err)
+				fmt.Printf("ERROR: Failed to decode EXEC response. Error: %v\n", err)
+				continue
+			}
+			printTransactionResults(names, results)
+
+		case "DISCARD":
+			if len(splitLine) != 1 {
+				fmt.Printf("DISCARD command takes no arguments. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			_, ok := sendCommand(tcpConn, command, &internal.DiscardCommand{})
+			if !ok {
+				continue
+			}
+
+			queued = nil
+			fmt.Println("Success!")
+
+		case "WATCH":
+			if len(splitLine) < 2 {
+				fmt.Println("WATCH command takes at least one argument.")
 				continue
 			}
 
-			if decoded.ErrorCode != internal.NO_ERROR {
-				fmt.Printf("ERROR: Server responeded with Error code %d\n", decoded.ErrorCode)
+			_, ok := sendCommand(tcpConn, command, &internal.WatchCommand{Keys: splitLine[1:]})
+			if !ok {
 				continue
 			}
 
 			fmt.Println("Success!")
 
+		case "UNWATCH":
+			if len(splitLine) != 1 {
+				fmt.Printf("UNWATCH command takes no arguments. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			_, ok := sendCommand(tcpConn, command, &internal.UnwatchCommand{})
+			if !ok {
+				continue
+			}
+
+			fmt.Println("Success!")
+
+		case "BGSAVE":
+			if len(splitLine) != 1 {
+				fmt.Printf("BGSAVE command takes no arguments. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			decoded, ok := sendCommand(tcpConn, command, &internal.BgsaveCommand{})
+			if !ok {
+				continue
+			}
+
+			fmt.Printf("%s\n", decoded.Value)
+
+		case "BACKUP":
+			if len(splitLine) != 2 {
+				fmt.Printf("BACKUP command takes one argument. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			decoded, ok := sendCommand(tcpConn, command, &internal.BackupCommand{Dir: splitLine[1]})
+			if !ok {
+				continue
+			}
+			seq, err := internal.DecodeVersion(decoded.Value)
+			if err != nil {
+				fmt.Printf("ERROR: Failed to decode BACKUP response. Error: %v\n", err)
+				continue
+			}
+
+			fmt.Printf("Backed up to %s on the server up to sequence number %d\n", splitLine[1], seq)
+
+		case "DUMP":
+			if len(splitLine) != 2 {
+				fmt.Printf("DUMP command takes one argument. Got %d.\n", len(splitLine)-1)
+				continue
+			}
+
+			size, err := dumpBackup(tcpConn, splitLine[1])
+			if err != nil {
+				fmt.Printf("ERROR: Failed to save backup. Error: %v\n", err)
+				continue
+			}
+
+			fmt.Printf("Saved %d byte backup to %s\n", size, splitLine[1])
+
 		case "HELP":
 			fmt.Print(HELP_MESSAGE)
 
@@ -0,0 +1,345 @@
+package internal
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	writelogger "github.com/willcruse/kvdb/server/v2/internal/write-logger"
+)
+
+const (
+	// Max bytes of a streamed backup sent in one response
+	BACKUP_CHUNK_SIZE = 64 * 1024
+)
+
+// Somewhere the files of a backup are written to
+type backupWriter interface {
+	writeFile(name string, size int64, contents io.Reader) error
+}
+
+// Writes a backup to a directory that's usable as a data directory
+type dirBackupWriter struct {
+	dir string
+}
+
+// Creates dir if needed. Fails if it already holds anything so a backup or restore never overwrites data
+func newDirBackupWriter(dir string) (*dirBackupWriter, error) {
+	err := checkEmptyDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("(Backup) Failed to create %s. Error: %w", dir, err)
+	}
+	return &dirBackupWriter{dir: dir}, nil
+}
+
+func (dbw *dirBackupWriter) writeFile(name string, size int64, contents io.Reader) error {
+	path := filepath.Join(dbw.dir, name)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("(Backup) Failed to create %s. Error: %w", path, err)
+	}
+
+	_, err = io.CopyN(file, contents, size)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("(Backup) Failed to write %s. Error: %w", path, err)
+	}
+	return nil
+}
+
+// Makes the new files durable
+func (dbw *dirBackupWriter) finish() {
+	writelogger.SyncDir(dbw.dir)
+}
+
+// Writes a backup as a tar archive of the files a data directory would hold
+type tarBackupWriter struct {
+	writer *tar.Writer
+}
+
+func (tbw *tarBackupWriter) writeFile(name string, size int64, contents io.Reader) error {
+	err := tbw.writer.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644, ModTime: time.Now()})
+	if err != nil {
+		return fmt.Errorf("(Backup) Failed to add %s to archive. Error: %w", name, err)
+	}
+	_, err = io.CopyN(tbw.writer, contents, size)
+	if err != nil {
+		return fmt.Errorf("(Backup) Failed to add %s to archive. Error: %w", name, err)
+	}
+	return nil
+}
+
+// Copies the snapshot and the write log to writer and returns the sequence number of the last write included
+//
+// Writes carry on while it runs. The write log copy ends at the last record appended when it starts and the snapshot
+// is whichever was last written, so together they hold every write up to that record.
+// Holds snapshotLock so no snapshot replaces the snapshot or compacts away records part way through.
+func (server *Server) backup(writer backupWriter) (uint64, error) {
+	logger, ok := server.WriteLogger.(writelogger.BackupWriteLogger)
+	if !ok {
+		return 0, fmt.Errorf("(Server) Backups need a write log that can be copied while it's appended to")
+	}
+
+	server.snapshotLock.Lock()
+	defer server.snapshotLock.Unlock()
+
+	start := time.Now()
+	if server.SnapshotPath != "" {
+		err := copySnapshot(server.SnapshotPath, writer)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	seq, err := logger.Backup(writer.writeFile)
+	if err != nil {
+		return 0, fmt.Errorf("(Server) Failed to back up write log. Error: %w", err)
+	}
+
+	log.Printf("Backup up to sequence number %d written in %s\n", seq, time.Since(start))
+	return seq, nil
+}
+
+// Does nothing if no snapshot has been taken yet
+func copySnapshot(path string, writer backupWriter) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("(Server) Failed to open snapshot %s for backup. Error: %w", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("(Server) Failed to stat snapshot %s. Error: %w", path, err)
+	}
+	return writer.writeFile(SNAPSHOT_FILE_NAME, info.Size(), file)
+}
+
+// Writes a backup to the directory named by Key under BackupDir and responds with the 8 byte big endian sequence number of the last write it holds
+func (server *Server) executeBackup(command commands.Command) commands.Response {
+	if _, ok := server.WriteLogger.(writelogger.BackupWriteLogger); !ok {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "backups need a write log that can be copied while it's appended to")
+	}
+	if server.BackupDir == "" {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "backing up to a directory on the server needs the server to be started with --backup-dir")
+	}
+	// Keys name a single directory so clients can't write anywhere else on the server
+	if command.Key == "." || strings.Contains(command.Key, "..") || strings.ContainsAny(command.Key, "/"+string(os.PathSeparator)) {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "can't back up to %s. Backups are named by a single directory name under the server's backup directory", command.Key)
+	}
+
+	writer, err := newDirBackupWriter(filepath.Join(server.BackupDir, command.Key))
+	if err != nil {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "can't back up to %s as %v", command.Key, err)
+	}
+	seq, err := server.backup(writer)
+	if err != nil {
+		log.Printf("handler_net_conn: Error writing backup %v\n", err)
+		return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to back up to %s", command.Key)
+	}
+	writer.finish()
+
+	return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE, Message: binary.BigEndian.AppendUint64(nil, seq)}
+}
+
+// Sends a response for each chunk of bytes written to it
+type chunkWriter struct {
+	sess      *session
+	requestID uint32
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:min(len(p), written+BACKUP_CHUNK_SIZE)]
+		err := cw.sess.send(commands.Response{RequestID: cw.requestID, ErrorCode: commands.NO_ERROR_ERROR_CODE, Message: chunk})
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// Sends a backup back to the client as a tar archive split over many responses to requestID
+//
+// Each response holds up to BACKUP_CHUNK_SIZE bytes of the archive and an empty response ends it, so only a chunk
+// is held in memory whatever the size of the backup. An error response part way through means the archive is incomplete.
+// Needs length prefixed responses as version 1 sends an empty response as a bare error code.
+func (server *Server) streamBackup(sess *session, requestID uint32) {
+	if _, ok := server.WriteLogger.(writelogger.BackupWriteLogger); !ok {
+		sess.respond(requestID, commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "backups need a write log that can be copied while it's appended to"))
+		return
+	}
+	if sess.codec.Version < commands.PROTOCOL_VERSION_2 {
+		sess.respond(requestID, commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "streaming a backup needs protocol version %d or later", commands.PROTOCOL_VERSION_2))
+		return
+	}
+
+	buffered := bufio.NewWriterSize(&chunkWriter{sess: sess, requestID: requestID}, BACKUP_CHUNK_SIZE)
+	tarWriter := tar.NewWriter(buffered)
+	_, err := server.backup(&tarBackupWriter{writer: tarWriter})
+	if err == nil {
+		err = tarWriter.Close()
+	}
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		log.Printf("handler_net_conn: Error streaming backup %v\n", err)
+		sess.respond(requestID, commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to back up"))
+		return
+	}
+	sess.respond(requestID, commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE})
+}
+
+// Checks dir is empty or doesn't exist so a backup or restore never overwrites data
+func checkEmptyDir(dir string) error {
+	existing, err := os.ReadDir(dir)
+	if err == nil && len(existing) > 0 {
+		return fmt.Errorf("(Backup) %s is not empty. Backups and restores never overwrite existing files", dir)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("(Backup) Failed to list %s. Error: %w", dir, err)
+	}
+	return nil
+}
+
+// Copies a backup made by BACKUP into dataDir, which must be empty or not exist
+// source is either a backup directory or a tar archive streamed by BACKUP
+//
+// The backup is copied into a temporary directory that's renamed to dataDir once complete,
+// so a restore that fails part way leaves dataDir as it was.
+func Restore(source string, dataDir string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return fmt.Errorf("(Restore) Failed to open backup %s. Error: %w", source, err)
+	}
+	err = checkEmptyDir(dataDir)
+	if err != nil {
+		return err
+	}
+
+	tmpDir := filepath.Clean(dataDir) + ".restoring"
+	err = os.RemoveAll(tmpDir)
+	if err != nil {
+		return fmt.Errorf("(Restore) Failed to remove %s. Error: %w", tmpDir, err)
+	}
+	defer os.RemoveAll(tmpDir)
+	writer, err := newDirBackupWriter(tmpDir)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		err = restoreDir(source, writer)
+	} else {
+		err = restoreArchive(source, writer)
+	}
+	if err != nil {
+		return err
+	}
+	writer.finish()
+
+	// Written last by BACKUP so a backup cut short won't have one
+	_, err = os.Stat(filepath.Join(tmpDir, writelogger.MANIFEST_FILE_NAME))
+	if err != nil {
+		return fmt.Errorf("(Restore) %s is not a complete backup as it has no write log manifest. Error: %w", source, err)
+	}
+
+	// Checked empty above. os.Rename won't replace a directory even if it's empty
+	err = os.Remove(dataDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("(Restore) Failed to remove empty %s. Error: %w", dataDir, err)
+	}
+	err = os.Rename(tmpDir, dataDir)
+	if err != nil {
+		return fmt.Errorf("(Restore) Failed to move %s into place at %s. Error: %w", tmpDir, dataDir, err)
+	}
+	writelogger.SyncDir(filepath.Dir(filepath.Clean(dataDir)))
+
+	log.Printf("Restored backup %s into %s\n", source, dataDir)
+	return nil
+}
+
+func restoreDir(dir string, writer backupWriter) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("(Restore) Failed to list %s. Error: %w", dir, err)
+	}
+
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		err = restoreFile(filepath.Join(dir, entry.Name()), writer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func restoreFile(path string, writer backupWriter) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("(Restore) Failed to open %s. Error: %w", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("(Restore) Failed to stat %s. Error: %w", path, err)
+	}
+	return writer.writeFile(filepath.Base(path), info.Size(), file)
+}
+
+func restoreArchive(path string, writer backupWriter) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("(Restore) Failed to open %s. Error: %w", path, err)
+	}
+	defer file.Close()
+
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("(Restore) Failed to read archive %s. Error: %w", path, err)
+		}
+		// Backups are flat so anything else would be written outside the data directory
+		if header.Typeflag != tar.TypeReg || header.Name != filepath.Base(header.Name) || header.Name == ".." {
+			return fmt.Errorf("(Restore) Unexpected entry %s in archive %s", header.Name, path)
+		}
+
+		err = writer.writeFile(header.Name, header.Size, reader)
+		if err != nil {
+			return err
+		}
+	}
+}
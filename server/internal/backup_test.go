@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+)
+
+func expectKeys(t *testing.T, server *Server, expected map[string]string) {
+	for key, value := range expected {
+		stored, err := server.StorageBackend.Get(key)
+		if err != nil || string(stored) != value {
+			t.Errorf("Expected %s to be %s. Got %q and err = %v", key, value, stored, err)
+		}
+	}
+}
+
+// Splits responses encoded with protocol version 4 into their error codes and messages
+func readResponses(t *testing.T, encoded []byte) ([]uint8, [][]byte) {
+	var errorCodes []uint8
+	var messages [][]byte
+	for len(encoded) > 0 {
+		if len(encoded) < commands.REQUEST_ID_SIZE+1+commands.LENGTH_PREFIX_SIZE {
+			t.Fatalf("Expected a whole response header. Got %d bytes", len(encoded))
+		}
+		encoded = encoded[commands.REQUEST_ID_SIZE:]
+		size := int(binary.BigEndian.Uint32(encoded[1:]))
+		errorCodes = append(errorCodes, encoded[0])
+		messages = append(messages, encoded[1+commands.LENGTH_PREFIX_SIZE:1+commands.LENGTH_PREFIX_SIZE+size])
+		encoded = encoded[1+commands.LENGTH_PREFIX_SIZE+size:]
+	}
+	return errorCodes, messages
+}
+
+func TestBackupToDirectoryHoldsSnapshotAndLogTail(t *testing.T) {
+	server := newDiskLoggedServer(t, t.TempDir())
+	server.BackupDir = t.TempDir()
+	server.commit(commands.CreateSetCommand("snapshotted", []byte("1")))
+	err := server.snapshot()
+	if err != nil {
+		t.Fatalf("Failed to snapshot. Got err = %s", err)
+	}
+	server.commit(commands.CreateSetCommand("logged", []byte("2")))
+
+	response := server.executeBackup(commands.Command{Identifier: commands.BACKUP_COMMAND, Key: "backup"})
+	if response.ErrorCode != commands.NO_ERROR_ERROR_CODE || binary.BigEndian.Uint64(response.Message) != 2 {
+		t.Fatalf("Expected a backup up to sequence number 2. Got %+v", response)
+	}
+	// Writes after the backup aren't in it
+	server.commit(commands.CreateSetCommand("later", []byte("3")))
+
+	dataDir := t.TempDir()
+	err = Restore(filepath.Join(server.BackupDir, "backup"), dataDir)
+	if err != nil {
+		t.Fatalf("Failed to restore. Got err = %s", err)
+	}
+	restored := newDiskLoggedServer(t, dataDir)
+	expectKeys(t, restored, map[string]string{"snapshotted": "1", "logged": "2"})
+	if restored.WriteLogger.LastSeq() != 2 {
+		t.Errorf("Expected the restored log to end at the backup. Got LastSeq %d", restored.WriteLogger.LastSeq())
+	}
+
+	response = server.executeBackup(commands.Command{Identifier: commands.BACKUP_COMMAND, Key: "backup"})
+	if response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected backing up over an existing backup to be a user error. Got %+v", response)
+	}
+}
+
+func TestBackupToDirectoryNeedsBackupDir(t *testing.T) {
+	server := newDiskLoggedServer(t, t.TempDir())
+	response := server.executeBackup(commands.Command{Identifier: commands.BACKUP_COMMAND, Key: "backup"})
+	if response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected BACKUP to a directory without a backup dir to be a user error. Got %+v", response)
+	}
+}
+
+func TestBackupRejectsKeysOutsideBackupDir(t *testing.T) {
+	server := newDiskLoggedServer(t, t.TempDir())
+	server.BackupDir = filepath.Join(t.TempDir(), "backups")
+
+	for _, key := range []string{"..", ".", "../escaped", "nested/backup", "/tmp/backup", "a..b"} {
+		response := server.executeBackup(commands.Command{Identifier: commands.BACKUP_COMMAND, Key: key})
+		if response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+			t.Errorf("Expected BACKUP to %q to be a user error. Got %+v", key, response)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Dir(server.BackupDir))
+	if len(entries) != 0 {
+		t.Errorf("Expected rejected backups to create nothing. Got %d entries", len(entries))
+	}
+}
+
+func TestStreamedBackupRestores(t *testing.T) {
+	server := newDiskLoggedServer(t, t.TempDir())
+	// Big enough to need several chunks
+	large := bytes.Repeat([]byte("v"), 3*BACKUP_CHUNK_SIZE)
+	server.commit(commands.CreateMultiSetCommand([]string{"a", "b"}, [][]byte{[]byte("1"), large}))
+
+	conn := &recordingConn{}
+	server.streamBackup(newSession(conn, &commands.Codec{Version: commands.PROTOCOL_VERSION_4}), 7)
+	errorCodes, messages := readResponses(t, conn.Bytes())
+	if len(messages) < 4 || len(messages[len(messages)-1]) != 0 {
+		t.Fatalf("Expected several chunks ending in an empty response. Got %d responses", len(messages))
+	}
+
+	var archive []byte
+	for i, message := range messages {
+		if errorCodes[i] != commands.NO_ERROR_ERROR_CODE || len(message) > BACKUP_CHUNK_SIZE {
+			t.Fatalf("Expected chunks of at most %d bytes. Got error code %d and %d bytes", BACKUP_CHUNK_SIZE, errorCodes[i], len(message))
+		}
+		archive = append(archive, message...)
+	}
+	archivePath := filepath.Join(t.TempDir(), "backup.tar")
+	os.WriteFile(archivePath, archive, 0644)
+
+	dataDir := filepath.Join(t.TempDir(), "restored")
+	err := Restore(archivePath, dataDir)
+	if err != nil {
+		t.Fatalf("Failed to restore. Got err = %s", err)
+	}
+	expectKeys(t, newDiskLoggedServer(t, dataDir), map[string]string{"a": "1", "b": string(large)})
+}
+
+func TestStreamedBackupIsOnlyOfferedFromVersion2(t *testing.T) {
+	server := newDiskLoggedServer(t, t.TempDir())
+	if slices.Contains(server.supportedCommands(commands.PROTOCOL_VERSION_1), commands.BACKUP_COMMAND) {
+		t.Errorf("Expected BACKUP not to be offered on protocol version 1")
+	}
+	if !slices.Contains(server.supportedCommands(commands.PROTOCOL_VERSION_2), commands.BACKUP_COMMAND) {
+		t.Errorf("Expected BACKUP to be offered on protocol version 2")
+	}
+
+	conn := &recordingConn{}
+	server.streamBackup(newSession(conn, &commands.Codec{Version: commands.PROTOCOL_VERSION_1}), 0)
+	if conn.Len() == 0 || conn.Bytes()[0] != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected streaming a backup on protocol version 1 to be a user error. Got %v", conn.Bytes())
+	}
+}
+
+func TestRestoreLeavesDataDirOnFailure(t *testing.T) {
+	// No manifest so the backup looks cut short
+	backupDir := t.TempDir()
+	os.WriteFile(filepath.Join(backupDir, SNAPSHOT_FILE_NAME), []byte("snapshot"), 0644)
+
+	dataDir := filepath.Join(t.TempDir(), "restored")
+	err := Restore(backupDir, dataDir)
+	if err == nil {
+		t.Fatalf("Expected restoring an incomplete backup to fail")
+	}
+	entries, _ := os.ReadDir(filepath.Dir(dataDir))
+	if len(entries) != 0 {
+		t.Errorf("Expected a failed restore to leave nothing behind. Got %d entries", len(entries))
+	}
+}
+
+func TestBackupNeedsCopyableWriteLog(t *testing.T) {
+	server, _ := newTestServer(t)
+	server.BackupDir = t.TempDir()
+	response := server.executeBackup(commands.Command{Identifier: commands.BACKUP_COMMAND, Key: "backup"})
+	if response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected BACKUP without a copyable write log to be a user error. Got %+v", response)
+	}
+}
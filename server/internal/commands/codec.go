@@ -0,0 +1,289 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// Original framing. Lengths are a single byte so keys, values and messages are limited to 255 bytes
+	PROTOCOL_VERSION_1 = 1
+	// Lengths are 4 byte big endian unsigned integers
+	PROTOCOL_VERSION_2 = 2
+	// Requests and responses start with a client chosen request id so requests can be pipelined
+	PROTOCOL_VERSION_3 = 3
+	// GET and SET respond with the key's version. SET and DELETE send an expected version
+	PROTOCOL_VERSION_4 = 4
+
+	MIN_PROTOCOL_VERSION = PROTOCOL_VERSION_1
+	MAX_PROTOCOL_VERSION = PROTOCOL_VERSION_4
+
+	REQUEST_ID_SIZE = 4
+)
+
+var ErrMessageTooLarge = errors.New("message exceeds max message size")
+
+// Codec reads requests and encodes responses using the framing of a single protocol version
+// Each connection negotiates its version with a HELLO and then uses one Codec for its lifetime
+type Codec struct {
+	Version uint8
+}
+
+// Whether requests carry an id. Responses to requests with ids may be sent out of order
+func (c *Codec) HasRequestIDs() bool {
+	return c.Version >= PROTOCOL_VERSION_3
+}
+
+// Whether keys' versions are sent to and from the client
+func (c *Codec) HasVersions() bool {
+	return c.Version >= PROTOCOL_VERSION_4
+}
+
+func (c *Codec) lengthPrefixSize() int {
+	if c.Version == PROTOCOL_VERSION_1 {
+		return 1
+	}
+
+	return LENGTH_PREFIX_SIZE
+}
+
+func (c *Codec) maxLength() uint64 {
+	if c.Version == PROTOCOL_VERSION_1 {
+		return math.MaxUint8
+	}
+
+	return math.MaxUint32
+}
+
+// Reads the next request from the stream
+// Returns io.EOF if the stream ends cleanly between requests
+// The returned request's ID is set whenever it was read, even if the rest of the request failed
+func (c *Codec) ReadRequest(reader *bufio.Reader, maxSize int) (Request, error) {
+	var request Request
+
+	if c.HasRequestIDs() {
+		idBuf := make([]byte, REQUEST_ID_SIZE)
+		_, err := io.ReadFull(reader, idBuf)
+		if err == io.EOF {
+			return request, err
+		}
+		if err != nil {
+			return request, fmt.Errorf("(Codec) Failed to read request id from stream. Error: %w", err)
+		}
+		request.ID = binary.BigEndian.Uint32(idBuf)
+	}
+
+	commandValue, err := reader.ReadByte()
+	if err == io.EOF && !c.HasRequestIDs() {
+		return request, err
+	}
+	if err != nil {
+		return request, fmt.Errorf("(Codec) Failed to read command value from stream. Error: %w", err)
+	}
+	request.Command.Identifier = int(commandValue)
+	request.Command.WithVersion = c.HasVersions()
+
+	if IsMultiKey(request.Command.Identifier) {
+		err = c.readMultiKey(reader, maxSize, &request.Command)
+		return request, err
+	}
+
+	request.Command.Key, err = c.ReadString(reader, maxSize)
+	if err != nil {
+		return request, fmt.Errorf("(Codec) Failed to read key. Error: %w", err)
+	}
+
+	identifier := request.Command.Identifier
+	// RANGE sends its end key as the value and SCAN its MATCH pattern. SCAN's cursor is sent as the key
+	if identifier == SET_COMMAND || identifier == SETEX_COMMAND || identifier == RANGE_COMMAND || identifier == SCAN_COMMAND || identifier == SCAN_AT_COMMAND || IsConditional(identifier) {
+		request.Command.Value, err = c.ReadBytes(reader, maxSize-len(request.Command.Key))
+		if err != nil {
+			return request, fmt.Errorf("(Codec) Failed to read value. Error: %w", err)
+		}
+	}
+
+	if identifier == CAS_COMMAND {
+		request.Command.Expected, err = c.ReadBytes(reader, maxSize-len(request.Command.Key)-len(request.Command.Value))
+		if err != nil {
+			return request, fmt.Errorf("(Codec) Failed to read expected value. Error: %w", err)
+		}
+	}
+
+	if identifier == SETEX_COMMAND || identifier == EXPIRE_COMMAND {
+		ttlBuf := make([]byte, TTL_SIZE)
+		_, err = io.ReadFull(reader, ttlBuf)
+		if err != nil {
+			return request, fmt.Errorf("(Codec) Failed to read TTL. Error: %w", err)
+		}
+		request.Command.TTLMillis = binary.BigEndian.Uint64(ttlBuf)
+	}
+
+	if c.HasVersions() && (identifier == SET_COMMAND || identifier == DELETE_COMMAND) {
+		versionBuf := make([]byte, VERSION_SIZE)
+		_, err = io.ReadFull(reader, versionBuf)
+		if err != nil {
+			return request, fmt.Errorf("(Codec) Failed to read expected version. Error: %w", err)
+		}
+		request.Command.ExpectedVersion = binary.BigEndian.Uint64(versionBuf)
+	}
+
+	if identifier == INCRBY_COMMAND {
+		deltaBuf := make([]byte, DELTA_SIZE)
+		_, err = io.ReadFull(reader, deltaBuf)
+		if err != nil {
+			return request, fmt.Errorf("(Codec) Failed to read delta. Error: %w", err)
+		}
+		request.Command.Delta = int64(binary.BigEndian.Uint64(deltaBuf))
+	}
+
+	// SCAN's COUNT hint is sent as the limit
+	if identifier == RANGE_COMMAND || identifier == SCAN_COMMAND || identifier == SCAN_AT_COMMAND || identifier == HISTORY_COMMAND {
+		limitBuf := make([]byte, LIMIT_SIZE)
+		_, err = io.ReadFull(reader, limitBuf)
+		if err != nil {
+			return request, fmt.Errorf("(Codec) Failed to read limit. Error: %w", err)
+		}
+		request.Command.Limit = binary.BigEndian.Uint32(limitBuf)
+	}
+
+	if identifier == GET_AT_COMMAND || identifier == SCAN_AT_COMMAND {
+		timestampBuf := make([]byte, READ_TIMESTAMP_SIZE)
+		_, err = io.ReadFull(reader, timestampBuf)
+		if err != nil {
+			return request, fmt.Errorf("(Codec) Failed to read read timestamp. Error: %w", err)
+		}
+		request.Command.ReadTimestamp = binary.BigEndian.Uint64(timestampBuf)
+	}
+
+	if identifier == GET_AS_OF_COMMAND {
+		asOfBuf := make([]byte, TIMESTAMP_SIZE)
+		_, err = io.ReadFull(reader, asOfBuf)
+		if err != nil {
+			return request, fmt.Errorf("(Codec) Failed to read time. Error: %w", err)
+		}
+		request.Command.AsOf = int64(binary.BigEndian.Uint64(asOfBuf))
+	}
+
+	return request, nil
+}
+
+// Reads the count and then each key, and value for MSET, of a multi key command
+// maxSize bounds the keys and values combined
+func (c *Codec) readMultiKey(reader *bufio.Reader, maxSize int, command *Command) error {
+	count, err := c.readLength(reader)
+	if err != nil {
+		return fmt.Errorf("(Codec) Failed to read key count. Error: %w", err)
+	}
+	// Every key takes at least a length prefix
+	if count*uint64(c.lengthPrefixSize()) > uint64(maxSize) {
+		return fmt.Errorf("(Codec) %d keys can't fit in %d bytes. Error: %w", count, maxSize, ErrMessageTooLarge)
+	}
+
+	remaining := maxSize
+	command.Keys = make([]string, 0, count)
+	if command.Identifier == MSET_COMMAND {
+		command.Values = make([][]byte, 0, count)
+	}
+	for range count {
+		key, err := c.ReadString(reader, remaining)
+		if err != nil {
+			return fmt.Errorf("(Codec) Failed to read key %d. Error: %w", len(command.Keys), err)
+		}
+		remaining -= len(key)
+		command.Keys = append(command.Keys, key)
+
+		if command.Identifier == MSET_COMMAND {
+			value, err := c.ReadBytes(reader, remaining)
+			if err != nil {
+				return fmt.Errorf("(Codec) Failed to read value %d. Error: %w", len(command.Values), err)
+			}
+			remaining -= len(value)
+			command.Values = append(command.Values, value)
+		}
+	}
+
+	return nil
+}
+
+// Reads a length prefixed string from the stream
+// Fails with ErrMessageTooLarge if the declared length is over maxSize
+func (c *Codec) ReadString(reader *bufio.Reader, maxSize int) (string, error) {
+	buf, err := c.ReadBytes(reader, maxSize)
+	return string(buf), err
+}
+
+// Reads length prefixed bytes from the stream
+// Fails with ErrMessageTooLarge if the declared length is over maxSize
+func (c *Codec) ReadBytes(reader *bufio.Reader, maxSize int) ([]byte, error) {
+	length, err := c.readLength(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if length > uint64(maxSize) {
+		return nil, fmt.Errorf("(Codec) Declared length %d is over the limit of %d bytes. Error: %w", length, maxSize, ErrMessageTooLarge)
+	}
+
+	buf := make([]byte, int(length))
+	_, err = io.ReadFull(reader, buf)
+	if err != nil {
+		return nil, fmt.Errorf("(Codec) Failed to read value from stream. Error: %w", err)
+	}
+
+	return buf, nil
+}
+
+// Reads a length prefix in the size used by the codec's version
+func (c *Codec) readLength(reader *bufio.Reader) (uint64, error) {
+	lengthBuf := make([]byte, c.lengthPrefixSize())
+	_, err := io.ReadFull(reader, lengthBuf)
+	if err != nil {
+		return 0, fmt.Errorf("(Codec) Failed to read length from stream. Error: %w", err)
+	}
+
+	var length uint64
+	for _, b := range lengthBuf {
+		length = (length << 8) | uint64(b)
+	}
+	return length, nil
+}
+
+func (c *Codec) EncodeResponse(r Response) ([]byte, error) {
+	// Error messages are only informational so cut them down rather than failing to respond at all
+	if r.ErrorCode != NO_ERROR_ERROR_CODE && uint64(len(r.Message)) > c.maxLength() {
+		r.Message = r.Message[:c.maxLength()]
+	}
+
+	if uint64(len(r.Message)) > c.maxLength() {
+		return nil, fmt.Errorf("(Codec) Message too big. Max message size for protocol version %d is %d got message of length %d. Error: %w", c.Version, c.maxLength(), len(r.Message), ErrMessageTooLarge)
+	}
+
+	// Version 1 only sends the error code when there is no message
+	if c.Version == PROTOCOL_VERSION_1 && len(r.Message) == 0 {
+		return []byte{byte(r.ErrorCode)}, nil
+	}
+
+	offset := 0
+	if c.HasRequestIDs() {
+		offset = REQUEST_ID_SIZE
+	}
+
+	prefixSize := c.lengthPrefixSize()
+	encoded := make([]byte, offset+1+prefixSize+len(r.Message))
+	if c.HasRequestIDs() {
+		binary.BigEndian.PutUint32(encoded, r.RequestID)
+	}
+	encoded[offset] = byte(r.ErrorCode)
+	if prefixSize == 1 {
+		encoded[offset+1] = byte(len(r.Message))
+	} else {
+		binary.BigEndian.PutUint32(encoded[offset+1:], uint32(len(r.Message)))
+	}
+	copy(encoded[offset+1+prefixSize:], r.Message)
+
+	return encoded, nil
+}
@@ -1,64 +1,299 @@
 package commands
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
 )
 
 const (
 	GET_COMMAND    = 0
 	SET_COMMAND    = 1
 	DELETE_COMMAND = 2
+	HELLO_COMMAND  = 3
+	BGSAVE_COMMAND = 4
+	// SET with a TTL
+	SETEX_COMMAND   = 5
+	EXPIRE_COMMAND  = 6
+	PERSIST_COMMAND = 7
+	TTL_COMMAND     = 8
+	RANGE_COMMAND   = 9
+	SCAN_COMMAND    = 10
+	// Multi key commands. Send a count followed by the keys, and values for MSET, instead of a single key
+	MGET_COMMAND = 11
+	MSET_COMMAND = 12
+	MDEL_COMMAND = 13
+	// Counters. The value is stored as a base 10 signed 64 bit integer
+	INCR_COMMAND   = 14
+	DECR_COMMAND   = 15
+	INCRBY_COMMAND = 16
+	// Conditional writes. SETNX only sets a key that doesn't exist, SETXX only one that does
+	// and CAS only one whose current value matches the expected value
+	SETNX_COMMAND = 17
+	SETXX_COMMAND = 18
+	CAS_COMMAND   = 19
+	// Transactions. Commands sent between MULTI and EXEC are queued and committed together by EXEC
+	// DISCARD drops the queued commands. EXEC is also the write log opcode of a committed transaction
+	MULTI_COMMAND   = 20
+	EXEC_COMMAND    = 21
+	DISCARD_COMMAND = 22
+	// Makes the connection's next EXEC fail if any of the keys change first. Sent like MGET
+	WATCH_COMMAND = 23
+	// Stops watching every key. Sent with an empty key
+	UNWATCH_COMMAND = 24
+	// Snapshot reads. SNAPSHOT responds with a read timestamp that GET_AT and SCAN_AT send after their other operands
+	// to read keys as they were when the snapshot was taken. Need a multi-version storage backend
+	SNAPSHOT_COMMAND = 25
+	GET_AT_COMMAND   = 26
+	SCAN_AT_COMMAND  = 27
+	// Key history read back from the write log. HISTORY sends a limit after the key and GET_AS_OF a wall clock time
+	HISTORY_COMMAND   = 28
+	GET_AS_OF_COMMAND = 29
+	// Copies the data while the server carries on serving. The key is a directory on the server to copy it to
+	// or empty to respond with the copy as a tar archive
+	BACKUP_COMMAND = 30
 
 	NO_ERROR_ERROR_CODE      = 0
 	SERVER_ERROR_ERROR_CODE  = 1
 	USER_ERROR_ERROR_CODE    = 2
 	UNKNOWN_ERROR_ERROR_CODE = 3
+	NOT_FOUND_ERROR_CODE     = 4
+	// A conditional write's condition didn't hold so nothing was written
+	CONDITION_FAILED_ERROR_CODE = 5
+
+	// Size in bytes of the length prefix in front of every key, value and message
+	LENGTH_PREFIX_SIZE = 4
+	// TTLs are sent as big endian unsigned milliseconds. TTL responds with a big endian signed number of milliseconds
+	TTL_SIZE = 8
+	// TTL's response for a key that never expires
+	NO_EXPIRY_TTL = -1
+	// Versions are sent as big endian unsigned integers
+	VERSION_SIZE = 8
+	// Snapshot read timestamps are sent as big endian unsigned integers
+	READ_TIMESTAMP_SIZE = 8
+	// GET_AS_OF's time and the times HISTORY responds with are big endian signed Unix milliseconds
+	TIMESTAMP_SIZE = 8
+	// Limits are sent as big endian unsigned integers
+	LIMIT_SIZE = 4
+	// INCRBY's delta is sent as a big endian signed integer. Counter commands respond with the new value in the same format
+	DELTA_SIZE = 8
+	// Length of a list element that's missing rather than empty e.g. a key MGET didn't find
+	MISSING_ELEMENT_LENGTH = math.MaxUint32
 )
 
 type Command struct {
 	Identifier int
 	Key        string
-	Value      string
+	Value      []byte
+	// Write log sequence number. Only set on commands replayed from the write log
+	Seq uint64
+	// Unix milliseconds the command was appended to the write log. Only set on commands replayed from the write log
+	// 0 for records logged before the write log held timestamps
+	LoggedAt int64
+	// Relative TTL as sent by the client with SETEX and EXPIRE
+	TTLMillis uint64
+	// Absolute expiry in Unix milliseconds worked out from TTLMillis when the command is committed
+	// This is what's logged so replaying never extends a key's life. 0 means no expiry
+	ExpiresAt int64
+	// Max number of results to return or with SCAN the number of keys to look at. 0 lets the server choose
+	Limit uint32
+	// Amount INCRBY adds to the key
+	Delta int64
+	// Value CAS expects the key to currently have
+	Expected []byte
+	// Version SET and DELETE expect the key to currently have. 0 writes whatever the version
+	ExpectedVersion uint64
+	// Set by the codec when the client's protocol version has versions so GET and SET respond with the key's version
+	WithVersion bool
+	// Snapshot GET_AT and SCAN_AT read at. The write log sequence number of the last write the snapshot sees
+	ReadTimestamp uint64
+	// Unix milliseconds GET_AS_OF reads the key as it was at
+	AsOf int64
+	// Keys of a multi key command. Key is empty for these
+	Keys []string
+	// Values for MSET in the same order as Keys
+	Values [][]byte
+	// Writes of a committed transaction in the order they were queued. Only set on EXEC
+	Batch []Command
+}
+
+// Whether the command only writes if a condition on the key's current value holds
+func IsConditional(identifier int) bool {
+	return identifier == SETNX_COMMAND || identifier == SETXX_COMMAND || identifier == CAS_COMMAND
+}
+
+// Whether the command sends a count and a list of keys rather than a single key
+func IsMultiKey(identifier int) bool {
+	return identifier == MGET_COMMAND || identifier == MSET_COMMAND || identifier == MDEL_COMMAND || identifier == WATCH_COMMAND
+}
+
+// Keys a logged write changes
+func WrittenKeys(command Command) []string {
+	switch command.Identifier {
+	case MSET_COMMAND, MDEL_COMMAND:
+		return command.Keys
+	case EXEC_COMMAND:
+		keys := make([]string, len(command.Batch))
+		for i, write := range command.Batch {
+			keys[i] = write.Key
+		}
+		return keys
+	default:
+		return []string{command.Key}
+	}
 }
 
 func CreateGetCommand(key string) Command {
-	return Command{GET_COMMAND, key, ""}
+	return Command{Identifier: GET_COMMAND, Key: key}
 }
 
-func CreateSetCommand(key, value string) Command {
-	return Command{SET_COMMAND, key, value}
+func CreateSetCommand(key string, value []byte) Command {
+	return Command{Identifier: SET_COMMAND, Key: key, Value: value}
 }
 
 func CreateDeleteCommand(key string) Command {
-	return Command{DELETE_COMMAND, key, ""}
+	return Command{Identifier: DELETE_COMMAND, Key: key}
 }
 
-type Response struct {
-	ErrorCode uint8
-	Message   string
+func CreateSetWithExpiryCommand(key string, value []byte, expiresAt int64) Command {
+	return Command{Identifier: SETEX_COMMAND, Key: key, Value: value, ExpiresAt: expiresAt}
+}
+
+func CreateExpireCommand(key string, expiresAt int64) Command {
+	return Command{Identifier: EXPIRE_COMMAND, Key: key, ExpiresAt: expiresAt}
 }
 
-func (r *Response) Encode() ([]byte, error) {
-	// No message set only send error code
-	if len(r.Message) == 0 {
-		return []byte{byte(r.ErrorCode)}, nil
+func CreatePersistCommand(key string) Command {
+	return Command{Identifier: PERSIST_COMMAND, Key: key}
+}
+
+func CreateMultiSetCommand(keys []string, values [][]byte) Command {
+	return Command{Identifier: MSET_COMMAND, Keys: keys, Values: values}
+}
+
+func CreateMultiDeleteCommand(keys []string) Command {
+	return Command{Identifier: MDEL_COMMAND, Keys: keys}
+}
+
+// The record written for a transaction. writes must be SETs and DELETEs
+func CreateTransactionCommand(writes []Command) Command {
+	return Command{Identifier: EXEC_COMMAND, Batch: writes}
+}
+
+// Encodes a list of elements as the message of a response
+//
+// | Element Count (4) | Element Length (4) | Element (n) | ... |
+func EncodeList(elements [][]byte) []byte {
+	size := LENGTH_PREFIX_SIZE
+	for _, element := range elements {
+		size += LENGTH_PREFIX_SIZE + len(element)
 	}
 
-	// Message can be max 255 bytes
-	// Size must be a single byte
-	// Note: This does not deal with UTF-8 only ASCII
-	if len(r.Message) > 255 {
-		return []byte{}, fmt.Errorf("Message too big. Max message size is 255 got message of length %d", len(r.Message))
+	encoded := make([]byte, 0, size)
+	encoded = binary.BigEndian.AppendUint32(encoded, uint32(len(elements)))
+	for _, element := range elements {
+		encoded = binary.BigEndian.AppendUint32(encoded, uint32(len(element)))
+		encoded = append(encoded, element...)
+	}
+	return encoded
+}
+
+// Like EncodeList but elements where found is false are sent as missing rather than empty
+// Missing elements have a length of MISSING_ELEMENT_LENGTH and no bytes
+func EncodeListWithMissing(elements [][]byte, found []bool) []byte {
+	size := LENGTH_PREFIX_SIZE
+	for _, element := range elements {
+		size += LENGTH_PREFIX_SIZE + len(element)
 	}
 
-	var encoded []byte
-	encoded = make([]byte, 2+len(r.Message))
+	encoded := make([]byte, 0, size)
+	encoded = binary.BigEndian.AppendUint32(encoded, uint32(len(elements)))
+	for i, element := range elements {
+		if !found[i] {
+			encoded = binary.BigEndian.AppendUint32(encoded, MISSING_ELEMENT_LENGTH)
+			continue
+		}
+		encoded = binary.BigEndian.AppendUint32(encoded, uint32(len(element)))
+		encoded = append(encoded, element...)
+	}
+	return encoded
+}
+
+// Decodes a list encoded by EncodeList
+// Fails if the elements don't exactly fill encoded
+func DecodeList(encoded []byte) ([][]byte, error) {
+	if len(encoded) < LENGTH_PREFIX_SIZE {
+		return nil, errors.New("list is shorter than its element count")
+	}
+	count := binary.BigEndian.Uint32(encoded)
+	encoded = encoded[LENGTH_PREFIX_SIZE:]
+	// Every element takes at least a length prefix so a count this big can't be right
+	if uint64(count)*LENGTH_PREFIX_SIZE > uint64(len(encoded)) {
+		return nil, fmt.Errorf("list of %d bytes is too short to hold %d elements", len(encoded), count)
+	}
+
+	elements := make([][]byte, 0, count)
+	for range count {
+		if len(encoded) < LENGTH_PREFIX_SIZE {
+			return nil, errors.New("list element is missing its length")
+		}
+		length := binary.BigEndian.Uint32(encoded)
+		encoded = encoded[LENGTH_PREFIX_SIZE:]
+		if uint64(length) > uint64(len(encoded)) {
+			return nil, fmt.Errorf("list element of length %d overruns the list", length)
+		}
+		elements = append(elements, encoded[:length])
+		encoded = encoded[length:]
+	}
+	if len(encoded) != 0 {
+		return nil, fmt.Errorf("%d unexpected bytes after the list", len(encoded))
+	}
+	return elements, nil
+}
+
+// A command read off the wire along with the id the client uses to match up its response
+// ID is always 0 for protocol versions without request ids
+type Request struct {
+	ID      uint32
+	Command Command
+}
+
+// Message holds the result on success and a human readable description of the error otherwise
+type Response struct {
+	RequestID uint32
+	ErrorCode uint8
+	Message   []byte
+}
+
+func ErrorResponse(errorCode uint8, format string, a ...any) Response {
+	return Response{ErrorCode: errorCode, Message: fmt.Appendf(nil, format, a...)}
+}
+
+// Reply to a HELLO. Always encoded the same way regardless of the negotiated version
+//
+// | Error Code (1) | Version (1) | Command Count (1) | Commands (n) | Feature Count (1) | Features (length (1) + name)... |
+type HelloResponse struct {
+	ErrorCode uint8
+	Version   uint8
+	Commands  []uint8
+	Features  []string
+}
+
+func (h *HelloResponse) Encode() ([]byte, error) {
+	if len(h.Commands) > math.MaxUint8 || len(h.Features) > math.MaxUint8 {
+		return nil, fmt.Errorf("(HelloResponse) Too many commands or features to encode. Got %d commands and %d features", len(h.Commands), len(h.Features))
+	}
 
-	encoded[0] = byte(r.ErrorCode)
-	encoded[1] = byte(len(r.Message))
-	offset := 2
-	for idx, ch := range r.Message {
-		encoded[idx+offset] = byte(ch)
+	encoded := []byte{h.ErrorCode, h.Version, byte(len(h.Commands))}
+	encoded = append(encoded, h.Commands...)
+	encoded = append(encoded, byte(len(h.Features)))
+	for _, feature := range h.Features {
+		if len(feature) > math.MaxUint8 {
+			return nil, fmt.Errorf("(HelloResponse) Feature name too long. Max length is 255 got %d", len(feature))
+		}
+		encoded = append(encoded, byte(len(feature)))
+		encoded = append(encoded, feature...)
 	}
 
 	return encoded, nil
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+// The only path that writes to the StorageBackend while serving
+//
+// Commits are serialised by commitLock so the order of the write log always matches the order writes were applied.
+// The command is logged before it's applied so a write that fails to log is never visible to readers.
+// Returns once the write is as durable as the write log's sync policy promises so the caller can acknowledge it.
+func (server *Server) commit(command commands.Command) error {
+	_, err := server.commitResolved(command)
+	return err
+}
+
+// Like commit but returns the command that was logged and applied
+// This differs from command for commands like INCR which are logged as the write they resulted in
+func (server *Server) commitResolved(command commands.Command) (commands.Command, error) {
+	seq, resolved, err := server.logAndApply(command)
+	if err != nil {
+		return resolved, err
+	}
+
+	// Outside commitLock so writers arriving while this one waits on fsync can share the next one
+	err = server.WriteLogger.Sync(seq)
+	if err != nil {
+		return resolved, fmt.Errorf("(Server) Failed to sync write log. Error: %w", err)
+	}
+
+	return resolved, nil
+}
+
+func (server *Server) logAndApply(command commands.Command) (uint64, commands.Command, error) {
+	server.commitLock.Lock()
+	defer server.commitLock.Unlock()
+
+	resolved, err := server.resolveCommand(command)
+	if err != nil {
+		return 0, resolved, err
+	}
+
+	seq, err := server.WriteLogger.Append(resolved)
+	if err != nil {
+		return 0, resolved, fmt.Errorf("(Server) Failed to log command. Nothing was applied. Error: %w", err)
+	}
+	// The sequence number becomes the version of every key the command writes, just as it does when replaying
+	resolved.Seq = seq
+
+	err = server.applyCommitted(resolved)
+	if err != nil {
+		// Already in the log so it will be applied on the next restart
+		return 0, resolved, fmt.Errorf("(Server) Failed to apply logged command. Error: %w", err)
+	}
+
+	return seq, resolved, nil
+}
+
+// Turns a command into the write to log and apply. Runs under commitLock so it sees the result of every earlier commit
+// Rejects a write that would have no effect before it's logged
+// Errors wrap storagebackend.ErrKeyNotFound so callers can tell the client the key doesn't exist
+func (server *Server) resolveCommand(command commands.Command) (commands.Command, error) {
+	if isConditionalSet(command) {
+		return server.resolveConditional(command)
+	}
+
+	switch command.Identifier {
+	case commands.EXPIRE_COMMAND, commands.PERSIST_COMMAND:
+		_, err := server.StorageBackend.Expiry(command.Key)
+		return command, err
+	case commands.INCR_COMMAND, commands.DECR_COMMAND, commands.INCRBY_COMMAND:
+		return server.resolveIncrement(command)
+	case commands.DELETE_COMMAND:
+		if command.ExpectedVersion == 0 {
+			return command, nil
+		}
+		// Nothing else can write the key while commitLock is held so it can't change before it's deleted
+		entry, err := server.StorageBackend.GetEntry(command.Key)
+		if err != nil || entry.Version != command.ExpectedVersion {
+			return command, fmt.Errorf("(Server) %s isn't at version %d. Error: %w", command.Key, command.ExpectedVersion, storagebackend.ErrConditionFailed)
+		}
+		// Logged as a plain DELETE so replaying never depends on the version
+		command.ExpectedVersion = 0
+	}
+
+	return command, nil
+}
+
+// Like apply but also lets watchers of the keys written know they've changed
+// Only needed while serving. Nothing watches while the write log is replayed
+func (server *Server) applyCommitted(command commands.Command) error {
+	server.touchWatched(command)
+	return server.apply(command)
+}
+
+// Applies a write to the StorageBackend. Used both when committing and when replaying the write log
+// command.Seq is used as the new version of the keys it writes
+func (server *Server) apply(command commands.Command) error {
+	switch command.Identifier {
+	case commands.SET_COMMAND:
+		err := server.StorageBackend.Set(command.Key, command.Value, command.Seq)
+		if err != nil {
+			return fmt.Errorf("(Server): Failed to apply SET command. Key = %s Value = %q. Error: %w", command.Key, command.Value, err)
+		}
+	case commands.DELETE_COMMAND:
+		err := server.StorageBackend.Delete(command.Key, command.Seq)
+		if err != nil {
+			return fmt.Errorf("(Server): Failed to apply DELETE command. Key = %s. Error: %w", command.Key, err)
+		}
+	case commands.SETEX_COMMAND:
+		err := server.StorageBackend.SetWithExpiry(command.Key, command.Value, command.ExpiresAt, command.Seq)
+		if err != nil {
+			return fmt.Errorf("(Server): Failed to apply SETEX command. Key = %s Value = %q. Error: %w", command.Key, command.Value, err)
+		}
+	case commands.EXPIRE_COMMAND, commands.PERSIST_COMMAND:
+		// ExpiresAt is 0 for PERSIST which removes the expiry
+		err := server.StorageBackend.SetExpiry(command.Key, command.ExpiresAt, command.Seq)
+		// The key can expire between being checked and applied and is always gone when replaying
+		// a record for a key that expired before the restart. Either way there's nothing left to change
+		if errors.Is(err, storagebackend.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("(Server): Failed to apply expiry change. Key = %s. Error: %w", command.Key, err)
+		}
+	case commands.MSET_COMMAND, commands.MDEL_COMMAND, commands.EXEC_COMMAND:
+		// Applied as one batch so no reader sees part of it
+		writes := batchWrites(command)
+		err := server.StorageBackend.WriteBatch(writes, command.Seq)
+		if err != nil {
+			return fmt.Errorf("(Server): Failed to apply batch of %d writes. Error: %w", len(writes), err)
+		}
+	default:
+		return fmt.Errorf("(Server) Unknown command to apply %+v", command)
+	}
+
+	return nil
+}
+
+// The writes of an MSET, MDEL or transaction. Transactions only hold SETs and DELETEs
+func batchWrites(command commands.Command) []storagebackend.BatchWrite {
+	var writes []storagebackend.BatchWrite
+	switch command.Identifier {
+	case commands.MSET_COMMAND:
+		for i, key := range command.Keys {
+			writes = append(writes, storagebackend.BatchWrite{Key: key, Value: command.Values[i]})
+		}
+	case commands.MDEL_COMMAND:
+		for _, key := range command.Keys {
+			writes = append(writes, storagebackend.BatchWrite{Key: key, Delete: true})
+		}
+	case commands.EXEC_COMMAND:
+		for _, write := range command.Batch {
+			writes = append(writes, storagebackend.BatchWrite{Key: write.Key, Value: write.Value, Delete: write.Identifier == commands.DELETE_COMMAND})
+		}
+	}
+	return writes
+}
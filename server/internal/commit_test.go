@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+// Records logged commands in memory and fails on demand
+type memoryWriteLogger struct {
+	logged []commands.Command
+	fail   bool
+}
+
+func (mwl *memoryWriteLogger) Init() error  { return nil }
+func (mwl *memoryWriteLogger) Close() error { return nil }
+
+func (mwl *memoryWriteLogger) Append(command commands.Command) (uint64, error) {
+	if mwl.fail {
+		return 0, errors.New("memory_write_logger: failing on purpose")
+	}
+	mwl.logged = append(mwl.logged, command)
+	return uint64(len(mwl.logged)), nil
+}
+
+func (mwl *memoryWriteLogger) Sync(seq uint64) error { return nil }
+func (mwl *memoryWriteLogger) LastSeq() uint64       { return uint64(len(mwl.logged)) }
+
+func (mwl *memoryWriteLogger) Compact(upToSeq uint64) error {
+	return errors.New("memory_write_logger: compaction not supported")
+}
+
+func (mwl *memoryWriteLogger) Replay(fn func(command commands.Command) error) error {
+	for i, command := range mwl.logged {
+		command.Seq = uint64(i + 1)
+		err := fn(command)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newTestServer(t *testing.T) (*Server, *memoryWriteLogger) {
+	writeLogger := &memoryWriteLogger{}
+	server := &Server{
+		StorageBackend: &storagebackend.ShardedMapStorageBackend{},
+		WriteLogger:    writeLogger,
+	}
+	err := server.Init()
+	if err != nil {
+		t.Fatalf("Failed to init server. Got err = %s", err)
+	}
+	return server, writeLogger
+}
+
+func TestCommitIsNotAppliedIfLoggingFails(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+	writeLogger.fail = true
+
+	err := server.commit(commands.CreateSetCommand("key", []byte("value")))
+	if err == nil {
+		t.Errorf("Expected commit to fail when the write logger fails")
+	}
+
+	_, err = server.StorageBackend.Get("key")
+	if !errors.Is(err, storagebackend.ErrKeyNotFound) {
+		t.Errorf("Expected a write that failed to log to not be visible. Got err = %s", err)
+	}
+}
+
+func TestCommitLogsAndApplies(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+
+	err := server.commit(commands.CreateSetCommand("key", []byte("value")))
+	if err != nil {
+		t.Errorf("Failed to commit SET. Got err = %s", err)
+	}
+
+	value, err := server.StorageBackend.Get("key")
+	if err != nil || string(value) != "value" {
+		t.Errorf("Expected committed value to be visible. Got value %q and err = %s", value, err)
+	}
+
+	if len(writeLogger.logged) != 1 || writeLogger.logged[0].Identifier != commands.SET_COMMAND {
+		t.Errorf("Expected exactly one SET to be logged. Got %+v", writeLogger.logged)
+	}
+}
+
+func TestCommitDoesNotLogExpiryChangesForMissingKeys(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+
+	err := server.commit(commands.CreateExpireCommand("missing", time.Now().Add(time.Hour).UnixMilli()))
+	if !errors.Is(err, storagebackend.ErrKeyNotFound) {
+		t.Errorf("Expected EXPIRE of a missing key to fail with ErrKeyNotFound. Got err = %s", err)
+	}
+	if len(writeLogger.logged) != 0 {
+		t.Errorf("Expected nothing to be logged. Got %+v", writeLogger.logged)
+	}
+}
+
+func TestReplayDoesNotResurrectExpiredKeys(t *testing.T) {
+	expired := time.Now().Add(-time.Minute).UnixMilli()
+	writeLogger := &memoryWriteLogger{logged: []commands.Command{
+		commands.CreateSetWithExpiryCommand("expired", []byte("value"), expired),
+		commands.CreateSetCommand("expired later", []byte("value")),
+		commands.CreateExpireCommand("expired later", expired),
+		commands.CreateSetWithExpiryCommand("live", []byte("value"), time.Now().Add(time.Hour).UnixMilli()),
+	}}
+	server := &Server{
+		StorageBackend: &storagebackend.ShardedMapStorageBackend{},
+		WriteLogger:    writeLogger,
+	}
+	err := server.Init()
+	if err != nil {
+		t.Fatalf("Failed to init server. Got err = %s", err)
+	}
+
+	for _, key := range []string{"expired", "expired later"} {
+		_, err = server.StorageBackend.Get(key)
+		if !errors.Is(err, storagebackend.ErrKeyNotFound) {
+			t.Errorf("Expected %s to stay expired after replay. Got err = %s", key, err)
+		}
+	}
+	_, err = server.StorageBackend.Get("live")
+	if err != nil {
+		t.Errorf("Expected a key that hasn't expired yet to be replayed. Got err = %s", err)
+	}
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+// Runs SETNX, SETXX or CAS. Responds with CONDITION_FAILED if the key's current value doesn't allow the write
+func (server *Server) executeConditional(command commands.Command) commands.Response {
+	err := server.commit(command)
+	if errors.Is(err, storagebackend.ErrConditionFailed) {
+		return commands.ErrorResponse(commands.CONDITION_FAILED_ERROR_CODE, "condition on %s doesn't hold", command.Key)
+	}
+	if err != nil {
+		log.Printf("handler_net_conn: Error conditionally setting value %v\n", err)
+		return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to set %s", command.Key)
+	}
+
+	return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE}
+}
+
+// Whether the command is a write that goes through resolveConditional
+// A SET with an expected version is conditional on the key still having that version
+func isConditionalSet(command commands.Command) bool {
+	return commands.IsConditional(command.Identifier) || (command.Identifier == commands.SET_COMMAND && command.ExpectedVersion != 0)
+}
+
+// Checked against a key's current entry. exists is false if the key doesn't exist or has expired
+type writeCondition func(current storagebackend.Entry, exists bool) bool
+
+// The condition a conditional write checks against the key's current entry
+func conditionFor(command commands.Command) writeCondition {
+	switch command.Identifier {
+	case commands.SET_COMMAND:
+		return func(current storagebackend.Entry, exists bool) bool {
+			return exists && current.Version == command.ExpectedVersion
+		}
+	case commands.SETNX_COMMAND:
+		return func(current storagebackend.Entry, exists bool) bool {
+			return !exists
+		}
+	case commands.SETXX_COMMAND:
+		return func(current storagebackend.Entry, exists bool) bool {
+			return exists
+		}
+	default:
+		return func(current storagebackend.Entry, exists bool) bool {
+			return exists && bytes.Equal(current.Value, command.Expected)
+		}
+	}
+}
+
+// Checks the condition against the key's current entry. Runs under commitLock so nothing else can write the key before it's applied
+// Resolves to a plain SET so replaying never depends on the condition
+func (server *Server) resolveConditional(command commands.Command) (commands.Command, error) {
+	entry, err := server.StorageBackend.GetEntry(command.Key)
+	if err != nil && !errors.Is(err, storagebackend.ErrKeyNotFound) {
+		return command, fmt.Errorf("(Server) Failed to fetch %s. Error: %w", command.Key, err)
+	}
+	if !conditionFor(command)(entry, err == nil) {
+		return command, fmt.Errorf("(Server) Condition on %s doesn't hold. Error: %w", command.Key, storagebackend.ErrConditionFailed)
+	}
+	return commands.CreateSetCommand(command.Key, command.Value), nil
+}
@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+)
+
+func TestConditionalWritesOnlyLogSuccesses(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+
+	for _, step := range []struct {
+		command  commands.Command
+		expected uint8
+	}{
+		{commands.Command{Identifier: commands.SETXX_COMMAND, Key: "key", Value: []byte("a")}, commands.CONDITION_FAILED_ERROR_CODE},
+		{commands.Command{Identifier: commands.SETNX_COMMAND, Key: "key", Value: []byte("b")}, commands.NO_ERROR_ERROR_CODE},
+		{commands.Command{Identifier: commands.SETNX_COMMAND, Key: "key", Value: []byte("c")}, commands.CONDITION_FAILED_ERROR_CODE},
+		{commands.Command{Identifier: commands.SETXX_COMMAND, Key: "key", Value: []byte("d")}, commands.NO_ERROR_ERROR_CODE},
+		{commands.Command{Identifier: commands.CAS_COMMAND, Key: "key", Value: []byte("e"), Expected: []byte("b")}, commands.CONDITION_FAILED_ERROR_CODE},
+		{commands.Command{Identifier: commands.CAS_COMMAND, Key: "key", Value: []byte("f"), Expected: []byte("d")}, commands.NO_ERROR_ERROR_CODE},
+		{commands.Command{Identifier: commands.CAS_COMMAND, Key: "missing", Value: []byte("g"), Expected: []byte{}}, commands.CONDITION_FAILED_ERROR_CODE},
+	} {
+		response := server.executeConditional(step.command)
+		if response.ErrorCode != step.expected {
+			t.Errorf("Expected %+v to respond with %d. Got %+v", step.command, step.expected, response)
+		}
+	}
+
+	value, err := server.StorageBackend.Get("key")
+	if err != nil || string(value) != "f" {
+		t.Errorf("Expected only the successful writes to apply. Got %q and err = %v", value, err)
+	}
+	if len(writeLogger.logged) != 3 {
+		t.Fatalf("Expected only the 3 successful writes to be logged. Got %+v", writeLogger.logged)
+	}
+	for _, logged := range writeLogger.logged {
+		if logged.Identifier != commands.SET_COMMAND {
+			t.Errorf("Expected conditional writes to be logged as SETs. Got %+v", logged)
+		}
+	}
+}
+
+func TestConditionalWriteIsNotAppliedIfLoggingFails(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+	writeLogger.fail = true
+
+	response := server.executeConditional(commands.Command{Identifier: commands.SETNX_COMMAND, Key: "key", Value: []byte("value")})
+	if response.ErrorCode != commands.SERVER_ERROR_ERROR_CODE {
+		t.Errorf("Expected a server error when logging fails. Got %+v", response)
+	}
+	if _, err := server.StorageBackend.Get("key"); err == nil {
+		t.Error("Expected a write that failed to log not to be applied")
+	}
+}
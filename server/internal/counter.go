@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+var (
+	errNotAnInteger      = errors.New("value is not an integer")
+	errIncrementOverflow = errors.New("increment would overflow a 64 bit integer")
+)
+
+// Adds the command's delta to the value of its key and responds with the new value
+func (server *Server) executeIncrement(command commands.Command) commands.Response {
+	resolved, err := server.commitResolved(command)
+	if errors.Is(err, errNotAnInteger) || errors.Is(err, errIncrementOverflow) {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "failed to increment %s: %v", command.Key, err)
+	}
+	if err != nil {
+		log.Printf("handler_net_conn: Error incrementing value %v\n", err)
+		return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to increment %s", command.Key)
+	}
+
+	// Already checked when resolving so this can't fail
+	value, _ := strconv.ParseInt(string(resolved.Value), 10, 64)
+	return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE, Message: binary.BigEndian.AppendUint64(nil, uint64(value))}
+}
+
+// Works out the new value of a counter. A key that doesn't exist or has expired counts as 0
+// Resolves to a SET of the new value, or a SETEX if the key has an expiry so the increment doesn't remove it
+func (server *Server) resolveIncrement(command commands.Command) (commands.Command, error) {
+	delta := command.Delta
+	switch command.Identifier {
+	case commands.INCR_COMMAND:
+		delta = 1
+	case commands.DECR_COMMAND:
+		delta = -1
+	}
+
+	// Read in one go so the value and expiry are of the same live key. An expired key counts as missing
+	var current int64
+	entry, err := server.StorageBackend.GetEntry(command.Key)
+	if err != nil && !errors.Is(err, storagebackend.ErrKeyNotFound) {
+		return command, fmt.Errorf("(Server) Failed to fetch counter %s. Error: %w", command.Key, err)
+	}
+	if err == nil {
+		current, err = strconv.ParseInt(string(entry.Value), 10, 64)
+		if err != nil {
+			return command, errNotAnInteger
+		}
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return command, errIncrementOverflow
+	}
+	next := []byte(strconv.FormatInt(current+delta, 10))
+
+	if entry.ExpiresAt != 0 {
+		return commands.CreateSetWithExpiryCommand(command.Key, next, entry.ExpiresAt), nil
+	}
+	return commands.CreateSetCommand(command.Key, next), nil
+}
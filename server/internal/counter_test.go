@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+)
+
+func TestIncrementLogsResultingValue(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+
+	for _, step := range []struct {
+		command  commands.Command
+		expected int64
+	}{
+		{commands.Command{Identifier: commands.INCR_COMMAND, Key: "counter"}, 1},
+		{commands.Command{Identifier: commands.INCRBY_COMMAND, Key: "counter", Delta: 41}, 42},
+		{commands.Command{Identifier: commands.DECR_COMMAND, Key: "counter"}, 41},
+		{commands.Command{Identifier: commands.INCRBY_COMMAND, Key: "counter", Delta: -50}, -9},
+	} {
+		response := server.executeIncrement(step.command)
+		if response.ErrorCode != commands.NO_ERROR_ERROR_CODE {
+			t.Fatalf("Expected %+v to succeed. Got %+v", step.command, response)
+		}
+		if got := int64(binary.BigEndian.Uint64(response.Message)); got != step.expected {
+			t.Errorf("Expected %+v to respond with %d. Got %d", step.command, step.expected, got)
+		}
+	}
+
+	last := writeLogger.logged[len(writeLogger.logged)-1]
+	if len(writeLogger.logged) != 4 || last.Identifier != commands.SET_COMMAND || string(last.Value) != "-9" {
+		t.Errorf("Expected each increment to be logged as a SET of the new value. Got %+v", writeLogger.logged)
+	}
+}
+
+func TestIncrementKeepsExpiry(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+	expiresAt := time.Now().Add(time.Hour).UnixMilli()
+	server.commit(commands.CreateSetWithExpiryCommand("counter", []byte("5"), expiresAt))
+
+	server.executeIncrement(commands.Command{Identifier: commands.INCR_COMMAND, Key: "counter"})
+	got, err := server.StorageBackend.Expiry("counter")
+	if err != nil || got != expiresAt {
+		t.Errorf("Expected INCR to keep the expiry %d. Got %d and err = %v", expiresAt, got, err)
+	}
+	last := writeLogger.logged[len(writeLogger.logged)-1]
+	if last.Identifier != commands.SETEX_COMMAND || last.ExpiresAt != expiresAt || string(last.Value) != "6" {
+		t.Errorf("Expected INCR of an expiring key to be logged as a SETEX. Got %+v", last)
+	}
+}
+
+func TestIncrementRejectsInvalidValues(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+	server.commit(commands.CreateSetCommand("text", []byte("hello")))
+	server.commit(commands.CreateSetCommand("max", []byte(strconv.FormatInt(math.MaxInt64, 10))))
+	server.commit(commands.CreateSetCommand("min", []byte(strconv.FormatInt(math.MinInt64, 10))))
+
+	for _, command := range []commands.Command{
+		{Identifier: commands.INCR_COMMAND, Key: "text"},
+		{Identifier: commands.INCR_COMMAND, Key: "max"},
+		{Identifier: commands.DECR_COMMAND, Key: "min"},
+	} {
+		response := server.executeIncrement(command)
+		if response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+			t.Errorf("Expected %+v to be a user error. Got %+v", command, response)
+		}
+	}
+	if len(writeLogger.logged) != 3 {
+		t.Errorf("Expected failed increments not to be logged. Got %+v", writeLogger.logged)
+	}
+}
+
+func TestIncrementOfExpiredKeyStartsFromZero(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+	server.commit(commands.CreateSetWithExpiryCommand("counter", []byte("5"), time.Now().Add(20*time.Millisecond).UnixMilli()))
+	time.Sleep(30 * time.Millisecond)
+
+	response := server.executeIncrement(commands.Command{Identifier: commands.INCR_COMMAND, Key: "counter"})
+	if response.ErrorCode != commands.NO_ERROR_ERROR_CODE || binary.BigEndian.Uint64(response.Message) != 1 {
+		t.Fatalf("Expected an expired counter to count as 0. Got %+v", response)
+	}
+	expiresAt, err := server.StorageBackend.Expiry("counter")
+	if err != nil || expiresAt != 0 {
+		t.Errorf("Expected the new counter to have no expiry. Got %d and err = %v", expiresAt, err)
+	}
+	last := writeLogger.logged[len(writeLogger.logged)-1]
+	if last.Identifier != commands.SET_COMMAND || string(last.Value) != "1" {
+		t.Errorf("Expected the increment to be logged as a SET without an expiry. Got %+v", last)
+	}
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+var errBadPattern = errors.New("syntax error in pattern")
+
+// Reports whether key matches the glob pattern
+//
+// '*' matches any run of characters, '?' any single character and '[...]' any character in the set.
+// Sets can hold ranges like 'a-z' and are negated by starting them with '^' or '!'. '\' matches the next character literally.
+// Unlike path.Match '/' isn't special. Returns errBadPattern if the pattern is malformed, whatever the key.
+func matchGlob(pattern string, key string) (bool, error) {
+	// Where to go back to if the rest of the pattern doesn't match after the last '*'
+	starPattern, starKey := -1, 0
+	p, k := 0, 0
+
+	for p < len(pattern) || k < len(key) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starPattern, starKey = p, k
+				p++
+				continue
+
+			case '?':
+				if k < len(key) {
+					_, size := utf8.DecodeRuneInString(key[k:])
+					p++
+					k += size
+					continue
+				}
+
+			case '[':
+				if k < len(key) {
+					r, size := utf8.DecodeRuneInString(key[k:])
+					matched, setSize, err := matchSet(pattern[p:], r)
+					if err != nil {
+						return false, err
+					}
+					if matched {
+						p += setSize
+						k += size
+						continue
+					}
+				} else if _, _, err := matchSet(pattern[p:], 0); err != nil {
+					return false, err
+				}
+
+			default:
+				literal := pattern[p]
+				literalSize := 1
+				if literal == '\\' {
+					if p+1 == len(pattern) {
+						return false, errBadPattern
+					}
+					literal = pattern[p+1]
+					literalSize = 2
+				}
+				if k < len(key) && key[k] == literal {
+					p += literalSize
+					k++
+					continue
+				}
+			}
+		}
+
+		if starPattern == -1 || starKey == len(key) {
+			// Finish checking the pattern is well formed before giving up
+			return false, checkGlob(pattern[p:])
+		}
+		// Let the last '*' swallow one more character and try again
+		_, size := utf8.DecodeRuneInString(key[starKey:])
+		starKey += size
+		p, k = starPattern+1, starKey
+	}
+
+	return true, nil
+}
+
+// Matches r against the set at the start of pattern returning the size of the set in bytes
+func matchSet(pattern string, r rune) (bool, int, error) {
+	i := 1
+	negated := false
+	if i < len(pattern) && (pattern[i] == '^' || pattern[i] == '!') {
+		negated = true
+		i++
+	}
+
+	matched := false
+	first := true
+	for {
+		if i >= len(pattern) {
+			return false, 0, errBadPattern
+		}
+		// A ']' straight after the '[' is part of the set
+		if pattern[i] == ']' && !first {
+			return matched != negated, i + 1, nil
+		}
+		first = false
+
+		low, size, err := setChar(pattern[i:])
+		if err != nil {
+			return false, 0, err
+		}
+		i += size
+		high := low
+		if i+1 < len(pattern) && pattern[i] == '-' && pattern[i+1] != ']' {
+			high, size, err = setChar(pattern[i+1:])
+			if err != nil {
+				return false, 0, err
+			}
+			i += 1 + size
+		}
+		if low <= r && r <= high {
+			matched = true
+		}
+	}
+}
+
+func setChar(pattern string) (rune, int, error) {
+	if pattern[0] == '\\' {
+		if len(pattern) == 1 {
+			return 0, 0, errBadPattern
+		}
+		r, size := utf8.DecodeRuneInString(pattern[1:])
+		return r, size + 1, nil
+	}
+	r, size := utf8.DecodeRuneInString(pattern)
+	return r, size, nil
+}
+
+// Returns errBadPattern if any set or escape in pattern is malformed
+func checkGlob(pattern string) error {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			if i+1 == len(pattern) {
+				return errBadPattern
+			}
+			i++
+		case '[':
+			_, size, err := matchSet(pattern[i:], 0)
+			if err != nil {
+				return err
+			}
+			i += size - 1
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	listener "github.com/willcruse/kvdb/server/v2/internal/listener"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+	writelogger "github.com/willcruse/kvdb/server/v2/internal/write-logger"
+)
+
+const (
+	FEATURE_LENGTH_PREFIX = "length-prefix"
+	FEATURE_REQUEST_IDS   = "request-ids"
+	FEATURE_VERSIONS      = "versions"
+	// Followed by '=<size in bytes>'
+	FEATURE_MAX_MESSAGE_SIZE = "max-message-size"
+)
+
+// Commands understood by handleConnection whatever the StorageBackend
+var coreCommands = []uint8{
+	commands.GET_COMMAND,
+	commands.SET_COMMAND,
+	commands.DELETE_COMMAND,
+	commands.HELLO_COMMAND,
+	commands.BGSAVE_COMMAND,
+	commands.SETEX_COMMAND,
+	commands.EXPIRE_COMMAND,
+	commands.PERSIST_COMMAND,
+	commands.TTL_COMMAND,
+	commands.SCAN_COMMAND,
+	commands.MGET_COMMAND,
+	commands.MSET_COMMAND,
+	commands.MDEL_COMMAND,
+	commands.INCR_COMMAND,
+	commands.DECR_COMMAND,
+	commands.INCRBY_COMMAND,
+	commands.SETNX_COMMAND,
+	commands.SETXX_COMMAND,
+	commands.CAS_COMMAND,
+	commands.MULTI_COMMAND,
+	commands.EXEC_COMMAND,
+	commands.DISCARD_COMMAND,
+	commands.WATCH_COMMAND,
+	commands.UNWATCH_COMMAND,
+}
+
+// Commands that need a storagebackend.OrderedStorageBackend
+var orderedCommands = []uint8{
+	commands.RANGE_COMMAND,
+}
+
+// Commands that need a storagebackend.MultiVersionStorageBackend
+var multiVersionCommands = []uint8{
+	commands.SNAPSHOT_COMMAND,
+	commands.GET_AT_COMMAND,
+	commands.SCAN_AT_COMMAND,
+}
+
+// Commands that need a writelogger.HistoryWriteLogger
+var historyCommands = []uint8{
+	commands.HISTORY_COMMAND,
+	commands.GET_AS_OF_COMMAND,
+}
+
+// Commands that need a writelogger.BackupWriteLogger
+var backupCommands = []uint8{
+	commands.BACKUP_COMMAND,
+}
+
+// Sent to clients using the given protocol version in reply to a HELLO
+func (server *Server) supportedCommands(version uint8) []uint8 {
+	supported := append([]uint8{}, coreCommands...)
+	if _, ok := server.StorageBackend.(storagebackend.OrderedStorageBackend); ok {
+		supported = append(supported, orderedCommands...)
+	}
+	if _, ok := server.StorageBackend.(storagebackend.MultiVersionStorageBackend); ok {
+		supported = append(supported, multiVersionCommands...)
+	}
+	if _, ok := server.WriteLogger.(writelogger.HistoryWriteLogger); ok {
+		supported = append(supported, historyCommands...)
+	}
+	// Streamed backups end with an empty response, which version 1 sends as a bare error code. See streamBackup
+	if _, ok := server.WriteLogger.(writelogger.BackupWriteLogger); ok && version >= commands.PROTOCOL_VERSION_2 {
+		supported = append(supported, backupCommands...)
+	}
+	return supported
+}
+
+// Picks the protocol version for a new connection
+//
+// Clients that open with a HELLO announce the highest version they speak and get the highest version both sides support.
+// Anything else is a client from before the handshake existed so it gets version 1 and its first byte is left in the reader as the first command.
+func (server *Server) negotiate(reader *bufio.Reader, conn listener.Readable) (*commands.Codec, error) {
+	firstByte, err := reader.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("(Server) Failed to read first byte of connection. Error: %w", err)
+	}
+
+	if firstByte[0] != commands.HELLO_COMMAND {
+		return &commands.Codec{Version: commands.PROTOCOL_VERSION_1}, nil
+	}
+
+	// Already peeked the command byte
+	_, err = reader.Discard(1)
+	if err != nil {
+		return nil, fmt.Errorf("(Server) Failed to read HELLO. Error: %w", err)
+	}
+	clientVersion, err := reader.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("(Server) Failed to read client protocol version from HELLO. Error: %w", err)
+	}
+
+	response := commands.HelloResponse{ErrorCode: commands.NO_ERROR_ERROR_CODE, Version: min(clientVersion, commands.MAX_PROTOCOL_VERSION)}
+	if clientVersion < commands.MIN_PROTOCOL_VERSION {
+		response.ErrorCode = commands.USER_ERROR_ERROR_CODE
+		response.Version = commands.MAX_PROTOCOL_VERSION
+	} else {
+		response.Commands = server.supportedCommands(response.Version)
+		response.Features = server.features(response.Version)
+	}
+
+	encoded, err := response.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("(Server) Failed to encode HELLO response. Error: %w", err)
+	}
+	_, err = conn.Write(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("(Server) Failed to send HELLO response. Error: %w", err)
+	}
+
+	if response.ErrorCode != commands.NO_ERROR_ERROR_CODE {
+		return nil, fmt.Errorf("(Server) Client requested unsupported protocol version %d", clientVersion)
+	}
+
+	log.Printf("Negotiated protocol version %d\n", response.Version)
+	return &commands.Codec{Version: response.Version}, nil
+}
+
+// Optional behaviour available to a connection using the given protocol version
+func (server *Server) features(version uint8) []string {
+	features := []string{fmt.Sprintf("%s=%d", FEATURE_MAX_MESSAGE_SIZE, server.MaxMessageSize)}
+	if version >= commands.PROTOCOL_VERSION_2 {
+		features = append(features, FEATURE_LENGTH_PREFIX)
+	}
+	if version >= commands.PROTOCOL_VERSION_3 {
+		features = append(features, FEATURE_REQUEST_IDS)
+	}
+	if version >= commands.PROTOCOL_VERSION_4 {
+		features = append(features, FEATURE_VERSIONS)
+	}
+
+	return features
+}
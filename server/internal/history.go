@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+	writelogger "github.com/willcruse/kvdb/server/v2/internal/write-logger"
+)
+
+const (
+	// Used when a HISTORY asks for a limit of 0
+	DEFAULT_HISTORY_LIMIT = 10
+	// Larger limits are cut down to this as every value is read back from disk
+	MAX_HISTORY_LIMIT = 1000
+)
+
+// The writes needed to work out a key's value have been compacted away or were logged without a timestamp
+var errHistoryUnavailable = errors.New("the write log doesn't go back far enough")
+
+func (server *Server) historyWriteLogger() (writelogger.HistoryWriteLogger, *commands.Response) {
+	logger, ok := server.WriteLogger.(writelogger.HistoryWriteLogger)
+	if !ok {
+		response := commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "key history needs a write log that indexes keys")
+		return nil, &response
+	}
+	return logger, nil
+}
+
+// Returns the last Limit values the key was set to, newest first, read back from the write log
+//
+// The response is a list with two elements per value. The first is when it was logged (8 byte big endian Unix milliseconds)
+// followed by its version (8 byte big endian). The second is the value, or missing if the key was deleted.
+// Expiry changes aren't listed. Only writes still in the write log are, so older ones disappear as it's compacted.
+func (server *Server) executeHistory(command commands.Command) commands.Response {
+	logger, errorResponse := server.historyWriteLogger()
+	if errorResponse != nil {
+		return *errorResponse
+	}
+
+	limit := int(command.Limit)
+	if limit == 0 {
+		limit = DEFAULT_HISTORY_LIMIT
+	}
+	limit = min(limit, MAX_HISTORY_LIMIT)
+
+	var elements [][]byte
+	var found []bool
+	_, err := logger.KeyHistory(command.Key, math.MaxInt64, func(write writelogger.KeyWrite) bool {
+		switch write.Command.Identifier {
+		case commands.SET_COMMAND, commands.SETEX_COMMAND, commands.DELETE_COMMAND:
+			header := binary.BigEndian.AppendUint64(nil, uint64(write.LoggedAt))
+			header = binary.BigEndian.AppendUint64(header, write.Seq)
+			elements = append(elements, header, write.Command.Value)
+			found = append(found, true, write.Command.Identifier != commands.DELETE_COMMAND)
+		}
+		return len(elements) < 2*limit
+	})
+	if err != nil {
+		log.Printf("handler_net_conn: Error reading key history %v\n", err)
+		return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to read history of %s", command.Key)
+	}
+
+	return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE, Message: commands.EncodeListWithMissing(elements, found)}
+}
+
+// Like GET but reads the key as it was at AsOf from the write log
+func (server *Server) executeGetAsOf(command commands.Command) commands.Response {
+	logger, errorResponse := server.historyWriteLogger()
+	if errorResponse != nil {
+		return *errorResponse
+	}
+
+	entry, err := keyAsOf(logger, command.Key, command.AsOf)
+	if errors.Is(err, errHistoryUnavailable) {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "can't tell what %s was at %d as %v", command.Key, command.AsOf, errHistoryUnavailable)
+	}
+	if errors.Is(err, storagebackend.ErrKeyNotFound) {
+		return commands.ErrorResponse(commands.NOT_FOUND_ERROR_CODE, "no such key %s at %d", command.Key, command.AsOf)
+	}
+	if err != nil {
+		log.Printf("handler_net_conn: Error reading key history %v\n", err)
+		return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to read history of %s", command.Key)
+	}
+
+	response := commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE, Message: entry.Value}
+	if command.WithVersion {
+		response.Message = append(binary.BigEndian.AppendUint64(nil, entry.Version), entry.Value...)
+	}
+	return response
+}
+
+// Works back from the last write to key logged at or before at until it finds the value the key had
+// EXPIRE and PERSIST change the expiry of the value set before them. Returns an error wrapping storagebackend.ErrKeyNotFound
+// if the key didn't exist or had expired at that time
+func keyAsOf(logger writelogger.HistoryWriteLogger, key string, at int64) (storagebackend.Entry, error) {
+	var entry storagebackend.Entry
+	var found, resolved, expiryKnown, untimed bool
+	complete, err := logger.KeyHistory(key, at, func(write writelogger.KeyWrite) bool {
+		if write.LoggedAt == 0 {
+			untimed = true
+			return false
+		}
+		// The newest write is the version whatever it did
+		if entry.Version == 0 {
+			entry.Version = write.Seq
+		}
+
+		switch write.Command.Identifier {
+		case commands.DELETE_COMMAND:
+			resolved = true
+			return false
+		case commands.EXPIRE_COMMAND, commands.PERSIST_COMMAND:
+			if !expiryKnown {
+				entry.ExpiresAt, expiryKnown = write.Command.ExpiresAt, true
+			}
+			return true
+		default:
+			if !expiryKnown {
+				entry.ExpiresAt = write.Command.ExpiresAt
+			}
+			entry.Value = write.Command.Value
+			found, resolved = true, true
+			return false
+		}
+	})
+	if err != nil {
+		return entry, fmt.Errorf("(Server) Failed to read history of %s. Error: %w", key, err)
+	}
+
+	if untimed || (!resolved && !complete) {
+		return entry, fmt.Errorf("(Server) History of %s is incomplete. Error: %w", key, errHistoryUnavailable)
+	}
+	if !found || (entry.ExpiresAt != 0 && entry.ExpiresAt <= at) {
+		return entry, fmt.Errorf("(Server) %s didn't exist at %d. Error: %w", key, at, storagebackend.ErrKeyNotFound)
+	}
+	return entry, nil
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+	writelogger "github.com/willcruse/kvdb/server/v2/internal/write-logger"
+)
+
+func newDiskLoggedServer(t *testing.T, dir string) *Server {
+	server := &Server{StorageBackend: &storagebackend.ShardedMapStorageBackend{}, WriteLogger: &writelogger.SegmentedDiskLogger{Dir: dir}, SnapshotPath: filepath.Join(dir, SNAPSHOT_FILE_NAME)}
+	err := server.Init()
+	if err != nil {
+		t.Fatalf("Failed to init server. Got err = %s", err)
+	}
+	t.Cleanup(func() { server.WriteLogger.Close() })
+	return server
+}
+
+// Returns a time strictly between writes logged before and after it
+func pause() int64 {
+	time.Sleep(2 * time.Millisecond)
+	at := time.Now().UnixMilli()
+	time.Sleep(2 * time.Millisecond)
+	return at
+}
+
+func TestHistoryListsValuesNewestFirst(t *testing.T) {
+	dir := t.TempDir()
+	server := newDiskLoggedServer(t, dir)
+	server.commit(commands.CreateSetCommand("key", []byte("1")))
+	server.commit(commands.CreateMultiSetCommand([]string{"key", "other"}, [][]byte{[]byte("2"), []byte("x")}))
+	server.commit(commands.CreateExpireCommand("key", time.Now().Add(time.Hour).UnixMilli()))
+	server.commit(commands.CreateDeleteCommand("key"))
+	server.WriteLogger.Close()
+
+	// The index is rebuilt as the log is replayed
+	server = newDiskLoggedServer(t, dir)
+	history := decodeHistory(t, server.executeHistory(commands.Command{Identifier: commands.HISTORY_COMMAND, Key: "key", Limit: 2}).Message)
+	if fmt.Sprint(history) != "[4:<deleted> 2:2]" {
+		t.Errorf("Expected the DELETE then the MSET's value of the key, skipping the EXPIRE. Got %v", history)
+	}
+}
+
+// Versions and values of a HISTORY response
+func decodeHistory(t *testing.T, encoded []byte) []string {
+	count := binary.BigEndian.Uint32(encoded)
+	encoded = encoded[commands.LENGTH_PREFIX_SIZE:]
+	var history []string
+	for range count / 2 {
+		version := binary.BigEndian.Uint64(encoded[commands.LENGTH_PREFIX_SIZE+commands.TIMESTAMP_SIZE:])
+		encoded = encoded[commands.LENGTH_PREFIX_SIZE+commands.TIMESTAMP_SIZE+commands.VERSION_SIZE:]
+		length := binary.BigEndian.Uint32(encoded)
+		encoded = encoded[commands.LENGTH_PREFIX_SIZE:]
+		if length == commands.MISSING_ELEMENT_LENGTH {
+			history = append(history, fmt.Sprintf("%d:<deleted>", version))
+			continue
+		}
+		history = append(history, fmt.Sprintf("%d:%s", version, encoded[:length]))
+		encoded = encoded[length:]
+	}
+	if len(encoded) != 0 {
+		t.Errorf("Unexpected %d bytes after the history", len(encoded))
+	}
+	return history
+}
+
+func TestGetAsOfReadsValueAtTime(t *testing.T) {
+	server := newDiskLoggedServer(t, t.TempDir())
+	beforeFirst := pause()
+	server.commit(commands.CreateSetCommand("key", []byte("1")))
+	afterFirst := pause()
+	server.commit(commands.CreateSetWithExpiryCommand("key", []byte("2"), time.Now().UnixMilli()+1))
+	afterExpiry := pause()
+	server.commit(commands.CreateSetCommand("key", []byte("3")))
+	server.commit(commands.CreateDeleteCommand("key"))
+
+	for _, test := range []struct {
+		name     string
+		at       int64
+		expected string
+	}{
+		{"before the key existed", beforeFirst, ""},
+		{"after the first SET", afterFirst, "1"},
+		{"after the value expired", afterExpiry, ""},
+		{"after the DELETE", time.Now().UnixMilli(), ""},
+	} {
+		response := server.executeGetAsOf(commands.Command{Identifier: commands.GET_AS_OF_COMMAND, Key: "key", AsOf: test.at})
+		if test.expected == "" && response.ErrorCode != commands.NOT_FOUND_ERROR_CODE {
+			t.Errorf("%s: Expected the key not to be found. Got %+v", test.name, response)
+		}
+		if test.expected != "" && string(response.Message) != test.expected {
+			t.Errorf("%s: Expected %q. Got %+v", test.name, test.expected, response)
+		}
+	}
+}
+
+func TestKeyHistoryNeedsIndexedWriteLog(t *testing.T) {
+	server, _ := newTestServer(t)
+	response := server.executeHistory(commands.Command{Identifier: commands.HISTORY_COMMAND, Key: "key"})
+	if response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected HISTORY without a key index to be a user error. Got %+v", response)
+	}
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/willcruse/kvdb/server/v2/internal/snapshot"
+	writelogger "github.com/willcruse/kvdb/server/v2/internal/write-logger"
+)
+
+// Moves a write log and snapshot kept in single files by older versions into dataDir so an upgraded server keeps its data
+//
+// Only runs if there's a log at logPath and dataDir is empty or doesn't exist, and returns whether it did.
+// The files are copied into a temporary directory that's renamed to dataDir once complete, so a migration
+// that fails part way leaves dataDir as it was and is run again on the next start. The old files are left where they are.
+func MigrateLegacyFiles(logPath string, snapshotPath string, dataDir string) (bool, error) {
+	_, err := os.Stat(logPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("(Migration) Failed to stat %s. Error: %w", logPath, err)
+	}
+	existing, err := os.ReadDir(dataDir)
+	if err == nil && len(existing) > 0 {
+		return false, nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("(Migration) Failed to list %s. Error: %w", dataDir, err)
+	}
+
+	tmpDir := filepath.Clean(dataDir) + ".migrating"
+	err = os.RemoveAll(tmpDir)
+	if err != nil {
+		return false, fmt.Errorf("(Migration) Failed to remove %s. Error: %w", tmpDir, err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	err = os.MkdirAll(tmpDir, 0755)
+	if err != nil {
+		return false, fmt.Errorf("(Migration) Failed to create %s. Error: %w", tmpDir, err)
+	}
+	_, err = snapshot.ReadHeader(snapshotPath)
+	if err == nil {
+		err = copyFile(snapshotPath, filepath.Join(tmpDir, SNAPSHOT_FILE_NAME))
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("(Migration) Failed to migrate snapshot %s. Error: %w", snapshotPath, err)
+	}
+	err = writelogger.ImportLegacyLog(logPath, tmpDir)
+	if err != nil {
+		return false, fmt.Errorf("(Migration) Failed to migrate write log %s. Error: %w", logPath, err)
+	}
+
+	// Checked empty above. os.Rename won't replace a directory even if it's empty
+	err = os.Remove(dataDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, fmt.Errorf("(Migration) Failed to remove empty %s. Error: %w", dataDir, err)
+	}
+	err = os.Rename(tmpDir, dataDir)
+	if err != nil {
+		return false, fmt.Errorf("(Migration) Failed to move %s into place at %s. Error: %w", tmpDir, dataDir, err)
+	}
+	writelogger.SyncDir(filepath.Dir(filepath.Clean(dataDir)))
+
+	log.Printf("Migrated %s and %s into %s. They're no longer used and can be deleted\n", logPath, snapshotPath, dataDir)
+	return true, nil
+}
+
+func copyFile(path string, dest string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	file, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, source)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
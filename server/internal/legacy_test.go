@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+)
+
+// Lays out a data directory's files the way versions before --data-dir did
+func writeLegacyFiles(t *testing.T) (string, string) {
+	dataDir := t.TempDir()
+	server := newDiskLoggedServer(t, dataDir)
+	server.commit(commands.CreateSetCommand("snapshotted", []byte("1")))
+	err := server.snapshot()
+	if err != nil {
+		t.Fatalf("Failed to snapshot. Got err = %s", err)
+	}
+	server.commit(commands.CreateSetCommand("logged", []byte("2")))
+	server.WriteLogger.Close()
+
+	legacyDir := t.TempDir()
+	logPath := filepath.Join(legacyDir, "kv.db")
+	snapshotPath := filepath.Join(legacyDir, "kv.snapshot")
+	// Compaction has dropped the first write from the log so the snapshot is needed too
+	err = os.Rename(filepath.Join(dataDir, "wal-00000002.log"), logPath)
+	if err == nil {
+		err = os.Rename(filepath.Join(dataDir, SNAPSHOT_FILE_NAME), snapshotPath)
+	}
+	if err != nil {
+		t.Fatalf("Failed to move files out of the data directory. Got err = %s", err)
+	}
+	return logPath, snapshotPath
+}
+
+func TestMigrateLegacyFilesKeepsData(t *testing.T) {
+	logPath, snapshotPath := writeLegacyFiles(t)
+
+	dataDir := filepath.Join(t.TempDir(), "kv-data")
+	migrated, err := MigrateLegacyFiles(logPath, snapshotPath, dataDir)
+	if err != nil || !migrated {
+		t.Fatalf("Expected the legacy files to be migrated. Got %t and err = %v", migrated, err)
+	}
+	server := newDiskLoggedServer(t, dataDir)
+	expectKeys(t, server, map[string]string{"snapshotted": "1", "logged": "2"})
+	if server.WriteLogger.LastSeq() != 2 {
+		t.Errorf("Expected new writes to follow on from the migrated ones. Got LastSeq %d", server.WriteLogger.LastSeq())
+	}
+	server.WriteLogger.Close()
+
+	// Once the data directory is in use the legacy files are ignored
+	migrated, err = MigrateLegacyFiles(logPath, snapshotPath, dataDir)
+	if err != nil || migrated {
+		t.Errorf("Expected a data directory in use to be left alone. Got %t and err = %v", migrated, err)
+	}
+}
+
+func TestMigrateLegacyFilesFromTextLog(t *testing.T) {
+	legacyDir := t.TempDir()
+	logPath := filepath.Join(legacyDir, "kv.db")
+	// What the first versions wrote after SET a 1, SET b 2 and DELETE a
+	err := os.WriteFile(logPath, []byte("SET\n1 a\n1 1\nSET\n1 b\n1 2\nDELETE\n1 a\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write legacy log. Got err = %s", err)
+	}
+
+	dataDir := filepath.Join(t.TempDir(), "kv-data")
+	migrated, err := MigrateLegacyFiles(logPath, filepath.Join(legacyDir, "kv.snapshot"), dataDir)
+	if err != nil || !migrated {
+		t.Fatalf("Expected the text log to be migrated. Got %t and err = %v", migrated, err)
+	}
+	server := newDiskLoggedServer(t, dataDir)
+	expectKeys(t, server, map[string]string{"b": "2"})
+	_, err = server.StorageBackend.Get("a")
+	if err == nil {
+		t.Errorf("Expected the deleted key to stay deleted")
+	}
+}
+
+func TestMigrateLegacyFilesIntoEmptyDataDir(t *testing.T) {
+	logPath, snapshotPath := writeLegacyFiles(t)
+
+	dataDir := t.TempDir()
+	migrated, err := MigrateLegacyFiles(logPath, snapshotPath, dataDir)
+	if err != nil || !migrated {
+		t.Fatalf("Expected the legacy files to be migrated into an empty data directory. Got %t and err = %v", migrated, err)
+	}
+	expectKeys(t, newDiskLoggedServer(t, dataDir), map[string]string{"snapshotted": "1", "logged": "2"})
+}
+
+func TestMigrateLegacyFilesLeavesDataDirOnFailure(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "kv.db")
+	err := os.WriteFile(logPath, []byte("SET key value\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write legacy log. Got err = %s", err)
+	}
+
+	dataDir := filepath.Join(t.TempDir(), "kv-data")
+	_, err = MigrateLegacyFiles(logPath, filepath.Join(t.TempDir(), "kv.snapshot"), dataDir)
+	if err == nil {
+		t.Fatalf("Expected a log that can't be read to stop the migration")
+	}
+	_, err = os.Stat(dataDir)
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected no data directory to be created. Got err = %v", err)
+	}
+	_, err = os.Stat(dataDir + ".migrating")
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected the temporary directory to be removed. Got err = %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"log"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+)
+
+// Runs MGET, MSET or MDEL over every key in the request
+//
+// MSET and MDEL are committed as a single write so they're logged as one record and applied together.
+// MGET responds with a list of values in the same order as the keys. Keys that don't exist are sent as missing elements.
+func (server *Server) executeMultiKey(command commands.Command) commands.Response {
+	if len(command.Keys) == 0 {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "at least one key is needed")
+	}
+
+	switch command.Identifier {
+	case commands.MGET_COMMAND:
+		// Read together so none or all of each MSET, MDEL or transaction is seen
+		entries, found := server.StorageBackend.GetMany(command.Keys)
+		values := make([][]byte, len(entries))
+		for i, entry := range entries {
+			values[i] = entry.Value
+		}
+		return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE, Message: commands.EncodeListWithMissing(values, found)}
+
+	case commands.MSET_COMMAND:
+		err := server.commit(command)
+		if err != nil {
+			log.Printf("handler_net_conn: Error setting values %v\n", err)
+			return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to set %d keys", len(command.Keys))
+		}
+
+	case commands.MDEL_COMMAND:
+		err := server.commit(command)
+		if err != nil {
+			log.Printf("handler_net_conn: Error deleting values %v\n", err)
+			return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to delete %d keys", len(command.Keys))
+		}
+	}
+
+	return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE}
+}
@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+)
+
+func TestMultiSetIsLoggedAsOneRecord(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+
+	mset := commands.CreateMultiSetCommand([]string{"a", "b", "c"}, [][]byte{[]byte("1"), []byte("2"), []byte("3")})
+	response := server.executeMultiKey(mset)
+	if response.ErrorCode != commands.NO_ERROR_ERROR_CODE {
+		t.Fatalf("Expected MSET to succeed. Got %+v", response)
+	}
+	response = server.executeMultiKey(commands.CreateMultiDeleteCommand([]string{"b", "missing"}))
+	if response.ErrorCode != commands.NO_ERROR_ERROR_CODE {
+		t.Fatalf("Expected MDEL to succeed. Got %+v", response)
+	}
+	if len(writeLogger.logged) != 2 {
+		t.Errorf("Expected MSET and MDEL to be logged as a record each. Got %+v", writeLogger.logged)
+	}
+
+	mget := commands.Command{Identifier: commands.MGET_COMMAND, Keys: []string{"a", "b", "c"}}
+	response = server.executeMultiKey(mget)
+	if response.ErrorCode != commands.NO_ERROR_ERROR_CODE {
+		t.Fatalf("Expected MGET to succeed. Got %+v", response)
+	}
+	// The deleted key is sent as missing rather than empty so can't go through decodeList
+	expected := binary.BigEndian.AppendUint32(nil, 3)
+	expected = append(binary.BigEndian.AppendUint32(expected, 1), '1')
+	expected = binary.BigEndian.AppendUint32(expected, commands.MISSING_ELEMENT_LENGTH)
+	expected = append(binary.BigEndian.AppendUint32(expected, 1), '3')
+	if string(response.Message) != string(expected) {
+		t.Errorf("Expected MGET to mark b as missing. Got %q", response.Message)
+	}
+
+	response = server.executeMultiKey(commands.Command{Identifier: commands.MGET_COMMAND})
+	if response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected MGET without keys to be a user error. Got %+v", response)
+	}
+}
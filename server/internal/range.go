@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+const (
+	// Used when a RANGE asks for a limit of 0
+	DEFAULT_RANGE_LIMIT = 100
+	// Larger limits are cut down to this so one request can't hold the backend's lock for too long
+	MAX_RANGE_LIMIT = 10000
+)
+
+// Returns up to Limit keys and values from Key (inclusive) to Value (exclusive, empty for no end)
+//
+// The response is a list. The first element is the cursor followed by each key and then its value.
+// The cursor is the start key to send to fetch the next page or empty if there are no more keys.
+func (server *Server) executeRange(command commands.Command) commands.Response {
+	backend, ok := server.StorageBackend.(storagebackend.OrderedStorageBackend)
+	if !ok {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "RANGE needs an ordered storage backend. Start the server with --storage-backend skiplist")
+	}
+
+	limit := int(command.Limit)
+	if limit == 0 {
+		limit = DEFAULT_RANGE_LIMIT
+	}
+	limit = min(limit, MAX_RANGE_LIMIT)
+
+	elements := [][]byte{nil}
+	var cursor string
+	count := 0
+	backend.Range(command.Key, string(command.Value), func(key string, entry storagebackend.Entry) bool {
+		if count == limit {
+			cursor = key
+			return false
+		}
+		elements = append(elements, []byte(key), entry.Value)
+		count++
+		return true
+	})
+	elements[0] = []byte(cursor)
+
+	return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE, Message: commands.EncodeList(elements)}
+}
@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+func decodeList(t *testing.T, encoded []byte) []string {
+	count := binary.BigEndian.Uint32(encoded)
+	encoded = encoded[commands.LENGTH_PREFIX_SIZE:]
+	elements := make([]string, 0, count)
+	for range count {
+		length := binary.BigEndian.Uint32(encoded)
+		encoded = encoded[commands.LENGTH_PREFIX_SIZE:]
+		elements = append(elements, string(encoded[:length]))
+		encoded = encoded[length:]
+	}
+	if len(encoded) != 0 {
+		t.Errorf("Unexpected %d bytes after the list", len(encoded))
+	}
+	return elements
+}
+
+func TestRangePagesWithCursor(t *testing.T) {
+	server := &Server{StorageBackend: &storagebackend.SkipListStorageBackend{}, WriteLogger: &memoryWriteLogger{}}
+	server.Init()
+	for _, key := range []string{"user:1:a", "user:1:b", "user:1:c", "user:2:a"} {
+		server.StorageBackend.Set(key, []byte("value of "+key), 1)
+	}
+
+	command := commands.Command{Identifier: commands.RANGE_COMMAND, Key: "user:1:", Value: []byte("user:1;"), Limit: 2}
+	page := decodeList(t, server.executeRange(command).Message)
+	if fmt.Sprint(page) != "[user:1:c user:1:a value of user:1:a user:1:b value of user:1:b]" {
+		t.Errorf("Expected the first two keys and a cursor pointing at the third. Got %q", page)
+	}
+
+	command.Key = page[0]
+	page = decodeList(t, server.executeRange(command).Message)
+	if fmt.Sprint(page) != "[ user:1:c value of user:1:c]" {
+		t.Errorf("Expected the last key and an empty cursor. Got %q", page)
+	}
+}
+
+func TestRangeNeedsOrderedBackend(t *testing.T) {
+	server, _ := newTestServer(t)
+	response := server.executeRange(commands.Command{Identifier: commands.RANGE_COMMAND})
+	if response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected RANGE on a hash backend to be a user error. Got %+v", response)
+	}
+}
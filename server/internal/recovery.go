@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	"github.com/willcruse/kvdb/server/v2/internal/snapshot"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+	writelogger "github.com/willcruse/kvdb/server/v2/internal/write-logger"
+)
+
+// The last write to keep when recovering. Set one of the two
+type RecoveryTarget struct {
+	// Keep every write up to and including this sequence number
+	Seq uint64
+	// Keep every write logged at or before this time (Unix milliseconds)
+	// Records logged before the write log held timestamps are always kept
+	Time int64
+}
+
+// Stops reading the log once a record past the target is reached
+var errRecoveryTargetReached = errors.New("recovery target reached")
+
+func (target RecoveryTarget) String() string {
+	if target.Seq != 0 {
+		return fmt.Sprintf("sequence number %d", target.Seq)
+	}
+	return time.UnixMilli(target.Time).UTC().Format(time.RFC3339Nano)
+}
+
+func (target RecoveryTarget) includes(seq uint64, loggedAt int64) bool {
+	if target.Seq != 0 {
+		return seq <= target.Seq
+	}
+	return loggedAt <= target.Time
+}
+
+// Whether everything the snapshot holds was written at or before the target
+func (target RecoveryTarget) includesSnapshot(header snapshot.Header) bool {
+	if target.Seq != 0 {
+		return header.Seq <= target.Seq
+	}
+	// Snapshots from before Taken At was recorded can't be placed in time
+	return header.TakenAt != 0 && header.TakenAt <= target.Time
+}
+
+// Rebuilds the data directory sourceDir as it was at target into targetDir, which must be empty or not exist
+//
+// The snapshot in sourceDir is used if it was taken before the target. Otherwise the write log is replayed from
+// its first record, which only works if it hasn't been compacted since then. Nothing in sourceDir is changed so
+// it can be a copy or a backup. targetDir gets a snapshot holding every write up to the target whose header is
+// returned. The server moves the write log on past it when it's started on targetDir.
+func Recover(sourceDir string, targetDir string, target RecoveryTarget) (snapshot.Header, error) {
+	if (target.Seq == 0) == (target.Time == 0) {
+		return snapshot.Header{}, fmt.Errorf("(Recovery) Expected a sequence number or a time to recover to")
+	}
+	existing, err := os.ReadDir(targetDir)
+	if err == nil && len(existing) > 0 {
+		return snapshot.Header{}, fmt.Errorf("(Recovery) %s is not empty. Recovery won't overwrite an existing data directory", targetDir)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return snapshot.Header{}, fmt.Errorf("(Recovery) Failed to list %s. Error: %w", targetDir, err)
+	}
+
+	start := time.Now()
+	server := &Server{StorageBackend: &storagebackend.ShardedMapStorageBackend{}}
+	server.StorageBackend.Init()
+
+	snapshotPath := filepath.Join(sourceDir, SNAPSHOT_FILE_NAME)
+	header, err := snapshot.ReadHeader(snapshotPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return snapshot.Header{}, fmt.Errorf("(Recovery) Failed to read snapshot. Error: %w", err)
+	}
+	// Where recovery has to start from if the log doesn't go back to the first write
+	earliest := header
+	if err == nil && target.includesSnapshot(header) {
+		server.SnapshotPath = snapshotPath
+		_, err = server.loadSnapshot()
+		if err != nil {
+			return snapshot.Header{}, err
+		}
+	} else {
+		header = snapshot.Header{}
+	}
+
+	replayed := false
+	err = writelogger.ReadLog(sourceDir, func(command commands.Command) error {
+		if command.Seq <= header.Seq {
+			return nil
+		}
+		if command.Seq != header.Seq+1 {
+			return fmt.Errorf("(Recovery) Writes %d to %d have been compacted out of the write log. %s", header.Seq+1, command.Seq-1, earliestRecoverable(earliest))
+		}
+		replayed = true
+		if !target.includes(command.Seq, command.LoggedAt) {
+			return errRecoveryTargetReached
+		}
+
+		err := server.apply(command)
+		if err != nil {
+			return err
+		}
+		header.Seq = command.Seq
+		header.TakenAt = max(header.TakenAt, command.LoggedAt)
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No write log found in %s. Recovering from the snapshot alone\n", sourceDir)
+		err = nil
+	}
+	if err != nil && !errors.Is(err, errRecoveryTargetReached) {
+		return snapshot.Header{}, fmt.Errorf("(Recovery) Failed to replay write log from %s. Error: %w", sourceDir, err)
+	}
+	if !replayed && header.Seq < earliest.Seq {
+		return snapshot.Header{}, fmt.Errorf("(Recovery) Writes %d to %d have been compacted out of the write log. %s", header.Seq+1, earliest.Seq, earliestRecoverable(earliest))
+	}
+	if target.Seq != 0 && header.Seq < target.Seq {
+		return snapshot.Header{}, fmt.Errorf("(Recovery) The write log in %s ends at sequence number %d before %s", sourceDir, header.Seq, target)
+	}
+
+	err = os.MkdirAll(targetDir, 0755)
+	if err != nil {
+		return snapshot.Header{}, fmt.Errorf("(Recovery) Failed to create %s. Error: %w", targetDir, err)
+	}
+	entries := snapshotEntries(server.StorageBackend)
+	err = snapshot.Write(filepath.Join(targetDir, SNAPSHOT_FILE_NAME), header, entries)
+	if err != nil {
+		return snapshot.Header{}, fmt.Errorf("(Recovery) Failed to write snapshot. Error: %w", err)
+	}
+
+	log.Printf("Recovered %d keys from %s as of %s up to sequence number %d into %s in %s\n", len(entries), sourceDir, target, header.Seq, targetDir, time.Since(start))
+	return header, nil
+}
+
+func earliestRecoverable(earliest snapshot.Header) string {
+	if earliest.TakenAt == 0 {
+		return fmt.Sprintf("The earliest point that can be recovered is sequence number %d", earliest.Seq)
+	}
+	return fmt.Sprintf("The earliest point that can be recovered is sequence number %d taken at %s", earliest.Seq, time.UnixMilli(earliest.TakenAt).UTC().Format(time.RFC3339Nano))
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+func TestRecoverToSequenceNumber(t *testing.T) {
+	sourceDir := t.TempDir()
+	server := newDiskLoggedServer(t, sourceDir)
+	server.commit(commands.CreateSetCommand("a", []byte("1")))
+	server.commit(commands.CreateSetCommand("b", []byte("2")))
+	server.commit(commands.CreateMultiDeleteCommand([]string{"a", "b"}))
+	server.WriteLogger.Close()
+
+	targetDir := filepath.Join(t.TempDir(), "recovered")
+	header, err := Recover(sourceDir, targetDir, RecoveryTarget{Seq: 2})
+	if err != nil || header.Seq != 2 {
+		t.Fatalf("Failed to recover to sequence number 2. Got %+v and err = %v", header, err)
+	}
+
+	recovered := newDiskLoggedServer(t, targetDir)
+	for key, expected := range map[string]string{"a": "1", "b": "2"} {
+		value, err := recovered.StorageBackend.Get(key)
+		if err != nil || string(value) != expected {
+			t.Errorf("Expected %s to be %s before the MDEL. Got %q and err = %v", key, expected, value, err)
+		}
+	}
+	if recovered.WriteLogger.LastSeq() != 2 {
+		t.Errorf("Expected new writes to follow on from the recovered ones. Got LastSeq %d", recovered.WriteLogger.LastSeq())
+	}
+
+	// The source is left alone
+	source := newDiskLoggedServer(t, sourceDir)
+	_, err = source.StorageBackend.Get("a")
+	if !errors.Is(err, storagebackend.ErrKeyNotFound) {
+		t.Errorf("Expected the source to still have the MDEL applied. Got err = %v", err)
+	}
+
+	_, err = Recover(sourceDir, targetDir, RecoveryTarget{Seq: 1})
+	if err == nil {
+		t.Errorf("Expected recovery into a data directory that isn't empty to fail")
+	}
+}
+
+func TestRecoverToTimeFromSnapshot(t *testing.T) {
+	sourceDir := t.TempDir()
+	server := newDiskLoggedServer(t, sourceDir)
+	server.commit(commands.CreateSetCommand("key", []byte("1")))
+	beforeSnapshot := pause()
+	server.commit(commands.CreateSetCommand("key", []byte("2")))
+	err := server.snapshot()
+	if err != nil {
+		t.Fatalf("Failed to snapshot. Got err = %s", err)
+	}
+	afterSnapshot := pause()
+	server.commit(commands.CreateDeleteCommand("key"))
+	server.WriteLogger.Close()
+
+	targetDir := t.TempDir()
+	header, err := Recover(sourceDir, targetDir, RecoveryTarget{Time: afterSnapshot})
+	if err != nil || header.Seq != 2 {
+		t.Fatalf("Failed to recover to before the DELETE. Got %+v and err = %v", header, err)
+	}
+	recovered := newDiskLoggedServer(t, targetDir)
+	value, err := recovered.StorageBackend.Get("key")
+	if err != nil || string(value) != "2" {
+		t.Errorf("Expected the value from before the DELETE. Got %q and err = %v", value, err)
+	}
+
+	// The snapshot compacted away the write needed to go back further
+	_, err = Recover(sourceDir, filepath.Join(t.TempDir(), "recovered"), RecoveryTarget{Time: beforeSnapshot})
+	if err == nil {
+		t.Errorf("Expected recovery to before the snapshot to fail")
+	}
+	if _, statErr := os.Stat(filepath.Join(sourceDir, SNAPSHOT_FILE_NAME)); statErr != nil {
+		t.Errorf("Expected the source snapshot to be left in place. Got err = %v", statErr)
+	}
+}
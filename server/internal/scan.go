@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"errors"
+	"log"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+const (
+	// Used when a SCAN asks for a count of 0
+	DEFAULT_SCAN_COUNT = 100
+	// Larger counts are cut down to this so one request can't hold a lock for too long
+	MAX_SCAN_COUNT = 10000
+)
+
+// Looks at up to Limit keys following on from the cursor in Key and returns the ones matching the glob in Value
+//
+// The response is a list. The first element is the cursor to send to fetch the next batch, empty once the scan is complete,
+// followed by the matching keys. A batch can be empty even though the scan isn't complete if none of the keys looked at matched.
+func (server *Server) executeScan(command commands.Command) commands.Response {
+	return server.executeScanWith(command, server.StorageBackend.Scan)
+}
+
+// Like executeScan but reads keys with scan. Used to scan at a snapshot
+func (server *Server) executeScanWith(command commands.Command, scan func(cursor []byte, count int, fn func(key string, entry storagebackend.Entry)) ([]byte, error)) commands.Response {
+	pattern := string(command.Value)
+	if _, err := matchGlob(pattern, ""); err != nil {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "invalid MATCH pattern %q: %v", pattern, err)
+	}
+
+	count := int(command.Limit)
+	if count == 0 {
+		count = DEFAULT_SCAN_COUNT
+	}
+	count = min(count, MAX_SCAN_COUNT)
+
+	elements := [][]byte{nil}
+	cursor, err := scan([]byte(command.Key), count, func(key string, entry storagebackend.Entry) {
+		// The pattern has already been checked so this can't fail
+		if matched, _ := matchGlob(pattern, key); matched || pattern == "" {
+			elements = append(elements, []byte(key))
+		}
+	})
+	if errors.Is(err, storagebackend.ErrInvalidCursor) || errors.Is(err, storagebackend.ErrSnapshotNotFound) {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "%v", err)
+	}
+	if err != nil {
+		log.Printf("handler_net_conn: Error scanning keys %v\n", err)
+		return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to scan keys")
+	}
+	elements[0] = cursor
+
+	return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE, Message: commands.EncodeList(elements)}
+}
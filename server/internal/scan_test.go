@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+)
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		matched bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "any/key", true},
+		{"user:*", "user:1", true},
+		{"user:*", "session:1", false},
+		{"user:*:name", "user:12:name", true},
+		{"user:*:name", "user:12:email", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h?llo", "héllo", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[!e]llo", "hello", false},
+		{"key-[0-9]", "key-7", true},
+		{"key-[0-9]", "key-x", false},
+		{"[]]", "]", true},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{"a*b*c", "aXbXbXc", true},
+		{"a*b*c", "aXbXbX", false},
+	}
+
+	for _, c := range cases {
+		matched, err := matchGlob(c.pattern, c.key)
+		if err != nil {
+			t.Errorf("matchGlob(%q, %q) failed. Got err = %s", c.pattern, c.key, err)
+		}
+		if matched != c.matched {
+			t.Errorf("matchGlob(%q, %q) = %v. Expected %v", c.pattern, c.key, matched, c.matched)
+		}
+	}
+
+	for _, pattern := range []string{"[", "abc[", `abc\`, "[a-"} {
+		if _, err := matchGlob(pattern, ""); err == nil {
+			t.Errorf("Expected %q to be rejected as malformed", pattern)
+		}
+	}
+}
+
+func TestScanPagesThroughMatchingKeys(t *testing.T) {
+	server, _ := newTestServer(t)
+	for _, key := range []string{"user:1", "user:2", "user:3", "session:1", "session:2"} {
+		server.StorageBackend.Set(key, []byte("value"), 1)
+	}
+
+	var found []string
+	command := commands.Command{Identifier: commands.SCAN_COMMAND, Value: []byte("user:*"), Limit: 2}
+	for {
+		response := server.executeScan(command)
+		if response.ErrorCode != commands.NO_ERROR_ERROR_CODE {
+			t.Fatalf("Expected SCAN to succeed. Got %+v", response)
+		}
+		batch := decodeList(t, response.Message)
+		found = append(found, batch[1:]...)
+		if batch[0] == "" {
+			break
+		}
+		command.Key = batch[0]
+	}
+
+	slices.Sort(found)
+	if !slices.Equal(found, []string{"user:1", "user:2", "user:3"}) {
+		t.Errorf("Expected SCAN to find every user key once. Got %q", found)
+	}
+
+	response := server.executeScan(commands.Command{Identifier: commands.SCAN_COMMAND, Value: []byte("user:[")})
+	if response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected a malformed pattern to be a user error. Got %+v", response)
+	}
+	response = server.executeScan(commands.Command{Identifier: commands.SCAN_COMMAND, Key: "bad"})
+	if response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected a made up cursor to be a user error. Got %+v", response)
+	}
+}
@@ -2,9 +2,14 @@ package internal
 
 import (
 	"bufio"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"sync"
+	"time"
 
 	"github.com/willcruse/kvdb/server/v2/internal/commands"
 	listener "github.com/willcruse/kvdb/server/v2/internal/listener"
@@ -14,45 +19,75 @@ import (
 
 const (
 	CONNECTION_CHANNEL_BUFFER_SIZE = 128
+	DEFAULT_MAX_MESSAGE_SIZE       = 64 * 1024 * 1024 // 64 MiB
 )
 
 type Server struct {
 	Listener       listener.Listener
 	StorageBackend storagebackend.StorageBackend
 	WriteLogger    writelogger.WriteOperationLogger
+	// Max combined size in bytes of the key and value of a single request
+	// Defaults to DEFAULT_MAX_MESSAGE_SIZE if not set
+	MaxMessageSize int
+	// Where snapshots are written and loaded from. Snapshots are disabled if not set
+	SnapshotPath string
+	// How often to snapshot while serving. Only on demand via BGSAVE if not set
+	SnapshotInterval time.Duration
+	// How often expired keys are cleared out of the StorageBackend
+	// Defaults to storagebackend.DEFAULT_EXPIRY_SWEEP_INTERVAL if not set
+	ExpirySweepInterval time.Duration
+	// Directory BACKUP writes backups into, each in a directory named by the client
+	// Backups can only be streamed back to the client if not set
+	BackupDir string
+
+	// Held for the whole of logging and applying a write. See commit
+	commitLock sync.Mutex
+	// Watches on each watched key. See watch
+	watchLock sync.RWMutex
+	watchers  map[string]map[*watch]struct{}
+	// Held while a snapshot is being taken
+	snapshotLock sync.Mutex
 }
 
 func (server *Server) Init() error {
+	if server.MaxMessageSize <= 0 {
+		server.MaxMessageSize = DEFAULT_MAX_MESSAGE_SIZE
+	}
+	if server.ExpirySweepInterval <= 0 {
+		server.ExpirySweepInterval = storagebackend.DEFAULT_EXPIRY_SWEEP_INTERVAL
+	}
+
 	server.StorageBackend.Init()
-	err := server.WriteLogger.Init()
+	snapshotSeq, err := server.loadSnapshot()
+	if err != nil {
+		return err
+	}
+
+	err = server.WriteLogger.Init()
 	if err != nil {
 		err = fmt.Errorf("(Server) Failed to init WriteLogger. Error: %w", err)
 		return err
 	}
 
-	commandsToReplay, err := server.WriteLogger.Replay()
+	err = server.WriteLogger.Replay(func(commandToReplay commands.Command) error {
+		// Already in the snapshot. Compaction only drops whole segments so some of these are usually left over
+		if commandToReplay.Seq <= snapshotSeq {
+			return nil
+		}
+		return server.apply(commandToReplay)
+	})
 	if err != nil {
+		server.WriteLogger.Close()
 		err = fmt.Errorf("(Server) Failed to replay WriteLogger. Error: %w", err)
 		return err
 	}
 
-	for _, commandToReplay := range commandsToReplay {
-		log.Printf("Command Replay: %+v\n", commandToReplay)
-		switch commandToReplay.Identifier {
-		case commands.SET_COMMAND:
-			err = server.StorageBackend.Set(commandToReplay.Key, commandToReplay.Value)
-			if err != nil {
-				err = fmt.Errorf("(Server): Failed to apply SET command. Key = %s Value = %s. Error: %w", commandToReplay.Key, commandToReplay.Value, err)
-				return err
-			}
-		case commands.DELETE_COMMAND:
-			err = server.StorageBackend.Delete(commandToReplay.Key)
-			if err != nil {
-				err = fmt.Errorf("(Server): Failed to apply DELETE command. Key = %s. Error: %w", commandToReplay.Key, err)
-				return err
-			}
-		default:
-			return fmt.Errorf("(Server) Unknown command to reply %+v", commandToReplay)
+	// The log is behind the snapshot (e.g. it was deleted) so new records would reuse sequence numbers the snapshot already covers
+	if server.WriteLogger.LastSeq() < snapshotSeq {
+		err = server.WriteLogger.Compact(snapshotSeq)
+		if err != nil {
+			server.WriteLogger.Close()
+			return fmt.Errorf("(Server) Failed to move write log past snapshot sequence number %d. Error: %w", snapshotSeq, err)
 		}
 	}
 
@@ -61,6 +96,13 @@ func (server *Server) Init() error {
 
 func (server *Server) Listen() error {
 	defer server.WriteLogger.Close()
+	if server.SnapshotPath != "" && server.SnapshotInterval > 0 {
+		go server.snapshotPeriodically()
+	}
+	stopSweeping := make(chan struct{})
+	defer close(stopSweeping)
+	go storagebackend.SweepExpiredPeriodically(server.StorageBackend, server.ExpirySweepInterval, stopSweeping)
+
 	connChan := make(chan listener.Readable, CONNECTION_CHANNEL_BUFFER_SIZE)
 	go server.messageReceiver(connChan)
 	err := server.Listener.Listen(connChan)
@@ -74,7 +116,6 @@ func (server *Server) Listen() error {
 
 func (server *Server) messageReceiver(connChan chan listener.Readable) {
 	for conn := range connChan {
-		// TODO: Handle concurrency issues
 		go server.handleConnection(conn)
 	}
 }
@@ -83,9 +124,19 @@ func (server *Server) handleConnection(conn listener.Readable) {
 	defer conn.Close()
 	reader := bufio.NewReader(conn)
 
+	codec, err := server.negotiate(reader, conn)
+	if err != nil {
+		log.Printf("handler_net_conn: Handshake failed. %v\n", err)
+		return
+	}
+
+	sess := newSession(conn, codec)
+	// Don't close the connection while requests are still executing
+	defer sess.wait()
+	defer server.unwatch(sess)
+
 	for {
-		response := commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE, Message: ""}
-		commandValue, err := reader.ReadByte()
+		request, err := codec.ReadRequest(reader, server.MaxMessageSize)
 
 		if err == io.EOF {
 			log.Println("handler_net_conn: Connection closed")
@@ -93,118 +144,215 @@ func (server *Server) handleConnection(conn listener.Readable) {
 		}
 
 		if err != nil {
-			log.Printf("handler_net_conn: Failed to read command value from stream. %v\n", err)
-			response.ErrorCode = commands.SERVER_ERROR_ERROR_CODE
+			log.Printf("handler_net_conn: Failed to read request from stream. %v\n", err)
+			server.rejectOversizedMessage(err, sess, request.ID)
 			break
 		}
 
-		commandValueInt := int(commandValue)
-		key, err := readString(reader)
-		if err != nil {
-			log.Printf("handler_net_conn: Error reading key from stream %v\n", err)
-			response.ErrorCode = commands.SERVER_ERROR_ERROR_CODE
-			break
+		// Transactions are run in the read loop so commands are queued in the order they were sent
+		if response, handled := server.executeInSession(sess, request.Command); handled {
+			sess.respond(request.ID, response)
+			continue
 		}
 
-		fmt.Printf("Command Value: %d\n", commandValueInt)
-
-		switch commandValueInt {
-		case commands.GET_COMMAND:
-			fmt.Printf("Fetching %s\n", key)
-			res, err := server.StorageBackend.Get(key)
-			if err != nil {
-				log.Printf("handler_net_conn: Error fetching from storage backend %v\n", err)
-				response.ErrorCode = commands.SERVER_ERROR_ERROR_CODE
-				break
-			}
-			fmt.Printf("Fetched %s -> %s\n", key, res)
-			response.Message = res
-
-		case commands.SET_COMMAND:
-			value, err := readString(reader)
-			if err != nil {
-				log.Printf("handler_net_conn: Error reading value from stream %v\n", err)
-				response.ErrorCode = commands.SERVER_ERROR_ERROR_CODE
-				break
-			}
-			fmt.Printf("Setting %s to %s\n", key, value)
-			err = server.StorageBackend.Set(key, value)
-			if err != nil {
-				log.Printf("handler_net_conn: Error setting value %v\n", err)
-				response.ErrorCode = commands.SERVER_ERROR_ERROR_CODE
-				break
-			}
-
-			err = server.WriteLogger.LogSet(key, value)
-			if err != nil {
-				log.Printf("handler_net_conn: Error logging operation %v\n", err)
-				response.ErrorCode = commands.SERVER_ERROR_ERROR_CODE
-				break
-			}
-			fmt.Printf("Set %s -> %s\n", key, value)
-
-		case commands.DELETE_COMMAND:
-			fmt.Printf("Deleting %s\n", key)
-			err = server.StorageBackend.Delete(key)
-			if err != nil {
-				log.Printf("handler_net_conn: Error deleting value %v\n", err)
-				response.ErrorCode = commands.SERVER_ERROR_ERROR_CODE
-				break
-			}
-			err = server.WriteLogger.LogDelete(key)
-			if err != nil {
-				log.Printf("handler_net_conn: Error logging operation %v\n", err)
-				response.ErrorCode = commands.SERVER_ERROR_ERROR_CODE
-				break
-			}
-			fmt.Printf("Delete %s\n", key)
-
-		default:
-			response.ErrorCode = commands.USER_ERROR_ERROR_CODE
-		}
-
-		err = sendResponse(response, conn)
-		if err != nil {
-			log.Printf("handler_net_conn: Error sending response %v\n", err)
+		// Clients without request ids can only match responses by order so run their requests one at a time
+		if !codec.HasRequestIDs() {
+			server.respondTo(sess, request)
+			continue
 		}
+
+		sess.goExecute(request.Command, func() {
+			server.respondTo(sess, request)
+		})
 	}
 
 }
 
-func readString(reader *bufio.Reader) (string, error) {
-	keyLength, err := reader.ReadByte()
-	if err != nil {
-		err = fmt.Errorf("handler_net_conn: Failed to read length from stream. %w", err)
-		return "", err
+// Streamed responses are sent as they're produced. Everything else sends the single response from execute
+func (server *Server) respondTo(sess *session, request commands.Request) {
+	if request.Command.Identifier == commands.BACKUP_COMMAND && request.Command.Key == "" {
+		server.streamBackup(sess, request.ID)
+		return
 	}
+	sess.respond(request.ID, server.execute(request.Command))
+}
 
-	keyBuf := make([]byte, int(keyLength))
-	nRead, err := io.ReadFull(reader, keyBuf)
-	if err != nil {
-		err = fmt.Errorf("handler_net_conn: Failed to read value from stream. %w", err)
-		return "", err
-	}
-	if nRead != int(keyLength) {
-		err = fmt.Errorf("handler_net_conn: Incorrect number of bytes read from stream")
-		return "", err
+func (server *Server) execute(command commands.Command) commands.Response {
+	response := commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE, Message: nil}
+	key := command.Key
+
+	fmt.Printf("Command Value: %d\n", command.Identifier)
+
+	switch command.Identifier {
+	case commands.GET_COMMAND:
+		fmt.Printf("Fetching %s\n", key)
+		entry, err := server.StorageBackend.GetEntry(key)
+		if errors.Is(err, storagebackend.ErrKeyNotFound) {
+			return commands.ErrorResponse(commands.NOT_FOUND_ERROR_CODE, "no such key %s", key)
+		}
+		if err != nil {
+			log.Printf("handler_net_conn: Error fetching from storage backend %v\n", err)
+			return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to fetch %s", key)
+		}
+		response.Message = entry.Value
+		if command.WithVersion {
+			response.Message = append(binary.BigEndian.AppendUint64(nil, entry.Version), entry.Value...)
+		}
+
+	case commands.SET_COMMAND:
+		value := command.Value
+		fmt.Printf("Setting %s to %q\n", key, value)
+		resolved, err := server.commitResolved(command)
+		if errors.Is(err, storagebackend.ErrConditionFailed) {
+			return commands.ErrorResponse(commands.CONDITION_FAILED_ERROR_CODE, "%s isn't at version %d", key, command.ExpectedVersion)
+		}
+		if err != nil {
+			log.Printf("handler_net_conn: Error setting value %v\n", err)
+			return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to set %s", key)
+		}
+		if command.WithVersion {
+			response.Message = binary.BigEndian.AppendUint64(nil, resolved.Seq)
+		}
+
+	case commands.DELETE_COMMAND:
+		fmt.Printf("Deleting %s\n", key)
+		err := server.commit(command)
+		if errors.Is(err, storagebackend.ErrConditionFailed) {
+			return commands.ErrorResponse(commands.CONDITION_FAILED_ERROR_CODE, "%s isn't at version %d", key, command.ExpectedVersion)
+		}
+		if err != nil {
+			log.Printf("handler_net_conn: Error deleting value %v\n", err)
+			return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to delete %s", key)
+		}
+		fmt.Printf("Delete %s\n", key)
+
+	case commands.SETEX_COMMAND:
+		expiresAt, err := expiryFromTTL(command.TTLMillis)
+		if err != nil {
+			return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "%v", err)
+		}
+		command.ExpiresAt = expiresAt
+		err = server.commit(command)
+		if err != nil {
+			log.Printf("handler_net_conn: Error setting value %v\n", err)
+			return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to set %s", key)
+		}
+
+	case commands.EXPIRE_COMMAND:
+		expiresAt, err := expiryFromTTL(command.TTLMillis)
+		if err != nil {
+			return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "%v", err)
+		}
+		command.ExpiresAt = expiresAt
+		err = server.commit(command)
+		if errors.Is(err, storagebackend.ErrKeyNotFound) {
+			return commands.ErrorResponse(commands.NOT_FOUND_ERROR_CODE, "no such key %s", key)
+		}
+		if err != nil {
+			log.Printf("handler_net_conn: Error setting expiry %v\n", err)
+			return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to expire %s", key)
+		}
+
+	case commands.PERSIST_COMMAND:
+		err := server.commit(command)
+		if errors.Is(err, storagebackend.ErrKeyNotFound) {
+			return commands.ErrorResponse(commands.NOT_FOUND_ERROR_CODE, "no such key %s", key)
+		}
+		if err != nil {
+			log.Printf("handler_net_conn: Error removing expiry %v\n", err)
+			return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to persist %s", key)
+		}
+
+	case commands.TTL_COMMAND:
+		expiresAt, err := server.StorageBackend.Expiry(key)
+		if errors.Is(err, storagebackend.ErrKeyNotFound) {
+			return commands.ErrorResponse(commands.NOT_FOUND_ERROR_CODE, "no such key %s", key)
+		}
+		if err != nil {
+			log.Printf("handler_net_conn: Error fetching expiry %v\n", err)
+			return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to fetch TTL of %s", key)
+		}
+		ttl := int64(commands.NO_EXPIRY_TTL)
+		if expiresAt != 0 {
+			ttl = max(expiresAt-time.Now().UnixMilli(), 0)
+		}
+		response.Message = binary.BigEndian.AppendUint64(nil, uint64(ttl))
+
+	case commands.RANGE_COMMAND:
+		return server.executeRange(command)
+
+	case commands.SCAN_COMMAND:
+		return server.executeScan(command)
+
+	case commands.SNAPSHOT_COMMAND:
+		return server.executeSnapshot()
+
+	case commands.GET_AT_COMMAND:
+		return server.executeGetAt(command)
+
+	case commands.SCAN_AT_COMMAND:
+		return server.executeScanAt(command)
+
+	case commands.HISTORY_COMMAND:
+		return server.executeHistory(command)
+
+	case commands.GET_AS_OF_COMMAND:
+		return server.executeGetAsOf(command)
+
+	case commands.MGET_COMMAND, commands.MSET_COMMAND, commands.MDEL_COMMAND:
+		return server.executeMultiKey(command)
+
+	case commands.INCR_COMMAND, commands.DECR_COMMAND, commands.INCRBY_COMMAND:
+		return server.executeIncrement(command)
+
+	case commands.SETNX_COMMAND, commands.SETXX_COMMAND, commands.CAS_COMMAND:
+		return server.executeConditional(command)
+
+	case commands.BGSAVE_COMMAND:
+		err := server.backgroundSnapshot()
+		if errors.Is(err, errSnapshotInProgress) {
+			return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "%v", err)
+		}
+		if err != nil {
+			log.Printf("handler_net_conn: Error starting snapshot %v\n", err)
+			return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to start snapshot")
+		}
+		response.Message = []byte("Background snapshot started")
+
+	case commands.BACKUP_COMMAND:
+		return server.executeBackup(command)
+
+	case commands.HELLO_COMMAND:
+		// The version is fixed for the lifetime of the connection
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "HELLO is only valid as the first message on a connection")
+
+	default:
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "unknown command %d", command.Identifier)
 	}
 
-	return string(keyBuf), nil
+	return response
 }
 
-func sendResponse(response commands.Response, conn listener.Readable) error {
-	encoded, err := response.Encode()
-	if err != nil {
-		err = fmt.Errorf("(Server) Failed to encode response. Error: %w", err)
-		return err
+// The rest of an oversized message is never read so the stream can't be resynchronised
+// Let the client know why before the connection is closed
+// The request id is read before any lengths so the client can still match this up
+func (server *Server) rejectOversizedMessage(err error, sess *session, requestID uint32) {
+	if !errors.Is(err, commands.ErrMessageTooLarge) {
+		return
 	}
 
-	log.Println("Sending response")
-	_, err = conn.Write(encoded)
-	if err != nil {
-		err = fmt.Errorf("(Server) Failed to send response. Error: %w", err)
-		return err
+	sess.respond(requestID, commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "message is larger than the max message size of %d bytes", server.MaxMessageSize))
+}
+
+// Turns a TTL sent by a client into the absolute expiry that's logged
+func expiryFromTTL(ttlMillis uint64) (int64, error) {
+	now := time.Now().UnixMilli()
+	if ttlMillis == 0 {
+		return 0, fmt.Errorf("TTL must be at least 1 millisecond")
+	}
+	if ttlMillis > uint64(math.MaxInt64-now) {
+		return 0, fmt.Errorf("TTL of %d milliseconds is too large", ttlMillis)
 	}
 
-	return nil
+	return now + int64(ttlMillis), nil
 }
@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	listener "github.com/willcruse/kvdb/server/v2/internal/listener"
+)
+
+const (
+	// Max requests from one connection executing at once
+	// Reading from the connection pauses until one finishes
+	MAX_IN_FLIGHT_REQUESTS = 128
+)
+
+// State for a single client connection
+type session struct {
+	conn  listener.Readable
+	codec *commands.Codec
+
+	// Responses from concurrently executing requests must not interleave on the connection
+	writeLock sync.Mutex
+	inFlight  sync.WaitGroup
+	slots     chan struct{}
+	// Requests started with goExecute that haven't finished, by the keys they touch. See order
+	orderLock sync.Mutex
+	keys      map[string]*keyOrder
+	// Requests that read every key e.g. SCAN
+	scans []chan struct{}
+
+	// Open between MULTI and EXEC or DISCARD. Only used by the connection's read loop
+	transaction *transaction
+	// Keys watched since the last EXEC, DISCARD or UNWATCH. Only used by the connection's read loop
+	watch *watch
+}
+
+func newSession(conn listener.Readable, codec *commands.Codec) *session {
+	return &session{
+		conn:  conn,
+		codec: codec,
+		slots: make(chan struct{}, MAX_IN_FLIGHT_REQUESTS),
+		keys:  make(map[string]*keyOrder),
+	}
+}
+
+// Requests on one key that haven't finished. Each is closed as its request finishes
+type keyOrder struct {
+	write chan struct{}
+	// Reads sent since write
+	reads []chan struct{}
+}
+
+// Runs fn in the background for command once there is a free slot and the requests it has to follow have finished. See order
+func (sess *session) goExecute(command commands.Command, fn func()) {
+	sess.slots <- struct{}{}
+	sess.inFlight.Add(1)
+	follows, finished := sess.order(command)
+	go func() {
+		defer func() {
+			finished()
+			<-sess.slots
+			sess.inFlight.Done()
+		}()
+		for _, earlier := range follows {
+			<-earlier
+		}
+		fn()
+	}()
+}
+
+// Returns the requests command has to wait for so requests on the same key are applied in the order they were sent,
+// and a func to call once it's finished
+//
+// Writes follow every earlier request on their keys and reads follow the last earlier write, so reads of a key
+// still run alongside each other. Requests that read every key follow every earlier write and writes follow them.
+// Only called from the connection's read loop so requests are ordered as they were read
+func (sess *session) order(command commands.Command) ([]chan struct{}, func()) {
+	done := make(chan struct{})
+	keys := touchedKeys(command)
+	write := isWrite(command.Identifier)
+	var follows []chan struct{}
+
+	sess.orderLock.Lock()
+	defer sess.orderLock.Unlock()
+	if keys == nil {
+		for _, order := range sess.keys {
+			if order.write != nil {
+				follows = append(follows, order.write)
+			}
+		}
+		sess.scans = append(sess.scans, done)
+	}
+	if write {
+		follows = append(follows, sess.scans...)
+	}
+	for _, key := range keys {
+		order, ok := sess.keys[key]
+		if !ok {
+			order = &keyOrder{}
+			sess.keys[key] = order
+		}
+		// The same key can be listed more than once
+		if order.write != nil && order.write != done {
+			follows = append(follows, order.write)
+		}
+		if write {
+			follows = append(follows, order.reads...)
+			order.write = done
+			order.reads = nil
+		} else {
+			order.reads = append(order.reads, done)
+		}
+	}
+
+	return follows, func() {
+		sess.orderLock.Lock()
+		defer sess.orderLock.Unlock()
+		close(done)
+		isDone := func(c chan struct{}) bool { return c == done }
+		sess.scans = slices.DeleteFunc(sess.scans, isDone)
+		for _, key := range keys {
+			order, ok := sess.keys[key]
+			if !ok {
+				continue
+			}
+			if order.write == done {
+				order.write = nil
+			}
+			order.reads = slices.DeleteFunc(order.reads, isDone)
+			if order.write == nil && len(order.reads) == 0 {
+				delete(sess.keys, key)
+			}
+		}
+	}
+}
+
+// Keys a request reads or writes. nil if it reads every key
+func touchedKeys(command commands.Command) []string {
+	switch command.Identifier {
+	case commands.SCAN_COMMAND, commands.RANGE_COMMAND, commands.SCAN_AT_COMMAND, commands.SNAPSHOT_COMMAND, commands.BGSAVE_COMMAND, commands.BACKUP_COMMAND:
+		return nil
+	}
+	if commands.IsMultiKey(command.Identifier) {
+		return command.Keys
+	}
+	return []string{command.Key}
+}
+
+func isWrite(identifier int) bool {
+	switch identifier {
+	case commands.SET_COMMAND, commands.DELETE_COMMAND, commands.SETEX_COMMAND, commands.EXPIRE_COMMAND, commands.PERSIST_COMMAND,
+		commands.MSET_COMMAND, commands.MDEL_COMMAND, commands.INCR_COMMAND, commands.DECR_COMMAND, commands.INCRBY_COMMAND,
+		commands.SETNX_COMMAND, commands.SETXX_COMMAND, commands.CAS_COMMAND:
+		return true
+	}
+	return false
+}
+
+// Waits for every request started with goExecute to finish
+func (sess *session) wait() {
+	sess.inFlight.Wait()
+}
+
+func (sess *session) respond(requestID uint32, response commands.Response) {
+	response.RequestID = requestID
+	err := sess.send(response)
+	if err != nil {
+		log.Printf("handler_net_conn: Error sending response %v\n", err)
+	}
+}
+
+// Sends a USER_ERROR in place of a response too big for the connection's protocol version so the client isn't left waiting
+func (sess *session) send(response commands.Response) error {
+	encoded, err := sess.codec.EncodeResponse(response)
+	if errors.Is(err, commands.ErrMessageTooLarge) {
+		tooLarge := commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "response of %d bytes is too large for protocol version %d", len(response.Message), sess.codec.Version)
+		tooLarge.RequestID = response.RequestID
+		encoded, err = sess.codec.EncodeResponse(tooLarge)
+	}
+	if err != nil {
+		err = fmt.Errorf("(Server) Failed to encode response. Error: %w", err)
+		return err
+	}
+
+	sess.writeLock.Lock()
+	defer sess.writeLock.Unlock()
+
+	log.Println("Sending response")
+	_, err = sess.conn.Write(encoded)
+	if err != nil {
+		err = fmt.Errorf("(Server) Failed to send response. Error: %w", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+)
+
+// Collects every response sent to it
+type recordingConn struct {
+	bytes.Buffer
+}
+
+func (rc *recordingConn) Close() error {
+	return nil
+}
+
+func TestVersion1ClientGetsErrorForResponseTooLargeToEncode(t *testing.T) {
+	server, _ := newTestServer(t)
+	server.execute(commands.CreateSetCommand("key", bytes.Repeat([]byte("v"), 300)))
+
+	conn := &recordingConn{}
+	sess := newSession(conn, &commands.Codec{Version: commands.PROTOCOL_VERSION_1})
+	sess.respond(0, server.execute(commands.Command{Identifier: commands.GET_COMMAND, Key: "key"}))
+
+	reply := conn.Bytes()
+	if len(reply) < 2 || reply[0] != commands.USER_ERROR_ERROR_CODE || int(reply[1]) != len(reply)-2 {
+		t.Errorf("Expected a USER_ERROR framed for version 1. Got %v", reply)
+	}
+}
+
+func expectFollows(t *testing.T, follows []chan struct{}, expected ...chan struct{}) {
+	t.Helper()
+	if len(follows) != len(expected) {
+		t.Fatalf("Expected to follow %d requests. Got %d", len(expected), len(follows))
+	}
+	for i := range expected {
+		if follows[i] != expected[i] {
+			t.Errorf("Expected to follow request %d", i)
+		}
+	}
+}
+
+func TestRequestsOnSameKeyFollowEarlierWrites(t *testing.T) {
+	sess := newSession(nil, nil)
+
+	follows, setDone := sess.order(commands.CreateSetCommand("key", []byte("1")))
+	expectFollows(t, follows)
+	set := sess.keys["key"].write
+
+	firstGet, firstGetDone := sess.order(commands.CreateGetCommand("key"))
+	secondGet, secondGetDone := sess.order(commands.CreateGetCommand("key"))
+	expectFollows(t, firstGet, set)
+	expectFollows(t, secondGet, set)
+	reads := append([]chan struct{}{}, sess.keys["key"].reads...)
+
+	other, otherDone := sess.order(commands.CreateSetCommand("other", []byte("1")))
+	expectFollows(t, other)
+
+	nextSet, nextSetDone := sess.order(commands.CreateSetCommand("key", []byte("2")))
+	expectFollows(t, nextSet, set, reads[0], reads[1])
+
+	for _, done := range []func(){setDone, firstGetDone, secondGetDone, otherDone, nextSetDone} {
+		done()
+	}
+	if len(sess.keys) != 0 || len(sess.scans) != 0 {
+		t.Errorf("Expected finished requests to be forgotten. Got %d keys and %d scans", len(sess.keys), len(sess.scans))
+	}
+}
+
+func TestScansFollowWritesToAnyKey(t *testing.T) {
+	sess := newSession(nil, nil)
+
+	_, setDone := sess.order(commands.CreateSetCommand("key", []byte("1")))
+	set := sess.keys["key"].write
+	scan, scanDone := sess.order(commands.Command{Identifier: commands.SCAN_COMMAND})
+	expectFollows(t, scan, set)
+	scanFinished := sess.scans[0]
+
+	nextSet, nextSetDone := sess.order(commands.CreateSetCommand("other", []byte("2")))
+	expectFollows(t, nextSet, scanFinished)
+
+	setDone()
+	scanDone()
+	nextSetDone()
+	if len(sess.keys) != 0 || len(sess.scans) != 0 {
+		t.Errorf("Expected finished requests to be forgotten. Got %d keys and %d scans", len(sess.keys), len(sess.scans))
+	}
+}
+
+// Encodes a version 3 request with a key and optionally a value
+func encodeRequest(requestID uint32, identifier uint8, key string, value []byte) []byte {
+	encoded := binary.BigEndian.AppendUint32(nil, requestID)
+	encoded = append(encoded, identifier)
+	encoded = binary.BigEndian.AppendUint32(encoded, uint32(len(key)))
+	encoded = append(encoded, key...)
+	if value != nil {
+		encoded = binary.BigEndian.AppendUint32(encoded, uint32(len(value)))
+		encoded = append(encoded, value...)
+	}
+	return encoded
+}
+
+func TestPipelinedRequestsOnSameKeyApplyInOrder(t *testing.T) {
+	server, _ := newTestServer(t)
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go server.handleConnection(serverConn)
+
+	const writes = 200
+	var requests []byte
+	requests = append(requests, commands.HELLO_COMMAND, commands.PROTOCOL_VERSION_3)
+	for i := range writes {
+		requests = append(requests, encodeRequest(uint32(i), commands.SET_COMMAND, "key", fmt.Appendf(nil, "%d", i))...)
+	}
+	requests = append(requests, encodeRequest(writes, commands.GET_COMMAND, "key", nil)...)
+	go clientConn.Write(requests)
+
+	reader := bufio.NewReader(clientConn)
+	hello := make([]byte, 3)
+	io.ReadFull(reader, hello)
+	reader.Discard(int(hello[2]))
+	featureCount, _ := reader.ReadByte()
+	for range featureCount {
+		length, _ := reader.ReadByte()
+		reader.Discard(int(length))
+	}
+
+	for range writes + 1 {
+		header := make([]byte, commands.REQUEST_ID_SIZE+1+commands.LENGTH_PREFIX_SIZE)
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			t.Fatalf("Failed to read response. Got err = %s", err)
+		}
+		message := make([]byte, binary.BigEndian.Uint32(header[commands.REQUEST_ID_SIZE+1:]))
+		io.ReadFull(reader, message)
+		if binary.BigEndian.Uint32(header) == writes && string(message) != fmt.Sprint(writes-1) {
+			t.Errorf("Expected GET to see the last SET sent before it. Got %q", message)
+		}
+	}
+	stored, _ := server.StorageBackend.Get("key")
+	if string(stored) != fmt.Sprint(writes-1) {
+		t.Errorf("Expected the last SET sent to win. Got %q", stored)
+	}
+}
@@ -0,0 +1,268 @@
+package snapshot
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	writelogger "github.com/willcruse/kvdb/server/v2/internal/write-logger"
+)
+
+// A point in time copy of every key in the StorageBackend
+//
+// Layout on disk:
+//
+// Header
+// | Magic "KVSS" (4) | Format Version (2) | Reserved (2) | Sequence Number (8) | Entry Count (8) | Taken At (8) |
+//
+// Followed by Entry Count entries
+// | Key Length (4) | Key (n) | Value Length (4) | Value (n) | Expires At (8) | Version (8) |
+//
+// Expires At is Unix milliseconds or 0 for keys that never expire. Version 1 snapshots have no expiry field.
+// Version is the key's version. Version 1 and 2 snapshots have no version field so their keys are given
+// the snapshot's sequence number, which is at least as new as whatever last wrote them.
+//
+// Followed by a trailer
+// | CRC32C of everything before the trailer (4) |
+//
+// All integers are big endian. The sequence number is the last write log record included in the snapshot.
+// Taken At is when the snapshot was taken in Unix milliseconds. Version 1 to 3 snapshots have no Taken At.
+const (
+	SNAPSHOT_MAGIC          = "KVSS"
+	SNAPSHOT_FORMAT_VERSION = 4
+
+	snapshotHeaderSize = 32
+	// Size of the header of snapshots from before Taken At was added
+	untimedHeaderSize = 24
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrCorruptSnapshot = errors.New("snapshot is corrupt")
+
+// What a snapshot covers
+type Header struct {
+	// Last write log record included
+	Seq uint64
+	// Unix milliseconds the snapshot was taken. Records it includes were logged before this and later records after it
+	// 0 if the snapshot was written before this was recorded
+	TakenAt int64
+}
+
+type Entry struct {
+	Key       string
+	Value     []byte
+	ExpiresAt int64
+	Version   uint64
+}
+
+// Atomically replaces the snapshot at path
+// The snapshot is written to a temporary file and fsynced before being renamed into place
+// so a crash never leaves a partial snapshot behind
+func Write(path string, header Header, entries []Entry) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("(Snapshot) Failed to create %s. Error: %w", tmpPath, err)
+	}
+	defer os.Remove(tmpPath)
+
+	err = writeEntries(file, header, entries)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("(Snapshot) Failed to write %s. Error: %w", tmpPath, err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("(Snapshot) Failed to move snapshot into place at %s. Error: %w", path, err)
+	}
+	writelogger.SyncDir(filepath.Dir(path))
+
+	return nil
+}
+
+func writeEntries(file io.Writer, header Header, entries []Entry) error {
+	checksum := crc32.New(castagnoliTable)
+	writer := bufio.NewWriter(io.MultiWriter(file, checksum))
+
+	encodedHeader := make([]byte, 0, snapshotHeaderSize)
+	encodedHeader = append(encodedHeader, SNAPSHOT_MAGIC...)
+	encodedHeader = binary.BigEndian.AppendUint16(encodedHeader, SNAPSHOT_FORMAT_VERSION)
+	encodedHeader = binary.BigEndian.AppendUint16(encodedHeader, 0)
+	encodedHeader = binary.BigEndian.AppendUint64(encodedHeader, header.Seq)
+	encodedHeader = binary.BigEndian.AppendUint64(encodedHeader, uint64(len(entries)))
+	encodedHeader = binary.BigEndian.AppendUint64(encodedHeader, uint64(header.TakenAt))
+	writer.Write(encodedHeader)
+
+	lengthBuf := make([]byte, 4)
+	for _, entry := range entries {
+		binary.BigEndian.PutUint32(lengthBuf, uint32(len(entry.Key)))
+		writer.Write(lengthBuf)
+		writer.WriteString(entry.Key)
+		binary.BigEndian.PutUint32(lengthBuf, uint32(len(entry.Value)))
+		writer.Write(lengthBuf)
+		writer.Write(entry.Value)
+		writer.Write(binary.BigEndian.AppendUint64(nil, uint64(entry.ExpiresAt)))
+		writer.Write(binary.BigEndian.AppendUint64(nil, entry.Version))
+	}
+
+	// Any write error is sticky and comes back from Flush
+	err := writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(checksum.Sum(nil))
+	return err
+}
+
+// Reads only the header of the snapshot at path. The rest of the snapshot isn't checked
+// Returns an error wrapping os.ErrNotExist if there is no snapshot
+func ReadHeader(path string) (Header, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Header{}, fmt.Errorf("(Snapshot) Failed to open %s. Error: %w", path, err)
+	}
+	defer file.Close()
+
+	header, _, _, err := readHeader(bufio.NewReader(file), path)
+	return header, err
+}
+
+// Returns the header along with the format version and entry count
+func readHeader(reader io.Reader, path string) (Header, uint16, uint64, error) {
+	encoded := make([]byte, untimedHeaderSize, snapshotHeaderSize)
+	_, err := io.ReadFull(reader, encoded)
+	if err != nil {
+		return Header{}, 0, 0, fmt.Errorf("(Snapshot) Failed to read header of %s. Error: %w", path, ErrCorruptSnapshot)
+	}
+	if string(encoded[:4]) != SNAPSHOT_MAGIC {
+		return Header{}, 0, 0, fmt.Errorf("(Snapshot) %s is not a snapshot. Error: %w", path, ErrCorruptSnapshot)
+	}
+	version := binary.BigEndian.Uint16(encoded[4:])
+	if version < 1 || version > SNAPSHOT_FORMAT_VERSION {
+		return Header{}, 0, 0, fmt.Errorf("(Snapshot) %s has unsupported format version %d", path, version)
+	}
+
+	header := Header{Seq: binary.BigEndian.Uint64(encoded[8:])}
+	count := binary.BigEndian.Uint64(encoded[16:])
+	if version >= 4 {
+		encoded = encoded[:snapshotHeaderSize]
+		_, err = io.ReadFull(reader, encoded[untimedHeaderSize:])
+		if err != nil {
+			return Header{}, 0, 0, fmt.Errorf("(Snapshot) Failed to read header of %s. Error: %w", path, ErrCorruptSnapshot)
+		}
+		header.TakenAt = int64(binary.BigEndian.Uint64(encoded[untimedHeaderSize:]))
+	}
+	return header, version, count, nil
+}
+
+// Streams the snapshot at path into fn and returns its header
+// Returns an error wrapping os.ErrNotExist if there is no snapshot
+// The checksum can only be checked once every entry has been read so fn may see entries from a snapshot that then fails with ErrCorruptSnapshot
+func Read(path string, fn func(entry Entry) error) (Header, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Header{}, fmt.Errorf("(Snapshot) Failed to open %s. Error: %w", path, err)
+	}
+	defer file.Close()
+
+	checksum := crc32.New(castagnoliTable)
+	reader := io.TeeReader(bufio.NewReader(file), checksum)
+
+	header, version, count, err := readHeader(reader, path)
+	if err != nil {
+		return Header{}, err
+	}
+
+	for i := uint64(0); i < count; i++ {
+		key, err := readLengthPrefixed(reader)
+		if err != nil {
+			return Header{}, fmt.Errorf("(Snapshot) Failed to read key of entry %d in %s. Error: %w", i, path, err)
+		}
+		value, err := readLengthPrefixed(reader)
+		if err != nil {
+			return Header{}, fmt.Errorf("(Snapshot) Failed to read value of entry %d in %s. Error: %w", i, path, err)
+		}
+
+		var expiresAt int64
+		if version >= 2 {
+			expiryBuf := make([]byte, 8)
+			_, err = io.ReadFull(reader, expiryBuf)
+			if err != nil {
+				return Header{}, fmt.Errorf("(Snapshot) Failed to read expiry of entry %d in %s. Error: %w", i, path, ErrCorruptSnapshot)
+			}
+			expiresAt = int64(binary.BigEndian.Uint64(expiryBuf))
+		}
+
+		keyVersion := header.Seq
+		if version >= 3 {
+			versionBuf := make([]byte, 8)
+			_, err = io.ReadFull(reader, versionBuf)
+			if err != nil {
+				return Header{}, fmt.Errorf("(Snapshot) Failed to read version of entry %d in %s. Error: %w", i, path, ErrCorruptSnapshot)
+			}
+			keyVersion = binary.BigEndian.Uint64(versionBuf)
+		}
+
+		err = fn(Entry{Key: string(key), Value: value, ExpiresAt: expiresAt, Version: keyVersion})
+		if err != nil {
+			return Header{}, err
+		}
+	}
+
+	err = verifyChecksum(reader, checksum)
+	if err != nil {
+		return Header{}, fmt.Errorf("(Snapshot) Failed to verify %s. Error: %w", path, err)
+	}
+
+	return header, nil
+}
+
+func verifyChecksum(reader io.Reader, checksum hash.Hash32) error {
+	expected := checksum.Sum32()
+	trailer := make([]byte, 4)
+	_, err := io.ReadFull(reader, trailer)
+	if err != nil {
+		return fmt.Errorf("missing checksum. Error: %w", ErrCorruptSnapshot)
+	}
+	if binary.BigEndian.Uint32(trailer) != expected {
+		return fmt.Errorf("checksum mismatch. Error: %w", ErrCorruptSnapshot)
+	}
+
+	extra, _ := reader.Read(make([]byte, 1))
+	if extra != 0 {
+		return fmt.Errorf("unexpected data after checksum. Error: %w", ErrCorruptSnapshot)
+	}
+
+	return nil
+}
+
+func readLengthPrefixed(reader io.Reader) ([]byte, error) {
+	lengthBuf := make([]byte, 4)
+	_, err := io.ReadFull(reader, lengthBuf)
+	if err != nil {
+		return nil, ErrCorruptSnapshot
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint32(lengthBuf))
+	_, err = io.ReadFull(reader, buf)
+	if err != nil {
+		return nil, ErrCorruptSnapshot
+	}
+
+	return buf, nil
+}
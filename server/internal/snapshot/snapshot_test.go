@@ -0,0 +1,70 @@
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.snapshot")
+	entries := []Entry{
+		{Key: "key\none", Value: []byte{'v', '\n', 0x00, 0xff}, Version: 7},
+		{Key: "key two", Value: []byte{}, ExpiresAt: 1700000000123, Version: 41},
+	}
+
+	err := Write(path, Header{Seq: 42, TakenAt: 1700000000999}, entries)
+	if err != nil {
+		t.Fatalf("Failed to write snapshot. Got err = %s", err)
+	}
+
+	var read []Entry
+	header, err := Read(path, func(entry Entry) error {
+		read = append(read, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read snapshot. Got err = %s", err)
+	}
+	if header.Seq != 42 || header.TakenAt != 1700000000999 {
+		t.Errorf("Expected sequence number 42 taken at 1700000000999. Got %+v", header)
+	}
+	header, err = ReadHeader(path)
+	if err != nil || header.Seq != 42 {
+		t.Errorf("Expected to read the header on its own. Got %+v and err = %v", header, err)
+	}
+	if len(read) != len(entries) {
+		t.Fatalf("Expected %d entries. Got %+v", len(entries), read)
+	}
+	for i := range entries {
+		if read[i].Key != entries[i].Key || !bytes.Equal(read[i].Value, entries[i].Value) || read[i].ExpiresAt != entries[i].ExpiresAt || read[i].Version != entries[i].Version {
+			t.Errorf("Entry %d doesn't match what was written. Expected %+v Got %+v", i, entries[i], read[i])
+		}
+	}
+}
+
+func TestSnapshotMissing(t *testing.T) {
+	_, err := Read(filepath.Join(t.TempDir(), "kv.snapshot"), func(entry Entry) error { return nil })
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected os.ErrNotExist. Got err = %s", err)
+	}
+}
+
+func TestSnapshotRejectsCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.snapshot")
+	err := Write(path, Header{Seq: 1}, []Entry{{Key: "key", Value: []byte("value")}})
+	if err != nil {
+		t.Fatalf("Failed to write snapshot. Got err = %s", err)
+	}
+
+	contents, _ := os.ReadFile(path)
+	contents[snapshotHeaderSize+4] ^= 0xff
+	os.WriteFile(path, contents, 0644)
+
+	_, err = Read(path, func(entry Entry) error { return nil })
+	if !errors.Is(err, ErrCorruptSnapshot) {
+		t.Errorf("Expected ErrCorruptSnapshot. Got err = %s", err)
+	}
+}
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+func (server *Server) multiVersionBackend() (storagebackend.MultiVersionStorageBackend, *commands.Response) {
+	backend, ok := server.StorageBackend.(storagebackend.MultiVersionStorageBackend)
+	if !ok {
+		response := commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "snapshot reads need a multi-version storage backend. Start the server with --storage-backend mvcc")
+		return nil, &response
+	}
+	return backend, nil
+}
+
+// Opens a snapshot of every write committed so far and responds with its read timestamp
+//
+// The read timestamp is the sequence number of the last write in the write log. Taken under commitLock
+// so every write up to it has been applied and none after, including all of a transaction or none of it.
+func (server *Server) executeSnapshot() commands.Response {
+	backend, errorResponse := server.multiVersionBackend()
+	if errorResponse != nil {
+		return *errorResponse
+	}
+
+	server.commitLock.Lock()
+	readTimestamp := server.WriteLogger.LastSeq()
+	backend.OpenSnapshot(readTimestamp)
+	server.commitLock.Unlock()
+
+	return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE, Message: binary.BigEndian.AppendUint64(nil, readTimestamp)}
+}
+
+// Like GET but reads the key as it was at the snapshot
+func (server *Server) executeGetAt(command commands.Command) commands.Response {
+	backend, errorResponse := server.multiVersionBackend()
+	if errorResponse != nil {
+		return *errorResponse
+	}
+
+	entry, err := backend.GetEntryAt(command.Key, command.ReadTimestamp)
+	if errors.Is(err, storagebackend.ErrSnapshotNotFound) {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "no snapshot at %d. It may have expired", command.ReadTimestamp)
+	}
+	if errors.Is(err, storagebackend.ErrKeyNotFound) {
+		return commands.ErrorResponse(commands.NOT_FOUND_ERROR_CODE, "no such key %s at %d", command.Key, command.ReadTimestamp)
+	}
+	if err != nil {
+		log.Printf("handler_net_conn: Error fetching from storage backend %v\n", err)
+		return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to fetch %s", command.Key)
+	}
+
+	response := commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE, Message: entry.Value}
+	if command.WithVersion {
+		response.Message = append(binary.BigEndian.AppendUint64(nil, entry.Version), entry.Value...)
+	}
+	return response
+}
+
+// Like SCAN but visits keys as they were at the snapshot
+func (server *Server) executeScanAt(command commands.Command) commands.Response {
+	backend, errorResponse := server.multiVersionBackend()
+	if errorResponse != nil {
+		return *errorResponse
+	}
+
+	return server.executeScanWith(command, func(cursor []byte, count int, fn func(key string, entry storagebackend.Entry)) ([]byte, error) {
+		return backend.ScanAt(cursor, count, command.ReadTimestamp, fn)
+	})
+}
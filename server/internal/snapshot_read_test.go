@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+func TestSnapshotReadsIgnoreLaterWrites(t *testing.T) {
+	server := &Server{StorageBackend: &storagebackend.MVCCStorageBackend{}, WriteLogger: &memoryWriteLogger{}}
+	err := server.Init()
+	if err != nil {
+		t.Fatalf("Failed to init server. Got err = %s", err)
+	}
+	server.commit(commands.CreateSetCommand("a", []byte("old")))
+	server.commit(commands.CreateSetCommand("b", []byte("old")))
+
+	response := server.executeSnapshot()
+	if response.ErrorCode != commands.NO_ERROR_ERROR_CODE {
+		t.Fatalf("Expected SNAPSHOT to succeed. Got %+v", response)
+	}
+	readTimestamp := binary.BigEndian.Uint64(response.Message)
+
+	server.commit(commands.CreateSetCommand("a", []byte("new")))
+	server.commit(commands.CreateDeleteCommand("b"))
+	server.commit(commands.CreateSetCommand("c", []byte("new")))
+
+	response = server.executeGetAt(commands.Command{Identifier: commands.GET_AT_COMMAND, Key: "a", ReadTimestamp: readTimestamp})
+	if string(response.Message) != "old" {
+		t.Errorf("Expected GET_AT to see the value before the snapshot. Got %+v", response)
+	}
+	response = server.executeGetAt(commands.Command{Identifier: commands.GET_AT_COMMAND, Key: "c", ReadTimestamp: readTimestamp})
+	if response.ErrorCode != commands.NOT_FOUND_ERROR_CODE {
+		t.Errorf("Expected a key created after the snapshot not to be found. Got %+v", response)
+	}
+
+	page := decodeList(t, server.executeScanAt(commands.Command{Identifier: commands.SCAN_AT_COMMAND, ReadTimestamp: readTimestamp}).Message)
+	keys := page[1:]
+	slices.Sort(keys)
+	if page[0] != "" || !slices.Equal(keys, []string{"a", "b"}) {
+		t.Errorf("Expected SCAN_AT to find the keys as of the snapshot. Got %q", page)
+	}
+
+	response = server.executeGetAt(commands.Command{Identifier: commands.GET_AT_COMMAND, Key: "a", ReadTimestamp: readTimestamp + 1})
+	if response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected reading at a timestamp with no snapshot to be a user error. Got %+v", response)
+	}
+}
+
+func TestSnapshotNeedsMultiVersionBackend(t *testing.T) {
+	server, _ := newTestServer(t)
+	response := server.executeSnapshot()
+	if response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected SNAPSHOT on a single version backend to be a user error. Got %+v", response)
+	}
+}
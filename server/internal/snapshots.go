@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/willcruse/kvdb/server/v2/internal/snapshot"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+// Name of the snapshot in a data directory. The write log's segments and manifest sit alongside it
+const SNAPSHOT_FILE_NAME = "kv.snapshot"
+
+var errSnapshotInProgress = errors.New("a snapshot or backup is already in progress")
+
+// Loads the snapshot if there is one and returns the sequence number of the last write it includes
+func (server *Server) loadSnapshot() (uint64, error) {
+	if server.SnapshotPath == "" {
+		return 0, nil
+	}
+
+	start := time.Now()
+	count := 0
+	header, err := snapshot.Read(server.SnapshotPath, func(entry snapshot.Entry) error {
+		count++
+		return server.StorageBackend.SetWithExpiry(entry.Key, entry.Value, entry.ExpiresAt, entry.Version)
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("No snapshot found at %s. Replaying the full write log\n", server.SnapshotPath)
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("(Server) Failed to load snapshot. Error: %w", err)
+	}
+
+	log.Printf("Loaded %d keys from snapshot %s up to sequence number %d in %s\n", count, server.SnapshotPath, header.Seq, time.Since(start))
+	return header.Seq, nil
+}
+
+// Writes a snapshot then drops the write log records it covers
+//
+// Writes are paused only while the keys are copied out of the StorageBackend.
+// The copy is written to disk and the log compacted while the server carries on serving.
+// Fails with errSnapshotInProgress if another snapshot is running.
+func (server *Server) snapshot() error {
+	if !server.snapshotLock.TryLock() {
+		return errSnapshotInProgress
+	}
+	defer server.snapshotLock.Unlock()
+
+	return server.snapshotLocked()
+}
+
+// Caller must hold snapshotLock
+func (server *Server) snapshotLocked() error {
+	if server.SnapshotPath == "" {
+		return fmt.Errorf("(Server) Snapshots are disabled as no SnapshotPath is set")
+	}
+
+	start := time.Now()
+
+	// Every logged write is also applied while commitLock is held so the copy matches LastSeq exactly
+	server.commitLock.Lock()
+	seq := server.WriteLogger.LastSeq()
+	// Taken while writes are paused so every record it covers was logged at or before it
+	header := snapshot.Header{Seq: seq, TakenAt: time.Now().UnixMilli()}
+	entries := snapshotEntries(server.StorageBackend)
+	server.commitLock.Unlock()
+
+	err := snapshot.Write(server.SnapshotPath, header, entries)
+	if err != nil {
+		return fmt.Errorf("(Server) Failed to write snapshot. Error: %w", err)
+	}
+
+	err = server.WriteLogger.Compact(seq)
+	if err != nil {
+		// The snapshot is safe on disk so the extra records are only replayed and skipped on startup
+		return fmt.Errorf("(Server) Snapshot written but failed to compact write log. Error: %w", err)
+	}
+
+	log.Printf("Snapshot of %d keys up to sequence number %d written to %s in %s\n", len(entries), seq, server.SnapshotPath, time.Since(start))
+	return nil
+}
+
+// Copies every key out of the backend. The caller must stop writes to get a consistent copy
+func snapshotEntries(backend storagebackend.StorageBackend) []snapshot.Entry {
+	var entries []snapshot.Entry
+	backend.ForEach(func(key string, entry storagebackend.Entry) bool {
+		entries = append(entries, snapshot.Entry{Key: key, Value: entry.Value, ExpiresAt: entry.ExpiresAt, Version: entry.Version})
+		return true
+	})
+	return entries
+}
+
+// Starts a snapshot in the background. Used by BGSAVE
+func (server *Server) backgroundSnapshot() error {
+	if !server.snapshotLock.TryLock() {
+		return errSnapshotInProgress
+	}
+
+	go func() {
+		defer server.snapshotLock.Unlock()
+		err := server.snapshotLocked()
+		if err != nil {
+			log.Printf("Background snapshot failed. Error: %v\n", err)
+		}
+	}()
+
+	return nil
+}
+
+func (server *Server) snapshotPeriodically() {
+	ticker := time.NewTicker(server.SnapshotInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := server.snapshot()
+		if errors.Is(err, errSnapshotInProgress) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Periodic snapshot failed. Error: %v\n", err)
+		}
+	}
+}
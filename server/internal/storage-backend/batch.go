@@ -0,0 +1,101 @@
+package storagebackend
+
+import (
+	"hash/fnv"
+	"slices"
+)
+
+// One write of a batch. See StorageBackend.WriteBatch
+type BatchWrite struct {
+	Key   string
+	Value []byte
+	// Deletes the key rather than setting it to Value
+	Delete bool
+}
+
+func shardIndex(key string, shardCount int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(shardCount))
+}
+
+// The distinct shards the keys are on in shard order
+// Batches and multi key reads lock shards in this order so they can't deadlock with each other
+func shardsFor[S any](shards []S, keys []string) []S {
+	indexes := make([]int, len(keys))
+	for i, key := range keys {
+		indexes[i] = shardIndex(key, len(shards))
+	}
+	slices.Sort(indexes)
+	indexes = slices.Compact(indexes)
+
+	locked := make([]S, len(indexes))
+	for i, index := range indexes {
+		locked[i] = shards[index]
+	}
+	return locked
+}
+
+func batchKeys(writes []BatchWrite) []string {
+	keys := make([]string, len(writes))
+	for i, write := range writes {
+		keys[i] = write.Key
+	}
+	return keys
+}
+
+// Caller must hold the write lock
+func (em *entryMap) writeLocked(write BatchWrite, version uint64, now int64) {
+	if write.Delete {
+		em.deleteLocked(write.Key)
+		return
+	}
+	em.setLocked(write.Key, Entry{Value: write.Value, Version: version}, now)
+}
+
+// Caller must hold the read lock. Expired entries are left for get or the sweeper to delete
+func (em *entryMap) getLocked(key string, now int64) (Entry, bool) {
+	entry, exists := em.data[key]
+	if !exists || entry.expired(now) {
+		return Entry{}, false
+	}
+	return entry, true
+}
+
+// Locks every shard the writes touch so readers of several keys see none or all of them
+func writeBatchToShards(shards []*entryMap, writes []BatchWrite, version uint64) {
+	now := nowMillis()
+	locked := shardsFor(shards, batchKeys(writes))
+	for _, shard := range locked {
+		shard.lock.Lock()
+	}
+	defer func() {
+		for _, shard := range locked {
+			shard.lock.Unlock()
+		}
+	}()
+
+	for _, write := range writes {
+		shards[shardIndex(write.Key, len(shards))].writeLocked(write, version, now)
+	}
+}
+
+func getManyFromShards(shards []*entryMap, keys []string) ([]Entry, []bool) {
+	now := nowMillis()
+	locked := shardsFor(shards, keys)
+	for _, shard := range locked {
+		shard.lock.RLock()
+	}
+	defer func() {
+		for _, shard := range locked {
+			shard.lock.RUnlock()
+		}
+	}()
+
+	entries := make([]Entry, len(keys))
+	exists := make([]bool, len(keys))
+	for i, key := range keys {
+		entries[i], exists[i] = shards[shardIndex(key, len(shards))].getLocked(key, now)
+	}
+	return entries, exists
+}
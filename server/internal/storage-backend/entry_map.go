@@ -0,0 +1,159 @@
+package storagebackend
+
+import (
+	"sync"
+	"time"
+)
+
+// A key's value, when it expires and its version
+type Entry struct {
+	Value []byte
+	// Unix milliseconds. 0 means the key never expires
+	ExpiresAt int64
+	// Sequence number of the write that last changed the key. Goes up every time the key is written
+	// so comparing versions is a cheap way to tell whether a key has changed
+	Version uint64
+}
+
+func (entry Entry) expired(now int64) bool {
+	return entry.ExpiresAt != 0 && entry.ExpiresAt <= now
+}
+
+func nowMillis() int64 {
+	return time.Now().UnixMilli()
+}
+
+// A map of entries behind a read/write lock shared by the map backends
+//
+// Expired entries are never returned. Get deletes them as it finds them (lazy expiry)
+// and deleteExpired clears out the rest (active expiry). Keys with an expiry are also
+// tracked in expiring so sweeping doesn't have to visit keys that never expire.
+// Keys are also kept in order in keys so scan can pick up where it left off without visiting the whole map.
+type entryMap struct {
+	lock     sync.RWMutex
+	data     map[string]Entry
+	expiring map[string]struct{}
+	// Only changed when a key is added or removed, not when it's overwritten
+	keys skipList[struct{}]
+}
+
+func (em *entryMap) init() {
+	em.data = make(map[string]Entry)
+	em.expiring = make(map[string]struct{})
+	em.keys.init()
+}
+
+func (em *entryMap) get(key string) (Entry, bool) {
+	now := nowMillis()
+
+	em.lock.RLock()
+	entry, exists := em.data[key]
+	em.lock.RUnlock()
+
+	if !exists {
+		return Entry{}, false
+	}
+	if !entry.expired(now) {
+		return entry, true
+	}
+
+	em.lock.Lock()
+	defer em.lock.Unlock()
+	// It may have been replaced while the lock was released
+	current, exists := em.data[key]
+	if exists && current.expired(now) {
+		em.deleteLocked(key)
+	}
+	return Entry{}, false
+}
+
+// Setting an entry that has already expired deletes the key
+// so replaying an old SET with a TTL doesn't bring the key back
+func (em *entryMap) set(key string, entry Entry) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+	em.setLocked(key, entry, nowMillis())
+}
+
+func (em *entryMap) setLocked(key string, entry Entry, now int64) {
+	if entry.expired(now) {
+		em.deleteLocked(key)
+		return
+	}
+
+	if _, exists := em.data[key]; !exists {
+		em.keys.set(key, struct{}{})
+	}
+	em.data[key] = entry
+	if entry.ExpiresAt != 0 {
+		em.expiring[key] = struct{}{}
+	} else {
+		delete(em.expiring, key)
+	}
+}
+
+func (em *entryMap) delete(key string) {
+	em.lock.Lock()
+	defer em.lock.Unlock()
+	em.deleteLocked(key)
+}
+
+func (em *entryMap) deleteLocked(key string) {
+	if _, exists := em.data[key]; exists {
+		em.keys.remove(key)
+	}
+	delete(em.data, key)
+	delete(em.expiring, key)
+}
+
+// Returns false if the key doesn't exist or has already expired
+func (em *entryMap) setExpiry(key string, expiresAt int64, version uint64) bool {
+	now := nowMillis()
+
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	entry, exists := em.data[key]
+	if !exists || entry.expired(now) {
+		return false
+	}
+
+	entry.ExpiresAt = expiresAt
+	entry.Version = version
+	em.setLocked(key, entry, now)
+	return true
+}
+
+func (em *entryMap) deleteExpired() int {
+	now := nowMillis()
+
+	em.lock.Lock()
+	defer em.lock.Unlock()
+
+	deleted := 0
+	for key := range em.expiring {
+		if em.data[key].expired(now) {
+			em.deleteLocked(key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// Returns false if fn stopped early
+func (em *entryMap) forEach(fn func(key string, entry Entry) bool) bool {
+	now := nowMillis()
+
+	em.lock.RLock()
+	defer em.lock.RUnlock()
+
+	for key, entry := range em.data {
+		if entry.expired(now) {
+			continue
+		}
+		if !fn(key, entry) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,27 @@
+package storagebackend
+
+import (
+	"log"
+	"time"
+)
+
+const DEFAULT_EXPIRY_SWEEP_INTERVAL = time.Second
+
+// Deletes expired keys from backend every interval so keys that are never read again still get freed
+// Runs until stop is closed
+func SweepExpiredPeriodically(backend StorageBackend, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			deleted := backend.DeleteExpired()
+			if deleted > 0 {
+				log.Printf("Expiry sweeper deleted %d expired keys\n", deleted)
+			}
+		}
+	}
+}
@@ -0,0 +1,447 @@
+package storagebackend
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// How long a snapshot's versions are kept if MVCCStorageBackend.Retention isn't set
+const DEFAULT_MVCC_RETENTION = 5 * time.Minute
+
+// Returned (possibly wrapped) by reads at a snapshot that was never opened or has expired
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// Implemented by backends that keep old versions of keys so they can be read as they were at an earlier point
+//
+// A snapshot is identified by its read sequence number. Reads at a snapshot see every write with a sequence number
+// up to and including it and none after, and treat keys as expired or not as of when the snapshot was opened.
+type MultiVersionStorageBackend interface {
+	StorageBackend
+	// Opens a snapshot at readSeq, which must be the sequence number of the last write applied
+	// The versions it can see are kept until it expires. Opening a snapshot that's already open keeps it for another full retention
+	OpenSnapshot(readSeq uint64)
+	// Like GetEntry but as the key was at the snapshot
+	// Returns an error wrapping ErrSnapshotNotFound if the snapshot isn't open
+	GetEntryAt(key string, readSeq uint64) (Entry, error)
+	// Like Scan but visits keys as they were at the snapshot
+	// Returns an error wrapping ErrSnapshotNotFound if the snapshot isn't open
+	ScanAt(cursor []byte, count int, readSeq uint64, fn func(key string, entry Entry)) ([]byte, error)
+}
+
+// One write to a key. Deletes are kept as tombstones so snapshots from before them still see the old value
+type mvccVersion struct {
+	entry   Entry
+	deleted bool
+}
+
+// Which versions can still be read. Versions no snapshot can see are garbage collected
+type mvccHorizon struct {
+	// Read sequence number of the oldest open snapshot. math.MaxUint64 if none are open
+	readSeq uint64
+	// When the oldest open snapshot was opened (Unix milliseconds). Now if none are open
+	openedAt int64
+}
+
+// An open snapshot
+type mvccSnapshot struct {
+	// When it was first opened (Unix milliseconds). Keys are read as if it were still this time so expiries after it aren't seen
+	openedAt int64
+	// When it stops being readable. Pushed back every time it's opened again
+	expiresAt int64
+}
+
+// Keys and every version of them that may still be read behind a read/write lock. See MVCCStorageBackend
+type mvccShard struct {
+	lock sync.RWMutex
+	// Versions of each key in the order they were written
+	chains map[string][]mvccVersion
+	// Keys that have more than one version, a tombstone or an expiry so garbage collection only needs to visit these
+	collectable map[string]struct{}
+	// Keys of chains in order so scans can pick up where they left off. See entryMap
+	keys skipList[struct{}]
+}
+
+// Reads of a shard as of a snapshot, or of the latest versions for a readSeq of math.MaxUint64
+type mvccShardView struct {
+	shard   *mvccShard
+	readSeq uint64
+	at      int64
+}
+
+// Keeps superseded versions of keys so snapshots can be read consistently while writers carry on
+//
+// Keys are spread over shards like ShardedMapStorageBackend. Every write adds a version to the key rather than replacing it.
+// Versions are dropped once no open snapshot can see them, as keys are written and by DeleteExpired.
+// Snapshots only live in memory. Only the latest version of each key is written to disk snapshots and none survive a restart.
+type MVCCStorageBackend struct {
+	// Defaults to DEFAULT_SHARD_COUNT if not set
+	ShardCount int
+	// How long a snapshot's versions are kept after it's last opened
+	// Defaults to DEFAULT_MVCC_RETENTION if not set
+	Retention time.Duration
+	shards    []*mvccShard
+
+	// Held for writing to open and expire snapshots and for reading while versions are dropped
+	// so a snapshot can't open part way through and lose the versions it needs. Taken before any shard lock
+	snapshotLock sync.RWMutex
+	// Open snapshots keyed by their read sequence number
+	snapshots map[uint64]mvccSnapshot
+}
+
+func (mvsb *MVCCStorageBackend) Init() {
+	if mvsb.ShardCount <= 0 {
+		mvsb.ShardCount = DEFAULT_SHARD_COUNT
+	}
+	if mvsb.Retention <= 0 {
+		mvsb.Retention = DEFAULT_MVCC_RETENTION
+	}
+
+	mvsb.shards = make([]*mvccShard, mvsb.ShardCount)
+	for i := range mvsb.shards {
+		mvsb.shards[i] = &mvccShard{chains: make(map[string][]mvccVersion), collectable: make(map[string]struct{})}
+		mvsb.shards[i].keys.init()
+	}
+	mvsb.snapshots = make(map[uint64]mvccSnapshot)
+}
+
+func (mvsb *MVCCStorageBackend) shardFor(key string) *mvccShard {
+	return mvsb.shards[shardIndex(key, len(mvsb.shards))]
+}
+
+// Caller must hold snapshotLock
+func (mvsb *MVCCStorageBackend) horizon(now int64) mvccHorizon {
+	horizon := mvccHorizon{readSeq: math.MaxUint64, openedAt: now}
+	for readSeq, snapshot := range mvsb.snapshots {
+		horizon.readSeq = min(horizon.readSeq, readSeq)
+		horizon.openedAt = min(horizon.openedAt, snapshot.openedAt)
+	}
+	return horizon
+}
+
+// The version visible at readSeq or false if the key didn't exist or had expired by at
+func visibleVersion(chain []mvccVersion, readSeq uint64, at int64) (Entry, bool) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		version := chain[i]
+		if version.entry.Version > readSeq {
+			continue
+		}
+		if version.deleted || version.entry.expired(at) {
+			return Entry{}, false
+		}
+		return version.entry, true
+	}
+	return Entry{}, false
+}
+
+// Drops the versions of key that no snapshot at or after the horizon can see. Caller must hold the shard's write lock
+// Returns true if the key's last version had expired and nothing is left
+func (shard *mvccShard) collectLocked(key string, horizon mvccHorizon) bool {
+	chain := shard.chains[key]
+
+	// Every snapshot sees the newest version at or before its read sequence number so anything older is unreachable
+	oldest := 0
+	for i := len(chain) - 1; i >= 0; i-- {
+		if chain[i].entry.Version <= horizon.readSeq {
+			oldest = i
+			break
+		}
+	}
+	chain = chain[oldest:]
+
+	// A leading tombstone or a version expired for every snapshot reads the same as no version at all
+	expired := false
+	for len(chain) > 0 && (chain[0].deleted || chain[0].entry.expired(horizon.openedAt)) {
+		expired = !chain[0].deleted
+		chain = chain[1:]
+	}
+
+	if len(chain) == 0 {
+		delete(shard.chains, key)
+		delete(shard.collectable, key)
+		shard.keys.remove(key)
+		return expired
+	}
+	// Copied so the dropped versions aren't kept alive by the backing array
+	if len(chain) != len(shard.chains[key]) {
+		shard.chains[key] = append([]mvccVersion(nil), chain...)
+	}
+	if len(chain) == 1 && chain[0].entry.ExpiresAt == 0 {
+		delete(shard.collectable, key)
+	}
+	return false
+}
+
+// Adds a version to the key. Caller must hold snapshotLock for reading and the shard's write lock
+func (shard *mvccShard) appendLocked(key string, version mvccVersion, horizon mvccHorizon) {
+	chain := shard.chains[key]
+	// A transaction writing the same key twice writes both at the same sequence number. Only the last counts
+	if len(chain) > 0 && chain[len(chain)-1].entry.Version == version.entry.Version {
+		chain[len(chain)-1] = version
+	} else {
+		if len(chain) == 0 {
+			shard.keys.set(key, struct{}{})
+		}
+		shard.chains[key] = append(chain, version)
+	}
+	shard.collectable[key] = struct{}{}
+	shard.collectLocked(key, horizon)
+}
+
+func (mvsb *MVCCStorageBackend) write(key string, version mvccVersion) {
+	mvsb.snapshotLock.RLock()
+	defer mvsb.snapshotLock.RUnlock()
+	horizon := mvsb.horizon(nowMillis())
+
+	shard := mvsb.shardFor(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	shard.appendLocked(key, version, horizon)
+}
+
+func (mvsb *MVCCStorageBackend) Set(key string, value []byte, version uint64) error {
+	mvsb.write(key, mvccVersion{entry: Entry{Value: value, Version: version}})
+	return nil
+}
+
+func (mvsb *MVCCStorageBackend) SetWithExpiry(key string, value []byte, expiresAt int64, version uint64) error {
+	mvsb.write(key, mvccVersion{entry: Entry{Value: value, ExpiresAt: expiresAt, Version: version}})
+	return nil
+}
+
+// Locks every shard the batch touches in shard order like ShardedMapStorageBackend.WriteBatch
+func (mvsb *MVCCStorageBackend) WriteBatch(writes []BatchWrite, version uint64) error {
+	mvsb.snapshotLock.RLock()
+	defer mvsb.snapshotLock.RUnlock()
+	horizon := mvsb.horizon(nowMillis())
+
+	locked := shardsFor(mvsb.shards, batchKeys(writes))
+	for _, shard := range locked {
+		shard.lock.Lock()
+	}
+	defer func() {
+		for _, shard := range locked {
+			shard.lock.Unlock()
+		}
+	}()
+
+	for _, write := range writes {
+		mvsb.shardFor(write.Key).appendLocked(write.Key, mvccVersion{entry: Entry{Value: write.Value, Version: version}, deleted: write.Delete}, horizon)
+	}
+	return nil
+}
+
+func (mvsb *MVCCStorageBackend) GetMany(keys []string) ([]Entry, []bool) {
+	now := nowMillis()
+	locked := shardsFor(mvsb.shards, keys)
+	for _, shard := range locked {
+		shard.lock.RLock()
+	}
+	defer func() {
+		for _, shard := range locked {
+			shard.lock.RUnlock()
+		}
+	}()
+
+	entries := make([]Entry, len(keys))
+	exists := make([]bool, len(keys))
+	for i, key := range keys {
+		entries[i], exists[i] = visibleVersion(mvsb.shardFor(key).chains[key], math.MaxUint64, now)
+	}
+	return entries, exists
+}
+
+func (mvsb *MVCCStorageBackend) Get(key string) ([]byte, error) {
+	entry, err := mvsb.GetEntry(key)
+	return entry.Value, err
+}
+
+// Expired keys are collected as they're found unless a snapshot can still see them. See entryMap.get
+func (mvsb *MVCCStorageBackend) GetEntry(key string) (Entry, error) {
+	now := nowMillis()
+
+	shard := mvsb.shardFor(key)
+	shard.lock.RLock()
+	chain := shard.chains[key]
+	entry, exists := visibleVersion(chain, math.MaxUint64, now)
+	shard.lock.RUnlock()
+
+	if exists {
+		return entry, nil
+	}
+	if len(chain) > 0 && chain[len(chain)-1].entry.expired(now) {
+		mvsb.collect(key, now)
+	}
+	return Entry{}, fmt.Errorf("mvcc_storage_backend: no such key %s. %w", key, ErrKeyNotFound)
+}
+
+func (mvsb *MVCCStorageBackend) collect(key string, now int64) {
+	mvsb.snapshotLock.RLock()
+	defer mvsb.snapshotLock.RUnlock()
+	horizon := mvsb.horizon(now)
+
+	shard := mvsb.shardFor(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	if _, exists := shard.chains[key]; exists {
+		shard.collectLocked(key, horizon)
+	}
+}
+
+func (mvsb *MVCCStorageBackend) Delete(key string, version uint64) error {
+	mvsb.write(key, mvccVersion{entry: Entry{Version: version}, deleted: true})
+	return nil
+}
+
+func (mvsb *MVCCStorageBackend) SetExpiry(key string, expiresAt int64, version uint64) error {
+	now := nowMillis()
+
+	mvsb.snapshotLock.RLock()
+	defer mvsb.snapshotLock.RUnlock()
+	horizon := mvsb.horizon(now)
+
+	shard := mvsb.shardFor(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	entry, exists := visibleVersion(shard.chains[key], math.MaxUint64, now)
+	if !exists {
+		return fmt.Errorf("mvcc_storage_backend: no such key %s. %w", key, ErrKeyNotFound)
+	}
+	entry.ExpiresAt = expiresAt
+	entry.Version = version
+	shard.appendLocked(key, mvccVersion{entry: entry}, horizon)
+	return nil
+}
+
+func (mvsb *MVCCStorageBackend) Expiry(key string) (int64, error) {
+	entry, err := mvsb.GetEntry(key)
+	if err != nil {
+		return 0, err
+	}
+	return entry.ExpiresAt, nil
+}
+
+// Also expires snapshots and drops every version no open snapshot can see
+// Only keys whose last version expired are counted
+func (mvsb *MVCCStorageBackend) DeleteExpired() int {
+	now := nowMillis()
+
+	mvsb.snapshotLock.Lock()
+	for readSeq, snapshot := range mvsb.snapshots {
+		if snapshot.expiresAt <= now {
+			delete(mvsb.snapshots, readSeq)
+		}
+	}
+	mvsb.snapshotLock.Unlock()
+
+	mvsb.snapshotLock.RLock()
+	defer mvsb.snapshotLock.RUnlock()
+	horizon := mvsb.horizon(now)
+
+	deleted := 0
+	for _, shard := range mvsb.shards {
+		shard.lock.Lock()
+		for key := range shard.collectable {
+			if shard.collectLocked(key, horizon) {
+				deleted++
+			}
+		}
+		shard.lock.Unlock()
+	}
+	return deleted
+}
+
+// Visits the latest version of every key. Shards are visited one at a time like ShardedMapStorageBackend.ForEach
+func (mvsb *MVCCStorageBackend) ForEach(fn func(key string, entry Entry) bool) {
+	now := nowMillis()
+	for _, shard := range mvsb.shards {
+		shard.lock.RLock()
+		for key, chain := range shard.chains {
+			entry, exists := visibleVersion(chain, math.MaxUint64, now)
+			if exists && !fn(key, entry) {
+				shard.lock.RUnlock()
+				return
+			}
+		}
+		shard.lock.RUnlock()
+	}
+}
+
+func (mvsb *MVCCStorageBackend) Scan(cursor []byte, count int, fn func(key string, entry Entry)) ([]byte, error) {
+	return scanShards(mvsb.views(math.MaxUint64, nowMillis()), cursor, count, fn)
+}
+
+func (mvsb *MVCCStorageBackend) OpenSnapshot(readSeq uint64) {
+	mvsb.snapshotLock.Lock()
+	defer mvsb.snapshotLock.Unlock()
+
+	// Everyone who opened it can read it for the full retention, with the view it was first opened with
+	now := nowMillis()
+	snapshot, open := mvsb.snapshots[readSeq]
+	if !open || snapshot.expiresAt <= now {
+		snapshot.openedAt = now
+	}
+	snapshot.expiresAt = now + mvsb.Retention.Milliseconds()
+	mvsb.snapshots[readSeq] = snapshot
+}
+
+// Returns when the snapshot was opened. Caller must hold snapshotLock for reading until it's done reading
+// so the snapshot can't expire part way through
+func (mvsb *MVCCStorageBackend) openedAt(readSeq uint64) (int64, error) {
+	snapshot, open := mvsb.snapshots[readSeq]
+	if !open || snapshot.expiresAt <= nowMillis() {
+		return 0, fmt.Errorf("mvcc_storage_backend: no snapshot open at %d. It may have expired. %w", readSeq, ErrSnapshotNotFound)
+	}
+	return snapshot.openedAt, nil
+}
+
+func (mvsb *MVCCStorageBackend) GetEntryAt(key string, readSeq uint64) (Entry, error) {
+	mvsb.snapshotLock.RLock()
+	defer mvsb.snapshotLock.RUnlock()
+
+	openedAt, err := mvsb.openedAt(readSeq)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	shard := mvsb.shardFor(key)
+	shard.lock.RLock()
+	entry, exists := visibleVersion(shard.chains[key], readSeq, openedAt)
+	shard.lock.RUnlock()
+
+	if exists {
+		return entry, nil
+	}
+	return Entry{}, fmt.Errorf("mvcc_storage_backend: no such key %s at %d. %w", key, readSeq, ErrKeyNotFound)
+}
+
+func (mvsb *MVCCStorageBackend) ScanAt(cursor []byte, count int, readSeq uint64, fn func(key string, entry Entry)) ([]byte, error) {
+	mvsb.snapshotLock.RLock()
+	defer mvsb.snapshotLock.RUnlock()
+
+	openedAt, err := mvsb.openedAt(readSeq)
+	if err != nil {
+		return nil, err
+	}
+	return scanShards(mvsb.views(readSeq, openedAt), cursor, count, fn)
+}
+
+func (mvsb *MVCCStorageBackend) views(readSeq uint64, at int64) []mvccShardView {
+	views := make([]mvccShardView, len(mvsb.shards))
+	for i, shard := range mvsb.shards {
+		views[i] = mvccShardView{shard: shard, readSeq: readSeq, at: at}
+	}
+	return views
+}
+
+func (view mvccShardView) scan(cursor scanCursor, count int, fn func(key string, entry Entry)) (string, bool) {
+	view.shard.lock.RLock()
+	defer view.shard.lock.RUnlock()
+
+	return scanKeys(&view.shard.keys, cursor, count, func(key string) (Entry, bool) {
+		return visibleVersion(view.shard.chains[key], view.readSeq, view.at)
+	}, fn)
+}
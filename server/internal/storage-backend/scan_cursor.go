@@ -0,0 +1,127 @@
+package storagebackend
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Returned (possibly wrapped) by Scan when the cursor wasn't one it handed out
+var ErrInvalidCursor = errors.New("invalid scan cursor")
+
+// Where a Scan got up to. Opaque to clients
+//
+// | Shard (4) | Started (1) | Last Key (n) |
+//
+// Started is 0 until the first key of the shard has been visited as "" is a valid key.
+// Keys are visited in order within a shard so keys that exist for the whole scan are returned exactly once.
+type scanCursor struct {
+	shard   int
+	started bool
+	lastKey string
+}
+
+const scanCursorFixedSize = 4 + 1
+
+func decodeScanCursor(cursor []byte, shardCount int) (scanCursor, error) {
+	if len(cursor) == 0 {
+		return scanCursor{}, nil
+	}
+	if len(cursor) < scanCursorFixedSize {
+		return scanCursor{}, fmt.Errorf("scan cursor is too short. %w", ErrInvalidCursor)
+	}
+
+	decoded := scanCursor{
+		shard:   int(binary.BigEndian.Uint32(cursor)),
+		started: cursor[4] == 1,
+		lastKey: string(cursor[scanCursorFixedSize:]),
+	}
+	if decoded.shard >= shardCount {
+		return scanCursor{}, fmt.Errorf("scan cursor points at shard %d of %d. %w", decoded.shard, shardCount, ErrInvalidCursor)
+	}
+	return decoded, nil
+}
+
+func (sc scanCursor) encode() []byte {
+	encoded := binary.BigEndian.AppendUint32(nil, uint32(sc.shard))
+	if sc.started {
+		encoded = append(encoded, 1)
+	} else {
+		encoded = append(encoded, 0)
+	}
+	return append(encoded, sc.lastKey...)
+}
+
+func (sc scanCursor) after(key string) bool {
+	return !sc.started || key > sc.lastKey
+}
+
+// Walks keys in order from the cursor calling fn with up to count of those live says still exist
+// Returns the last key visited and whether there are live keys after it
+// Only the keys visited and any dead ones in between are looked at so a batch doesn't cost more as the shard grows
+func scanKeys(keys *skipList[struct{}], cursor scanCursor, count int, live func(key string) (Entry, bool), fn func(key string, entry Entry)) (string, bool) {
+	visited := 0
+	lastKey := ""
+	for node := keys.seek(cursor.lastKey, nil); node != nil; node = node.next[0] {
+		if !cursor.after(node.key) {
+			continue
+		}
+		entry, exists := live(node.key)
+		if !exists {
+			continue
+		}
+		if visited == count {
+			return lastKey, true
+		}
+		fn(node.key, entry)
+		lastKey = node.key
+		visited++
+	}
+	return lastKey, false
+}
+
+// Visits up to count of the live keys after the cursor in key order
+// Returns the last key visited and whether there are keys after it
+func (em *entryMap) scan(cursor scanCursor, count int, fn func(key string, entry Entry)) (string, bool) {
+	now := nowMillis()
+
+	em.lock.RLock()
+	defer em.lock.RUnlock()
+
+	return scanKeys(&em.keys, cursor, count, func(key string) (Entry, bool) {
+		entry := em.data[key]
+		return entry, !entry.expired(now)
+	}, fn)
+}
+
+// A shard that can be scanned in key order. See entryMap.scan
+type shardScanner interface {
+	scan(cursor scanCursor, count int, fn func(key string, entry Entry)) (string, bool)
+}
+
+// Scans shards in order moving on to the next once one has been visited completely
+func scanShards[S shardScanner](shards []S, cursor []byte, count int, fn func(key string, entry Entry)) ([]byte, error) {
+	position, err := decodeScanCursor(cursor, len(shards))
+	if err != nil {
+		return nil, err
+	}
+
+	for count > 0 {
+		visited := 0
+		lastKey, more := shards[position.shard].scan(position, count, func(key string, entry Entry) {
+			visited++
+			fn(key, entry)
+		})
+		count -= visited
+
+		if more {
+			return scanCursor{shard: position.shard, started: true, lastKey: lastKey}.encode(), nil
+		}
+		position = scanCursor{shard: position.shard + 1}
+		if position.shard == len(shards) {
+			return nil, nil
+		}
+	}
+
+	return position.encode(), nil
+}
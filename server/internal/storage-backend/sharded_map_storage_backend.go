@@ -0,0 +1,109 @@
+package storagebackend
+
+import (
+	"fmt"
+)
+
+const DEFAULT_SHARD_COUNT = 64
+
+// Spreads keys over ShardCount maps each with its own lock
+// Requests for keys on different shards never wait on each other
+type ShardedMapStorageBackend struct {
+	// Defaults to DEFAULT_SHARD_COUNT if not set
+	ShardCount int
+	shards     []*entryMap
+}
+
+func (smsb *ShardedMapStorageBackend) Init() {
+	if smsb.ShardCount <= 0 {
+		smsb.ShardCount = DEFAULT_SHARD_COUNT
+	}
+
+	smsb.shards = make([]*entryMap, smsb.ShardCount)
+	for i := range smsb.shards {
+		smsb.shards[i] = &entryMap{}
+		smsb.shards[i].init()
+	}
+}
+
+func (smsb *ShardedMapStorageBackend) shardFor(key string) *entryMap {
+	return smsb.shards[shardIndex(key, len(smsb.shards))]
+}
+
+func (smsb *ShardedMapStorageBackend) Set(key string, value []byte, version uint64) error {
+	smsb.shardFor(key).set(key, Entry{Value: value, Version: version})
+	return nil
+}
+
+func (smsb *ShardedMapStorageBackend) SetWithExpiry(key string, value []byte, expiresAt int64, version uint64) error {
+	smsb.shardFor(key).set(key, Entry{Value: value, ExpiresAt: expiresAt, Version: version})
+	return nil
+}
+
+func (smsb *ShardedMapStorageBackend) Get(key string) ([]byte, error) {
+	entry, err := smsb.GetEntry(key)
+	return entry.Value, err
+}
+
+func (smsb *ShardedMapStorageBackend) GetEntry(key string) (Entry, error) {
+	entry, exists := smsb.shardFor(key).get(key)
+	if exists {
+		return entry, nil
+	}
+
+	return Entry{}, fmt.Errorf("sharded_map_storage_backend: no such key %s. %w", key, ErrKeyNotFound)
+}
+
+func (smsb *ShardedMapStorageBackend) Delete(key string, version uint64) error {
+	smsb.shardFor(key).delete(key)
+	return nil
+}
+
+func (smsb *ShardedMapStorageBackend) SetExpiry(key string, expiresAt int64, version uint64) error {
+	if !smsb.shardFor(key).setExpiry(key, expiresAt, version) {
+		return fmt.Errorf("sharded_map_storage_backend: no such key %s. %w", key, ErrKeyNotFound)
+	}
+	return nil
+}
+
+func (smsb *ShardedMapStorageBackend) Expiry(key string) (int64, error) {
+	entry, exists := smsb.shardFor(key).get(key)
+	if !exists {
+		return 0, fmt.Errorf("sharded_map_storage_backend: no such key %s. %w", key, ErrKeyNotFound)
+	}
+	return entry.ExpiresAt, nil
+}
+
+// Every shard the batch touches is locked while it's applied, in shard order so batches can't deadlock
+func (smsb *ShardedMapStorageBackend) WriteBatch(writes []BatchWrite, version uint64) error {
+	writeBatchToShards(smsb.shards, writes, version)
+	return nil
+}
+
+func (smsb *ShardedMapStorageBackend) GetMany(keys []string) ([]Entry, []bool) {
+	return getManyFromShards(smsb.shards, keys)
+}
+
+// Shards are swept one at a time so only one shard is locked at once
+func (smsb *ShardedMapStorageBackend) DeleteExpired() int {
+	deleted := 0
+	for _, shard := range smsb.shards {
+		deleted += shard.deleteExpired()
+	}
+	return deleted
+}
+
+// Shards are visited one at a time so writers to other shards aren't held up
+// Callers wanting a consistent view must stop writes themselves
+func (smsb *ShardedMapStorageBackend) ForEach(fn func(key string, entry Entry) bool) {
+	for _, shard := range smsb.shards {
+		if !shard.forEach(fn) {
+			return
+		}
+	}
+}
+
+// Only one shard is locked at a time and only while up to count of its keys are picked out
+func (smsb *ShardedMapStorageBackend) Scan(cursor []byte, count int, fn func(key string, entry Entry)) ([]byte, error) {
+	return scanShards(smsb.shards, cursor, count, fn)
+}
@@ -0,0 +1,97 @@
+package storagebackend
+
+import "math/rand/v2"
+
+const (
+	skipListMaxLevel = 32
+	// Chance of a node being promoted to the next level
+	skipListP = 0.25
+)
+
+type skipListNode[V any] struct {
+	key   string
+	value V
+	next  []*skipListNode[V]
+}
+
+// Values kept in ascending byte order of their keys
+// Finding a key or the first key after a point takes O(log n). Not safe for concurrent use
+type skipList[V any] struct {
+	head  *skipListNode[V]
+	level int
+	// Only used by set
+	random *rand.Rand
+}
+
+func (sl *skipList[V]) init() {
+	sl.head = &skipListNode[V]{next: make([]*skipListNode[V], skipListMaxLevel)}
+	sl.level = 1
+	sl.random = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+}
+
+func (sl *skipList[V]) randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && sl.random.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// Returns the first node with a key >= key
+// If update is given it's filled with the last node before that point on every level
+func (sl *skipList[V]) seek(key string, update []*skipListNode[V]) *skipListNode[V] {
+	node := sl.head
+	for level := sl.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].key < key {
+			node = node.next[level]
+		}
+		if update != nil {
+			update[level] = node
+		}
+	}
+	return node.next[0]
+}
+
+func (sl *skipList[V]) find(key string) *skipListNode[V] {
+	node := sl.seek(key, nil)
+	if node != nil && node.key == key {
+		return node
+	}
+	return nil
+}
+
+// Adds key or replaces its value if it's already there
+func (sl *skipList[V]) set(key string, value V) {
+	update := make([]*skipListNode[V], skipListMaxLevel)
+	node := sl.seek(key, update)
+	if node != nil && node.key == key {
+		node.value = value
+		return
+	}
+
+	level := sl.randomLevel()
+	for ; sl.level < level; sl.level++ {
+		update[sl.level] = sl.head
+	}
+
+	node = &skipListNode[V]{key: key, value: value, next: make([]*skipListNode[V], level)}
+	for i := range level {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+}
+
+func (sl *skipList[V]) remove(key string) {
+	update := make([]*skipListNode[V], skipListMaxLevel)
+	node := sl.seek(key, update)
+	if node == nil || node.key != key {
+		return
+	}
+
+	for i := range node.next {
+		update[i].next[i] = node.next[i]
+	}
+	for sl.level > 1 && sl.head.next[sl.level-1] == nil {
+		sl.level--
+	}
+}
@@ -0,0 +1,243 @@
+package storagebackend
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Implemented by backends that keep their keys in order
+type OrderedStorageBackend interface {
+	StorageBackend
+	// Calls fn for every key from start (inclusive) to end (exclusive) in ascending byte order until fn returns false
+	// An empty end means there is no upper bound. Locks may be held while fn runs so fn must not call back into the backend
+	Range(start string, end string, fn func(key string, entry Entry) bool)
+}
+
+// Keeps keys sorted in a skip list behind a single lock so they can be read back in order with Range
+// Lookups and writes take O(log n) rather than the O(1) of the map backends
+type SkipListStorageBackend struct {
+	lock sync.RWMutex
+	list skipList[Entry]
+	// Keys with an expiry so sweeping doesn't have to walk the whole list
+	expiring map[string]struct{}
+}
+
+func (slsb *SkipListStorageBackend) Init() {
+	slsb.list.init()
+	slsb.expiring = make(map[string]struct{})
+}
+
+// Caller must hold the write lock
+func (slsb *SkipListStorageBackend) setLocked(key string, entry Entry, now int64) {
+	if entry.expired(now) {
+		slsb.deleteLocked(key)
+		return
+	}
+
+	if entry.ExpiresAt != 0 {
+		slsb.expiring[key] = struct{}{}
+	} else {
+		delete(slsb.expiring, key)
+	}
+
+	slsb.list.set(key, entry)
+}
+
+// Caller must hold the write lock
+func (slsb *SkipListStorageBackend) deleteLocked(key string) {
+	delete(slsb.expiring, key)
+	slsb.list.remove(key)
+}
+
+func (slsb *SkipListStorageBackend) Set(key string, value []byte, version uint64) error {
+	return slsb.SetWithExpiry(key, value, 0, version)
+}
+
+func (slsb *SkipListStorageBackend) SetWithExpiry(key string, value []byte, expiresAt int64, version uint64) error {
+	slsb.lock.Lock()
+	defer slsb.lock.Unlock()
+
+	slsb.setLocked(key, Entry{Value: value, ExpiresAt: expiresAt, Version: version}, nowMillis())
+	return nil
+}
+
+// Expired keys are deleted as they're found. See entryMap.get
+func (slsb *SkipListStorageBackend) getEntry(key string) (Entry, bool) {
+	now := nowMillis()
+
+	slsb.lock.RLock()
+	node := slsb.list.find(key)
+	var entry Entry
+	if node != nil {
+		entry = node.value
+	}
+	slsb.lock.RUnlock()
+
+	if node == nil {
+		return Entry{}, false
+	}
+	if !entry.expired(now) {
+		return entry, true
+	}
+
+	slsb.lock.Lock()
+	defer slsb.lock.Unlock()
+	current := slsb.list.find(key)
+	if current != nil && current.value.expired(now) {
+		slsb.deleteLocked(key)
+	}
+	return Entry{}, false
+}
+
+func (slsb *SkipListStorageBackend) Get(key string) ([]byte, error) {
+	entry, err := slsb.GetEntry(key)
+	return entry.Value, err
+}
+
+func (slsb *SkipListStorageBackend) GetEntry(key string) (Entry, error) {
+	entry, exists := slsb.getEntry(key)
+	if exists {
+		return entry, nil
+	}
+
+	return Entry{}, fmt.Errorf("skip_list_storage_backend: no such key %s. %w", key, ErrKeyNotFound)
+}
+
+func (slsb *SkipListStorageBackend) Delete(key string, version uint64) error {
+	slsb.lock.Lock()
+	defer slsb.lock.Unlock()
+
+	slsb.deleteLocked(key)
+	return nil
+}
+
+func (slsb *SkipListStorageBackend) SetExpiry(key string, expiresAt int64, version uint64) error {
+	now := nowMillis()
+
+	slsb.lock.Lock()
+	defer slsb.lock.Unlock()
+
+	node := slsb.list.find(key)
+	if node == nil || node.value.expired(now) {
+		return fmt.Errorf("skip_list_storage_backend: no such key %s. %w", key, ErrKeyNotFound)
+	}
+
+	entry := node.value
+	entry.ExpiresAt = expiresAt
+	entry.Version = version
+	slsb.setLocked(key, entry, now)
+	return nil
+}
+
+func (slsb *SkipListStorageBackend) Expiry(key string) (int64, error) {
+	entry, exists := slsb.getEntry(key)
+	if !exists {
+		return 0, fmt.Errorf("skip_list_storage_backend: no such key %s. %w", key, ErrKeyNotFound)
+	}
+	return entry.ExpiresAt, nil
+}
+
+// Applied under the one lock so Range and GetMany see none or all of it
+func (slsb *SkipListStorageBackend) WriteBatch(writes []BatchWrite, version uint64) error {
+	now := nowMillis()
+
+	slsb.lock.Lock()
+	defer slsb.lock.Unlock()
+
+	for _, write := range writes {
+		if write.Delete {
+			slsb.deleteLocked(write.Key)
+		} else {
+			slsb.setLocked(write.Key, Entry{Value: write.Value, Version: version}, now)
+		}
+	}
+	return nil
+}
+
+func (slsb *SkipListStorageBackend) GetMany(keys []string) ([]Entry, []bool) {
+	now := nowMillis()
+
+	slsb.lock.RLock()
+	defer slsb.lock.RUnlock()
+
+	entries := make([]Entry, len(keys))
+	exists := make([]bool, len(keys))
+	for i, key := range keys {
+		node := slsb.list.find(key)
+		if node != nil && !node.value.expired(now) {
+			entries[i], exists[i] = node.value, true
+		}
+	}
+	return entries, exists
+}
+
+func (slsb *SkipListStorageBackend) DeleteExpired() int {
+	now := nowMillis()
+
+	slsb.lock.Lock()
+	defer slsb.lock.Unlock()
+
+	deleted := 0
+	for key := range slsb.expiring {
+		node := slsb.list.find(key)
+		if node != nil && node.value.expired(now) {
+			slsb.deleteLocked(key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// Visits keys in ascending order
+func (slsb *SkipListStorageBackend) ForEach(fn func(key string, entry Entry) bool) {
+	slsb.Range("", "", fn)
+}
+
+func (slsb *SkipListStorageBackend) Range(start string, end string, fn func(key string, entry Entry) bool) {
+	now := nowMillis()
+
+	slsb.lock.RLock()
+	defer slsb.lock.RUnlock()
+
+	for node := slsb.list.seek(start, nil); node != nil; node = node.next[0] {
+		if end != "" && node.key >= end {
+			return
+		}
+		if node.value.expired(now) {
+			continue
+		}
+		if !fn(node.key, node.value) {
+			return
+		}
+	}
+}
+
+// Keys are visited in order so the cursor is just the last key visited
+func (slsb *SkipListStorageBackend) Scan(cursor []byte, count int, fn func(key string, entry Entry)) ([]byte, error) {
+	position, err := decodeScanCursor(cursor, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	visited := 0
+	var lastKey string
+	more := false
+	slsb.Range(position.lastKey, "", func(key string, entry Entry) bool {
+		if !position.after(key) {
+			return true
+		}
+		if visited == count {
+			more = true
+			return false
+		}
+		fn(key, entry)
+		lastKey = key
+		visited++
+		return true
+	})
+
+	if !more {
+		return nil, nil
+	}
+	return scanCursor{started: true, lastKey: lastKey}.encode(), nil
+}
@@ -1,42 +1,126 @@
 package storagebackend
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
+// Returned (possibly wrapped) by Get when the key is not in the store
+var ErrKeyNotFound = errors.New("key not found")
+
+// Wrapped by errors from writes whose condition on a key's current entry doesn't hold
+var ErrConditionFailed = errors.New("condition failed")
+
+// Keys can be given an expiry (Unix milliseconds). Once it passes the key behaves as if it was deleted
 type StorageBackend interface {
 	Init()
-	Set(key, value string) error
-	Get(key string) (string, error)
-	Delete(key string) error
+	// Implementations may keep a reference to value so callers must not modify it afterwards
+	// Clears any expiry the key had. version becomes the key's Entry.Version
+	Set(key string, value []byte, version uint64) error
+	// Like Set but the key expires at expiresAt. A key set with an expiry in the past is deleted
+	SetWithExpiry(key string, value []byte, expiresAt int64, version uint64) error
+	// Returns an error wrapping ErrKeyNotFound if the key does not exist
+	// Callers must not modify the returned slice
+	Get(key string) ([]byte, error)
+	// Like Get but returns the whole entry including its version
+	GetEntry(key string) (Entry, error)
+	// version is the sequence number of the delete. Only backends that keep old versions of keys use it
+	Delete(key string, version uint64) error
+	// Changes when an existing key expires. 0 removes the expiry
+	// Returns an error wrapping ErrKeyNotFound if the key does not exist
+	SetExpiry(key string, expiresAt int64, version uint64) error
+	// Returns when the key expires or 0 if it never does
+	// Returns an error wrapping ErrKeyNotFound if the key does not exist
+	Expiry(key string) (int64, error)
+	// Applies every write with version as the new version of the keys it sets
+	// Readers using GetMany see either none or all of the batch
+	WriteBatch(writes []BatchWrite, version uint64) error
+	// Like GetEntry for several keys at once. exists[i] is false if keys[i] doesn't exist
+	// Sees either none or all of each WriteBatch
+	GetMany(keys []string) (entries []Entry, exists []bool)
+	// Removes every key whose expiry has passed and returns how many were removed
+	DeleteExpired() int
+	// Calls fn for every key in no particular order until fn returns false
+	// Locks may be held while fn runs so fn must not call back into the backend
+	ForEach(fn func(key string, entry Entry) bool)
+	// Calls fn for up to count keys following on from cursor and returns the cursor to carry on from
+	// An empty cursor starts a new scan. The returned cursor is nil once every key has been visited
+	// Keys that exist for the whole scan are visited exactly once. Keys added or removed part way through may or may not be
+	// Returns an error wrapping ErrInvalidCursor if cursor wasn't returned by a previous Scan
+	Scan(cursor []byte, count int, fn func(key string, entry Entry)) ([]byte, error)
 }
 
+// Every operation takes a single lock so requests running concurrently are safe but contend with each other
 type MapStorageBackend struct {
-	data map[string]string
+	entryMap
 }
 
 func (msb *MapStorageBackend) Init() {
-	msb.data = make(map[string]string)
+	msb.entryMap.init()
+}
+
+func (msb *MapStorageBackend) Set(key string, value []byte, version uint64) error {
+	msb.entryMap.set(key, Entry{Value: value, Version: version})
+	return nil
 }
 
-func (msb *MapStorageBackend) Set(key, value string) error {
-	msb.data[key] = value
+func (msb *MapStorageBackend) SetWithExpiry(key string, value []byte, expiresAt int64, version uint64) error {
+	msb.entryMap.set(key, Entry{Value: value, ExpiresAt: expiresAt, Version: version})
 	return nil
 }
 
-func (msb *MapStorageBackend) Get(key string) (string, error) {
-	value, exists := msb.data[key]
+func (msb *MapStorageBackend) Get(key string) ([]byte, error) {
+	entry, err := msb.GetEntry(key)
+	return entry.Value, err
+}
+
+func (msb *MapStorageBackend) GetEntry(key string) (Entry, error) {
+	entry, exists := msb.entryMap.get(key)
 
 	if exists {
-		return value, nil
+		return entry, nil
 	}
 
-	return "", fmt.Errorf("map_storage_backend: no such key %s", key)
+	return Entry{}, fmt.Errorf("map_storage_backend: no such key %s. %w", key, ErrKeyNotFound)
 }
 
-func (msb *MapStorageBackend) Delete(key string) error {
-	_, exists := msb.data[key]
-	if exists {
-		delete(msb.data, key)
+func (msb *MapStorageBackend) Delete(key string, version uint64) error {
+	msb.entryMap.delete(key)
+	return nil
+}
+
+func (msb *MapStorageBackend) SetExpiry(key string, expiresAt int64, version uint64) error {
+	if !msb.entryMap.setExpiry(key, expiresAt, version) {
+		return fmt.Errorf("map_storage_backend: no such key %s. %w", key, ErrKeyNotFound)
+	}
+	return nil
+}
+
+func (msb *MapStorageBackend) Expiry(key string) (int64, error) {
+	entry, exists := msb.entryMap.get(key)
+	if !exists {
+		return 0, fmt.Errorf("map_storage_backend: no such key %s. %w", key, ErrKeyNotFound)
 	}
+	return entry.ExpiresAt, nil
+}
 
+func (msb *MapStorageBackend) WriteBatch(writes []BatchWrite, version uint64) error {
+	writeBatchToShards([]*entryMap{&msb.entryMap}, writes, version)
 	return nil
 }
+
+func (msb *MapStorageBackend) GetMany(keys []string) ([]Entry, []bool) {
+	return getManyFromShards([]*entryMap{&msb.entryMap}, keys)
+}
+
+func (msb *MapStorageBackend) DeleteExpired() int {
+	return msb.entryMap.deleteExpired()
+}
+
+func (msb *MapStorageBackend) ForEach(fn func(key string, entry Entry) bool) {
+	msb.entryMap.forEach(fn)
+}
+
+func (msb *MapStorageBackend) Scan(cursor []byte, count int, fn func(key string, entry Entry)) ([]byte, error) {
+	return scanShards([]*entryMap{&msb.entryMap}, cursor, count, fn)
+}
@@ -1,14 +1,22 @@
 package storagebackend
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
-	TEST_KEY   = "test_key"
-	TEST_VALUE = "test_value"
+	TEST_KEY = "test_key"
 )
 
+// Deliberately not valid UTF-8 and contains a newline
+var TEST_VALUE = []byte{'t', 'e', 's', 't', 0x00, '\n', 0xff, 0xfe}
+
 func TestMapStorageInit(t *testing.T) {
 	mapStorageBackend := &MapStorageBackend{}
 	mapStorageBackend.Init()
@@ -22,7 +30,7 @@ func TestMapStorageCanSet(t *testing.T) {
 	mapStorageBackend := &MapStorageBackend{}
 	mapStorageBackend.Init()
 
-	err := mapStorageBackend.Set(TEST_KEY, TEST_VALUE)
+	err := mapStorageBackend.Set(TEST_KEY, TEST_VALUE, 1)
 	if err != nil {
 		t.Errorf("Failed to set key. Got err = %s", err)
 	}
@@ -33,8 +41,8 @@ func TestMapStorageCanSet(t *testing.T) {
 		t.Errorf("Failed to get key. Got err = %s", err)
 	}
 
-	if fetchedValue != TEST_VALUE {
-		t.Errorf("Expected fetched value to match expected value. %s != %s", TEST_VALUE, fetchedValue)
+	if !bytes.Equal(fetchedValue, TEST_VALUE) {
+		t.Errorf("Expected fetched value to match expected value. %q != %q", TEST_VALUE, fetchedValue)
 	}
 
 }
@@ -45,7 +53,7 @@ func TestMapStorageCanGet(t *testing.T) {
 	mapStorageBackend := &MapStorageBackend{}
 	mapStorageBackend.Init()
 
-	err := mapStorageBackend.Set(TEST_KEY, TEST_VALUE)
+	err := mapStorageBackend.Set(TEST_KEY, TEST_VALUE, 1)
 	if err != nil {
 		t.Errorf("Failed to set key. Got err = %s", err)
 	}
@@ -56,8 +64,8 @@ func TestMapStorageCanGet(t *testing.T) {
 		t.Errorf("Failed to get key. Got err = %s", err)
 	}
 
-	if fetchedValue != TEST_VALUE {
-		t.Errorf("Expected fetched value to match expected value. %s != %s", TEST_VALUE, fetchedValue)
+	if !bytes.Equal(fetchedValue, TEST_VALUE) {
+		t.Errorf("Expected fetched value to match expected value. %q != %q", TEST_VALUE, fetchedValue)
 	}
 
 }
@@ -66,7 +74,7 @@ func TestMapStorageCanDelete(t *testing.T) {
 	mapStorageBackend := &MapStorageBackend{}
 	mapStorageBackend.Init()
 
-	err := mapStorageBackend.Set(TEST_KEY, TEST_VALUE)
+	err := mapStorageBackend.Set(TEST_KEY, TEST_VALUE, 1)
 	if err != nil {
 		t.Errorf("Failed to set key. Got err = %s", err)
 	}
@@ -77,13 +85,516 @@ func TestMapStorageCanDelete(t *testing.T) {
 		t.Errorf("Failed to get key. Got err = %s", err)
 	}
 
-	err = mapStorageBackend.Delete(TEST_KEY)
+	err = mapStorageBackend.Delete(TEST_KEY, 1)
 	if err != nil {
 		t.Errorf("Failed to delete key. Got err = %s", err)
 	}
 
 	fetchedValue, err = mapStorageBackend.Get(TEST_KEY)
-	if fetchedValue != "" || err == nil {
-		t.Errorf("Expected fetching deleted value to result in an error. Got value %s and err = %s", fetchedValue, err)
+	if fetchedValue != nil || !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected fetching deleted value to result in ErrKeyNotFound. Got value %q and err = %s", fetchedValue, err)
+	}
+}
+
+func TestMapStorageGetMissingKey(t *testing.T) {
+	mapStorageBackend := &MapStorageBackend{}
+	mapStorageBackend.Init()
+
+	_, err := mapStorageBackend.Get(TEST_KEY)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected fetching a missing key to result in ErrKeyNotFound. Got err = %s", err)
+	}
+}
+
+func TestShardedMapStorageInit(t *testing.T) {
+	shardedStorageBackend := &ShardedMapStorageBackend{}
+	shardedStorageBackend.Init()
+
+	if len(shardedStorageBackend.shards) != DEFAULT_SHARD_COUNT {
+		t.Errorf("Expected %d shards to be created. Got %d", DEFAULT_SHARD_COUNT, len(shardedStorageBackend.shards))
+	}
+}
+
+func TestShardedMapStorageCanSetGetDelete(t *testing.T) {
+	shardedStorageBackend := &ShardedMapStorageBackend{ShardCount: 4}
+	shardedStorageBackend.Init()
+
+	err := shardedStorageBackend.Set(TEST_KEY, TEST_VALUE, 1)
+	if err != nil {
+		t.Errorf("Failed to set key. Got err = %s", err)
+	}
+
+	fetchedValue, err := shardedStorageBackend.Get(TEST_KEY)
+	if err != nil {
+		t.Errorf("Failed to get key. Got err = %s", err)
+	}
+
+	if !bytes.Equal(fetchedValue, TEST_VALUE) {
+		t.Errorf("Expected fetched value to match expected value. %q != %q", TEST_VALUE, fetchedValue)
+	}
+
+	err = shardedStorageBackend.Delete(TEST_KEY, 1)
+	if err != nil {
+		t.Errorf("Failed to delete key. Got err = %s", err)
+	}
+
+	_, err = shardedStorageBackend.Get(TEST_KEY)
+	if !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected fetching deleted value to result in ErrKeyNotFound. Got err = %s", err)
+	}
+}
+
+// Meant to be run with `go test -race`
+// Writers, readers and deleters hammer an overlapping set of keys at the same time
+func TestStorageBackendsConcurrentAccess(t *testing.T) {
+	const workers = 16
+	const operations = 2000
+	const keySpace = 100
+
+	backends := map[string]StorageBackend{
+		"map":      &MapStorageBackend{},
+		"sharded":  &ShardedMapStorageBackend{ShardCount: 8},
+		"skiplist": &SkipListStorageBackend{},
+		"mvcc":     &MVCCStorageBackend{},
+	}
+
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			backend.Init()
+
+			var wg sync.WaitGroup
+			for worker := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := range operations {
+						key := fmt.Sprintf("key-%d", (worker*operations+i)%keySpace)
+						var err error
+						switch i % 3 {
+						case 0:
+							err = backend.Set(key, []byte(key), 1)
+						case 1:
+							var value []byte
+							value, err = backend.Get(key)
+							if errors.Is(err, ErrKeyNotFound) {
+								err = nil
+							} else if err == nil && string(value) != key {
+								err = fmt.Errorf("read %q for %s", value, key)
+							}
+						case 2:
+							err = backend.Delete(key, 1)
+						}
+						if err != nil {
+							t.Errorf("Worker %d operation %d failed. Got err = %s", worker, i, err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestStorageBackendsForEach(t *testing.T) {
+	backends := map[string]StorageBackend{
+		"map":      &MapStorageBackend{},
+		"sharded":  &ShardedMapStorageBackend{ShardCount: 8},
+		"skiplist": &SkipListStorageBackend{},
+		"mvcc":     &MVCCStorageBackend{},
+	}
+
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			backend.Init()
+			for i := range 100 {
+				backend.Set(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i)), 1)
+			}
+
+			seen := make(map[string]bool)
+			backend.ForEach(func(key string, entry Entry) bool {
+				if string(entry.Value) != "value-"+key[len("key-"):] {
+					t.Errorf("Unexpected value %q for %s", entry.Value, key)
+				}
+				seen[key] = true
+				return true
+			})
+			if len(seen) != 100 {
+				t.Errorf("Expected ForEach to visit 100 keys. Visited %d", len(seen))
+			}
+
+			visited := 0
+			backend.ForEach(func(key string, entry Entry) bool {
+				visited++
+				return visited < 10
+			})
+			if visited != 10 {
+				t.Errorf("Expected ForEach to stop once fn returns false. Visited %d", visited)
+			}
+		})
+	}
+}
+
+func TestStorageBackendsScan(t *testing.T) {
+	backends := map[string]StorageBackend{
+		"map":      &MapStorageBackend{},
+		"sharded":  &ShardedMapStorageBackend{ShardCount: 8},
+		"skiplist": &SkipListStorageBackend{},
+		"mvcc":     &MVCCStorageBackend{},
+	}
+
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			backend.Init()
+			// Includes the empty key which has to be told apart from the start of a shard
+			for i := range 100 {
+				backend.Set(fmt.Sprintf("key-%d", i), []byte(fmt.Sprintf("value-%d", i)), 1)
+			}
+			backend.Set("", []byte("empty"), 1)
+
+			seen := make(map[string]int)
+			var cursor []byte
+			batches := 0
+			for {
+				batch := 0
+				next, err := backend.Scan(cursor, 7, func(key string, entry Entry) {
+					seen[key]++
+					batch++
+				})
+				if err != nil {
+					t.Fatalf("Failed to scan. Got err = %s", err)
+				}
+				if batch > 7 {
+					t.Errorf("Expected at most 7 keys per batch. Got %d", batch)
+				}
+				batches++
+				// Remove keys part way through to make sure the cursor doesn't depend on them
+				if batches == 3 {
+					for i := range 50 {
+						backend.Delete(fmt.Sprintf("key-%d", i), 1)
+					}
+				}
+				if next == nil {
+					break
+				}
+				cursor = next
+			}
+
+			for key, count := range seen {
+				if count != 1 {
+					t.Errorf("Expected %q to be visited once. Visited %d times", key, count)
+				}
+			}
+			for i := 50; i < 100; i++ {
+				if seen[fmt.Sprintf("key-%d", i)] != 1 {
+					t.Errorf("Expected key-%d which existed for the whole scan to be visited", i)
+				}
+			}
+
+			_, err := backend.Scan([]byte{0xff, 0xff, 0xff, 0xff, 1}, 10, func(string, Entry) {})
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("Expected a made up cursor to be rejected. Got err = %v", err)
+			}
+		})
+	}
+}
+
+func TestStorageBackendsVersions(t *testing.T) {
+	backends := map[string]StorageBackend{
+		"map":      &MapStorageBackend{},
+		"sharded":  &ShardedMapStorageBackend{ShardCount: 8},
+		"skiplist": &SkipListStorageBackend{},
+		"mvcc":     &MVCCStorageBackend{},
+	}
+
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			backend.Init()
+			expectVersion := func(expected uint64) {
+				t.Helper()
+				entry, err := backend.GetEntry(TEST_KEY)
+				if err != nil || entry.Version != expected {
+					t.Errorf("Expected version %d. Got %+v and err = %v", expected, entry, err)
+				}
+			}
+
+			backend.Set(TEST_KEY, TEST_VALUE, 3)
+			expectVersion(3)
+			backend.SetExpiry(TEST_KEY, time.Now().Add(time.Hour).UnixMilli(), 5)
+			expectVersion(5)
+			backend.Set(TEST_KEY, TEST_VALUE, 8)
+			expectVersion(8)
+		})
+	}
+}
+
+func TestStorageBackendsExpiry(t *testing.T) {
+	backends := map[string]StorageBackend{
+		"map":      &MapStorageBackend{},
+		"sharded":  &ShardedMapStorageBackend{ShardCount: 8},
+		"skiplist": &SkipListStorageBackend{},
+		"mvcc":     &MVCCStorageBackend{},
+	}
+
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			backend.Init()
+			future := time.Now().Add(time.Hour).UnixMilli()
+
+			backend.SetWithExpiry("future", TEST_VALUE, future, 1)
+			value, err := backend.Get("future")
+			if err != nil || !bytes.Equal(value, TEST_VALUE) {
+				t.Errorf("Expected a key expiring in the future to be readable. Got %q and err = %s", value, err)
+			}
+			expiresAt, err := backend.Expiry("future")
+			if err != nil || expiresAt != future {
+				t.Errorf("Expected expiry %d. Got %d and err = %s", future, expiresAt, err)
+			}
+
+			// e.g. replaying a SET whose TTL ran out while the server was down
+			backend.SetWithExpiry("past", TEST_VALUE, time.Now().Add(-time.Second).UnixMilli(), 1)
+			_, err = backend.Get("past")
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("Expected a key set with an expiry in the past not to exist. Got err = %s", err)
+			}
+
+			backend.SetExpiry("future", 0, 1)
+			expiresAt, err = backend.Expiry("future")
+			if err != nil || expiresAt != 0 {
+				t.Errorf("Expected SetExpiry(0) to remove the expiry. Got %d and err = %s", expiresAt, err)
+			}
+
+			err = backend.SetExpiry("missing", future, 1)
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("Expected setting the expiry of a missing key to result in ErrKeyNotFound. Got err = %s", err)
+			}
+
+			backend.SetWithExpiry("soon", TEST_VALUE, time.Now().Add(20*time.Millisecond).UnixMilli(), 1)
+			backend.SetWithExpiry("lazy", TEST_VALUE, time.Now().Add(20*time.Millisecond).UnixMilli(), 1)
+			time.Sleep(30 * time.Millisecond)
+
+			_, err = backend.Get("lazy")
+			if !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("Expected Get to treat an expired key as missing. Got err = %s", err)
+			}
+			deleted := backend.DeleteExpired()
+			if deleted != 1 {
+				t.Errorf("Expected DeleteExpired to remove the one remaining expired key. Removed %d", deleted)
+			}
+			backend.ForEach(func(key string, entry Entry) bool {
+				if key != "future" {
+					t.Errorf("Expected only the persisted key to be left. Found %s", key)
+				}
+				return true
+			})
+		})
+	}
+}
+
+func TestSkipListStorageRange(t *testing.T) {
+	backend := &SkipListStorageBackend{}
+	backend.Init()
+	// Inserted out of order
+	for _, key := range []string{"user:2:name", "user:10:name", "user:1:email", "user:1:name", "admin", "user;"} {
+		backend.Set(key, []byte(key), 1)
+	}
+	backend.SetWithExpiry("user:1:session", TEST_VALUE, time.Now().Add(-time.Second).UnixMilli(), 1)
+
+	collect := func(start string, end string, limit int) []string {
+		var keys []string
+		backend.Range(start, end, func(key string, entry Entry) bool {
+			if string(entry.Value) != key {
+				t.Errorf("Unexpected value %q for %s", entry.Value, key)
+			}
+			keys = append(keys, key)
+			return len(keys) < limit
+		})
+		return keys
+	}
+
+	keys := collect("user:1:", "user:1;", 10)
+	if fmt.Sprint(keys) != "[user:1:email user:1:name]" {
+		t.Errorf("Expected only the keys prefixed user:1: in order. Got %v", keys)
+	}
+
+	keys = collect("user:", "", 2)
+	if fmt.Sprint(keys) != "[user:10:name user:1:email]" {
+		t.Errorf("Expected Range to stop once fn returns false. Got %v", keys)
+	}
+
+	keys = collect("", "", 10)
+	if fmt.Sprint(keys) != "[admin user:10:name user:1:email user:1:name user:2:name user;]" {
+		t.Errorf("Expected ForEach order with no bounds. Got %v", keys)
+	}
+
+	backend.Delete("user:1:email", 1)
+	keys = collect("user:1:", "user:1;", 10)
+	if fmt.Sprint(keys) != "[user:1:name]" {
+		t.Errorf("Expected deleted keys to be skipped. Got %v", keys)
+	}
+}
+
+func TestMVCCStorageBackendReadsAtSnapshot(t *testing.T) {
+	backend := &MVCCStorageBackend{ShardCount: 4, Retention: 50 * time.Millisecond}
+	backend.Init()
+	backend.Set("a", []byte("old"), 1)
+	backend.Set("b", []byte("deleted later"), 2)
+	backend.SetWithExpiry("c", []byte("expires later"), time.Now().Add(20*time.Millisecond).UnixMilli(), 3)
+	backend.OpenSnapshot(3)
+	backend.Set("a", []byte("new"), 4)
+	backend.Delete("b", 5)
+	backend.Set("d", []byte("added later"), 6)
+	time.Sleep(30 * time.Millisecond)
+
+	entry, err := backend.GetEntryAt("a", 3)
+	if err != nil || string(entry.Value) != "old" || entry.Version != 1 {
+		t.Errorf("Expected the snapshot to see the version of a from before it. Got %+v and err = %v", entry, err)
+	}
+	if _, err := backend.GetEntryAt("b", 3); err != nil {
+		t.Errorf("Expected the snapshot to see b from before it was deleted. Got err = %v", err)
+	}
+	if _, err := backend.GetEntryAt("c", 3); err != nil {
+		t.Errorf("Expected the snapshot to see c as it was before it expired. Got err = %v", err)
+	}
+	if _, err := backend.GetEntryAt("d", 3); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Expected the snapshot not to see d added after it. Got err = %v", err)
+	}
+	if value, _ := backend.Get("a"); string(value) != "new" {
+		t.Errorf("Expected Get to see the latest version. Got %q", value)
+	}
+
+	collect := func(scan func(cursor []byte, fn func(key string, entry Entry)) ([]byte, error)) []string {
+		var keys []string
+		var cursor []byte
+		for {
+			var err error
+			cursor, err = scan(cursor, func(key string, entry Entry) { keys = append(keys, key) })
+			if err != nil {
+				t.Fatalf("Failed to scan. Got err = %v", err)
+			}
+			if cursor == nil {
+				return keys
+			}
+		}
+	}
+	keys := collect(func(cursor []byte, fn func(key string, entry Entry)) ([]byte, error) {
+		return backend.ScanAt(cursor, 1, 3, fn)
+	})
+	if len(keys) != 3 || !slices.Contains(keys, "a") || !slices.Contains(keys, "b") || !slices.Contains(keys, "c") {
+		t.Errorf("Expected ScanAt to visit the keys as they were at the snapshot. Got %v", keys)
+	}
+	keys = collect(func(cursor []byte, fn func(key string, entry Entry)) ([]byte, error) {
+		return backend.Scan(cursor, 1, fn)
+	})
+	if len(keys) != 2 || !slices.Contains(keys, "a") || !slices.Contains(keys, "d") {
+		t.Errorf("Expected Scan to visit the latest keys. Got %v", keys)
+	}
+
+	if _, err := backend.GetEntryAt("a", 4); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("Expected reading at a snapshot that was never opened to fail. Got err = %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	backend.DeleteExpired()
+	if _, err := backend.GetEntryAt("a", 3); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("Expected the snapshot to have expired. Got err = %v", err)
+	}
+	versions := 0
+	for _, shard := range backend.shards {
+		for _, chain := range shard.chains {
+			versions += len(chain)
+		}
+	}
+	if versions != 2 {
+		t.Errorf("Expected only the latest versions of a and d to be left once the snapshot expired. Got %d versions", versions)
+	}
+}
+
+func TestEntryMapKeepsKeysInOrder(t *testing.T) {
+	em := &entryMap{}
+	em.init()
+	for _, key := range []string{"c", "a", "d", "b"} {
+		em.set(key, Entry{Value: []byte(key)})
+	}
+	em.set("a", Entry{Value: []byte("overwritten")})
+	em.delete("c")
+	em.set("expiring", Entry{Value: []byte("1"), ExpiresAt: nowMillis() + 10})
+	time.Sleep(20 * time.Millisecond)
+	em.deleteExpired()
+
+	var keys []string
+	for node := em.keys.seek("", nil); node != nil; node = node.next[0] {
+		keys = append(keys, node.key)
+	}
+	if !slices.Equal(keys, []string{"a", "b", "d"}) {
+		t.Errorf("Expected the key index to follow the map. Got %v", keys)
+	}
+}
+
+func TestStorageBackendsGetManySeesWholeBatches(t *testing.T) {
+	backends := map[string]StorageBackend{
+		"map":      &MapStorageBackend{},
+		"sharded":  &ShardedMapStorageBackend{ShardCount: 8},
+		"skiplist": &SkipListStorageBackend{},
+		"mvcc":     &MVCCStorageBackend{},
+	}
+	keys := []string{"a", "b", "c", "d"}
+
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			backend.Init()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for version := uint64(1); version <= 501; version++ {
+					writes := make([]BatchWrite, len(keys))
+					for i, key := range keys {
+						writes[i] = BatchWrite{Key: key, Value: []byte(fmt.Sprint(version)), Delete: version%5 == 0}
+					}
+					backend.WriteBatch(writes, version)
+				}
+			}()
+
+			for running := true; running; {
+				select {
+				case <-done:
+					running = false
+				default:
+				}
+				entries, exists := backend.GetMany(keys)
+				for i := range keys {
+					if exists[i] != exists[0] || entries[i].Version != entries[0].Version || !bytes.Equal(entries[i].Value, entries[0].Value) {
+						t.Fatalf("Expected every key to be from the same batch. Got %+v and %v", entries, exists)
+					}
+				}
+			}
+
+			entries, exists := backend.GetMany(append(keys, "missing"))
+			if !exists[0] || entries[0].Version != 501 || exists[len(keys)] {
+				t.Errorf("Expected the last batch to be read and missing keys not to exist. Got %+v and %v", entries, exists)
+			}
+		})
+	}
+}
+
+func TestMVCCStorageBackendReopenedSnapshotLastsFullRetention(t *testing.T) {
+	backend := &MVCCStorageBackend{ShardCount: 4, Retention: 60 * time.Millisecond}
+	backend.Init()
+	backend.SetWithExpiry("key", TEST_VALUE, time.Now().Add(20*time.Millisecond).UnixMilli(), 1)
+	backend.OpenSnapshot(1)
+	time.Sleep(40 * time.Millisecond)
+	// A second reader opens the same snapshot part way through the first one's retention
+	backend.OpenSnapshot(1)
+	time.Sleep(40 * time.Millisecond)
+	backend.DeleteExpired()
+
+	entry, err := backend.GetEntryAt("key", 1)
+	if err != nil || !bytes.Equal(entry.Value, TEST_VALUE) {
+		t.Errorf("Expected the snapshot to still be readable as first opened after the first opener's retention. Got %+v and err = %v", entry, err)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if _, err := backend.GetEntryAt("key", 1); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Errorf("Expected the snapshot to expire after the second opener's retention. Got err = %v", err)
 	}
 }
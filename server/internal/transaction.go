@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+// Response to a command queued between MULTI and EXEC
+var QUEUED_MESSAGE = []byte("QUEUED")
+
+var errWatchedKeyChanged = errors.New("a watched key changed")
+
+// Commands queued on a connection between MULTI and EXEC
+type transaction struct {
+	queued []commands.Command
+	// Combined size of the queued keys and values. Capped at the max message size so the logged record stays bounded
+	size int
+}
+
+// What a queued command saw when the transaction was committed
+type transactionRead struct {
+	entry  storagebackend.Entry
+	exists bool
+	// Written earlier in the same transaction so its version is the transaction's sequence number
+	written bool
+}
+
+// Whether the command can be queued in a transaction
+func isTransactional(identifier int) bool {
+	return identifier == commands.GET_COMMAND || identifier == commands.SET_COMMAND || identifier == commands.DELETE_COMMAND
+}
+
+// Runs MULTI, EXEC and DISCARD and queues commands sent while a transaction is open
+// Returns false for any other command, which should be executed as normal
+//
+// Only called from the connection's read loop so a session's transaction is never touched concurrently
+func (server *Server) executeInSession(sess *session, command commands.Command) (commands.Response, bool) {
+	switch command.Identifier {
+	case commands.MULTI_COMMAND:
+		if sess.transaction != nil {
+			return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "MULTI calls can't be nested"), true
+		}
+		// Requests sent before MULTI finish before anything in the transaction runs
+		sess.wait()
+		sess.transaction = &transaction{}
+		return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE}, true
+
+	case commands.EXEC_COMMAND:
+		if sess.transaction == nil {
+			return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "EXEC without MULTI"), true
+		}
+		queued := sess.transaction.queued
+		sess.transaction = nil
+		response := server.executeTransaction(queued, sess.watch)
+		server.unwatch(sess)
+		return response, true
+
+	case commands.DISCARD_COMMAND:
+		if sess.transaction == nil {
+			return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "DISCARD without MULTI"), true
+		}
+		sess.transaction = nil
+		server.unwatch(sess)
+		return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE}, true
+
+	case commands.WATCH_COMMAND, commands.UNWATCH_COMMAND:
+		return server.executeWatch(sess, command), true
+	}
+
+	if sess.transaction == nil {
+		return commands.Response{}, false
+	}
+
+	// The transaction stays open so the client can carry on queueing or DISCARD it
+	if !isTransactional(command.Identifier) {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "only GET, SET and DELETE can be used in a transaction. Got command %d", command.Identifier), true
+	}
+	size := sess.transaction.size + len(command.Key) + len(command.Value)
+	if size > server.MaxMessageSize {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "transaction is larger than the max message size of %d bytes", server.MaxMessageSize), true
+	}
+
+	sess.transaction.queued = append(sess.transaction.queued, command)
+	sess.transaction.size = size
+	return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE, Message: QUEUED_MESSAGE}, true
+}
+
+// Commits the queued commands as one write
+//
+// Responds with a list holding the result of each queued command in order. Each result is its error code byte followed by
+// the message the command would have responded with on its own. If the expected version of any SET or DELETE doesn't match
+// the whole transaction fails with CONDITION_FAILED and nothing is written. It fails the same way if a key in w changed.
+func (server *Server) executeTransaction(queued []commands.Command, w *watch) commands.Response {
+	seq, reads, err := server.commitTransaction(queued, w)
+	if errors.Is(err, errWatchedKeyChanged) {
+		return commands.ErrorResponse(commands.CONDITION_FAILED_ERROR_CODE, "transaction aborted as a watched key changed")
+	}
+	if errors.Is(err, storagebackend.ErrConditionFailed) {
+		return commands.ErrorResponse(commands.CONDITION_FAILED_ERROR_CODE, "transaction aborted as a key isn't at its expected version")
+	}
+	if err != nil {
+		log.Printf("handler_net_conn: Error committing transaction %v\n", err)
+		return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to commit transaction")
+	}
+
+	results := make([][]byte, len(queued))
+	for i, command := range queued {
+		read := reads[i]
+		version := read.entry.Version
+		if read.written {
+			version = seq
+		}
+
+		switch command.Identifier {
+		case commands.GET_COMMAND:
+			if !read.exists {
+				results[i] = fmt.Appendf([]byte{commands.NOT_FOUND_ERROR_CODE}, "no such key %s", command.Key)
+				continue
+			}
+			results[i] = []byte{commands.NO_ERROR_ERROR_CODE}
+			if command.WithVersion {
+				results[i] = binary.BigEndian.AppendUint64(results[i], version)
+			}
+			results[i] = append(results[i], read.entry.Value...)
+		case commands.SET_COMMAND:
+			results[i] = []byte{commands.NO_ERROR_ERROR_CODE}
+			if command.WithVersion {
+				results[i] = binary.BigEndian.AppendUint64(results[i], seq)
+			}
+		case commands.DELETE_COMMAND:
+			results[i] = []byte{commands.NO_ERROR_ERROR_CODE}
+		}
+	}
+
+	return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE, Message: commands.EncodeList(results)}
+}
+
+// Works out every queued command's effect and then logs and applies the writes as a single record
+// Returns the record's sequence number, 0 if nothing was written, and what each command read
+func (server *Server) commitTransaction(queued []commands.Command, w *watch) (uint64, []transactionRead, error) {
+	seq, reads, err := server.logAndApplyTransaction(queued, w)
+	if err != nil || seq == 0 {
+		return seq, reads, err
+	}
+
+	// Outside commitLock like commitResolved
+	err = server.WriteLogger.Sync(seq)
+	if err != nil {
+		return seq, reads, fmt.Errorf("(Server) Failed to sync write log. Error: %w", err)
+	}
+	return seq, reads, nil
+}
+
+func (server *Server) logAndApplyTransaction(queued []commands.Command, w *watch) (uint64, []transactionRead, error) {
+	server.commitLock.Lock()
+	defer server.commitLock.Unlock()
+
+	broken, err := server.watchBroken(w)
+	if err != nil {
+		return 0, nil, err
+	}
+	if broken {
+		return 0, nil, fmt.Errorf("(Server) Not committing transaction. Error: %w", errWatchedKeyChanged)
+	}
+
+	// Keys written earlier in the transaction. Later commands read these rather than the StorageBackend
+	pending := make(map[string]transactionRead)
+	reads := make([]transactionRead, len(queued))
+	var writes []commands.Command
+
+	for i, command := range queued {
+		read, ok := pending[command.Key]
+		if !ok {
+			// Nothing else can write while commitLock is held so this can't change before the transaction is applied
+			entry, err := server.StorageBackend.GetEntry(command.Key)
+			if err != nil && !errors.Is(err, storagebackend.ErrKeyNotFound) {
+				return 0, nil, fmt.Errorf("(Server) Failed to read %s in transaction. Error: %w", command.Key, err)
+			}
+			read = transactionRead{entry: entry, exists: err == nil}
+		}
+		reads[i] = read
+
+		if command.Identifier == commands.GET_COMMAND {
+			continue
+		}
+		if command.ExpectedVersion != 0 && (!read.exists || read.written || read.entry.Version != command.ExpectedVersion) {
+			return 0, nil, fmt.Errorf("(Server) %s isn't at version %d. Error: %w", command.Key, command.ExpectedVersion, storagebackend.ErrConditionFailed)
+		}
+
+		if command.Identifier == commands.SET_COMMAND {
+			pending[command.Key] = transactionRead{entry: storagebackend.Entry{Value: command.Value}, exists: true, written: true}
+			writes = append(writes, commands.CreateSetCommand(command.Key, command.Value))
+		} else {
+			pending[command.Key] = transactionRead{written: true}
+			writes = append(writes, commands.CreateDeleteCommand(command.Key))
+		}
+	}
+
+	// Reads alone are consistent as nothing was written while commitLock was held
+	if len(writes) == 0 {
+		return 0, reads, nil
+	}
+
+	record := commands.CreateTransactionCommand(writes)
+	seq, err := server.WriteLogger.Append(record)
+	if err != nil {
+		return 0, nil, fmt.Errorf("(Server) Failed to log transaction. Nothing was applied. Error: %w", err)
+	}
+	record.Seq = seq
+
+	err = server.applyCommitted(record)
+	if err != nil {
+		// Already in the log so it will be applied on the next restart
+		return 0, nil, fmt.Errorf("(Server) Failed to apply logged transaction. Error: %w", err)
+	}
+
+	return seq, reads, nil
+}
@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+func runInSession(t *testing.T, server *Server, sess *session, command commands.Command) commands.Response {
+	response, handled := server.executeInSession(sess, command)
+	if !handled {
+		t.Fatalf("Expected %+v to be handled by the session", command)
+	}
+	return response
+}
+
+func TestTransactionIsLoggedAsOneRecord(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+	server.commit(commands.CreateSetCommand("existing", []byte("old")))
+	sess := newSession(nil, nil)
+
+	runInSession(t, server, sess, commands.Command{Identifier: commands.MULTI_COMMAND})
+	for _, command := range []commands.Command{
+		commands.CreateSetCommand("a", []byte("1")),
+		commands.CreateGetCommand("a"),
+		commands.CreateDeleteCommand("existing"),
+		commands.CreateGetCommand("existing"),
+	} {
+		response := runInSession(t, server, sess, command)
+		if response.ErrorCode != commands.NO_ERROR_ERROR_CODE || string(response.Message) != "QUEUED" {
+			t.Errorf("Expected %+v to be queued. Got %+v", command, response)
+		}
+	}
+	if _, err := server.StorageBackend.Get("a"); err == nil {
+		t.Error("Expected queued writes not to be applied before EXEC")
+	}
+
+	response := runInSession(t, server, sess, commands.Command{Identifier: commands.EXEC_COMMAND})
+	if response.ErrorCode != commands.NO_ERROR_ERROR_CODE {
+		t.Fatalf("Expected EXEC to succeed. Got %+v", response)
+	}
+	results, err := commands.DecodeList(response.Message)
+	if err != nil || len(results) != 4 {
+		t.Fatalf("Expected a result for each queued command. Got %q and err = %v", response.Message, err)
+	}
+	if string(results[1]) != "\x001" {
+		t.Errorf("Expected GET to see the SET queued before it. Got %q", results[1])
+	}
+	if results[3][0] != commands.NOT_FOUND_ERROR_CODE {
+		t.Errorf("Expected GET to see the DELETE queued before it. Got %q", results[3])
+	}
+
+	if len(writeLogger.logged) != 2 || writeLogger.logged[1].Identifier != commands.EXEC_COMMAND || len(writeLogger.logged[1].Batch) != 2 {
+		t.Fatalf("Expected the transaction's writes to be logged as one record. Got %+v", writeLogger.logged)
+	}
+
+	restarted := &Server{StorageBackend: &storagebackend.ShardedMapStorageBackend{}, WriteLogger: writeLogger}
+	err = restarted.Init()
+	if err != nil {
+		t.Fatalf("Failed to init server. Got err = %s", err)
+	}
+	value, err := restarted.StorageBackend.Get("a")
+	if err != nil || string(value) != "1" {
+		t.Errorf("Expected the transaction to be replayed. Got %q and err = %v", value, err)
+	}
+	if _, err := restarted.StorageBackend.Get("existing"); err == nil {
+		t.Error("Expected the transaction's DELETE to be replayed")
+	}
+}
+
+func TestTransactionWithStaleVersionWritesNothing(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+	server.commit(commands.CreateSetCommand("key", []byte("old")))
+	sess := newSession(nil, nil)
+
+	runInSession(t, server, sess, commands.Command{Identifier: commands.MULTI_COMMAND})
+	runInSession(t, server, sess, commands.CreateSetCommand("other", []byte("new")))
+	runInSession(t, server, sess, commands.Command{Identifier: commands.SET_COMMAND, Key: "key", Value: []byte("new"), ExpectedVersion: 1000})
+	response := runInSession(t, server, sess, commands.Command{Identifier: commands.EXEC_COMMAND})
+	if response.ErrorCode != commands.CONDITION_FAILED_ERROR_CODE {
+		t.Errorf("Expected EXEC to fail its condition. Got %+v", response)
+	}
+	if len(writeLogger.logged) != 1 {
+		t.Errorf("Expected nothing from the transaction to be logged. Got %+v", writeLogger.logged)
+	}
+	if _, err := server.StorageBackend.Get("other"); err == nil {
+		t.Error("Expected no write from the transaction to be applied")
+	}
+}
+
+func TestDiscardDropsQueuedCommands(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+	sess := newSession(nil, nil)
+
+	if response := runInSession(t, server, sess, commands.Command{Identifier: commands.DISCARD_COMMAND}); response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected DISCARD without MULTI to fail. Got %+v", response)
+	}
+
+	runInSession(t, server, sess, commands.Command{Identifier: commands.MULTI_COMMAND})
+	if response := runInSession(t, server, sess, commands.Command{Identifier: commands.MULTI_COMMAND}); response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected a nested MULTI to fail. Got %+v", response)
+	}
+	if response := runInSession(t, server, sess, commands.Command{Identifier: commands.INCR_COMMAND, Key: "key"}); response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected INCR to be rejected in a transaction. Got %+v", response)
+	}
+	runInSession(t, server, sess, commands.CreateSetCommand("key", []byte("value")))
+	runInSession(t, server, sess, commands.Command{Identifier: commands.DISCARD_COMMAND})
+
+	if _, handled := server.executeInSession(sess, commands.CreateGetCommand("key")); handled {
+		t.Error("Expected commands after DISCARD to run as normal")
+	}
+	if response := runInSession(t, server, sess, commands.Command{Identifier: commands.EXEC_COMMAND}); response.ErrorCode != commands.USER_ERROR_ERROR_CODE {
+		t.Errorf("Expected EXEC after DISCARD to fail. Got %+v", response)
+	}
+	if len(writeLogger.logged) != 0 {
+		t.Errorf("Expected nothing to be logged. Got %+v", writeLogger.logged)
+	}
+}
+
+func execWatched(t *testing.T, server *Server, sess *session, key string) commands.Response {
+	runInSession(t, server, sess, commands.Command{Identifier: commands.MULTI_COMMAND})
+	runInSession(t, server, sess, commands.CreateSetCommand(key, []byte("from transaction")))
+	return runInSession(t, server, sess, commands.Command{Identifier: commands.EXEC_COMMAND})
+}
+
+func TestWatchedKeyChangingAbortsTransaction(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		// Run before the keys are watched
+		setup  func(server *Server)
+		change func(server *Server)
+	}{
+		{"overwritten", nil, func(server *Server) { server.commit(commands.CreateSetCommand("key", []byte("other"))) }},
+		{"deleted", nil, func(server *Server) { server.commit(commands.CreateDeleteCommand("key")) }},
+		{"created and deleted again", nil, func(server *Server) {
+			server.commit(commands.CreateSetCommand("missing", []byte("other")))
+			server.commit(commands.CreateDeleteCommand("missing"))
+		}},
+		// Expiring doesn't commit a write so only the version check can catch it
+		{"expired", func(server *Server) {
+			server.commit(commands.CreateSetWithExpiryCommand("key", []byte("old"), time.Now().UnixMilli()+10))
+		}, func(server *Server) { time.Sleep(30 * time.Millisecond) }},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server, writeLogger := newTestServer(t)
+			server.commit(commands.CreateSetCommand("key", []byte("old")))
+			if test.setup != nil {
+				test.setup(server)
+			}
+			sess := newSession(nil, nil)
+
+			runInSession(t, server, sess, commands.Command{Identifier: commands.WATCH_COMMAND, Keys: []string{"key", "missing"}})
+			test.change(server)
+			logged := len(writeLogger.logged)
+
+			if response := execWatched(t, server, sess, "key"); response.ErrorCode != commands.CONDITION_FAILED_ERROR_CODE {
+				t.Errorf("Expected EXEC to fail as a watched key changed. Got %+v", response)
+			}
+			if len(writeLogger.logged) != logged {
+				t.Errorf("Expected nothing to be logged. Got %+v", writeLogger.logged[logged:])
+			}
+
+			// EXEC clears the watch so trying again succeeds
+			if response := execWatched(t, server, sess, "key"); response.ErrorCode != commands.NO_ERROR_ERROR_CODE {
+				t.Errorf("Expected EXEC to succeed once the watch is cleared. Got %+v", response)
+			}
+		})
+	}
+}
+
+func TestUnchangedOrUnwatchedKeysLetTransactionCommit(t *testing.T) {
+	server, _ := newTestServer(t)
+	server.commit(commands.CreateSetCommand("key", []byte("old")))
+	sess := newSession(nil, nil)
+
+	runInSession(t, server, sess, commands.Command{Identifier: commands.WATCH_COMMAND, Keys: []string{"key"}})
+	server.commit(commands.CreateSetCommand("unwatched", []byte("other")))
+	if response := execWatched(t, server, sess, "key"); response.ErrorCode != commands.NO_ERROR_ERROR_CODE {
+		t.Errorf("Expected EXEC to succeed when no watched key changed. Got %+v", response)
+	}
+
+	runInSession(t, server, sess, commands.Command{Identifier: commands.WATCH_COMMAND, Keys: []string{"key"}})
+	runInSession(t, server, sess, commands.Command{Identifier: commands.UNWATCH_COMMAND})
+	server.commit(commands.CreateSetCommand("key", []byte("other")))
+	if response := execWatched(t, server, sess, "key"); response.ErrorCode != commands.NO_ERROR_ERROR_CODE {
+		t.Errorf("Expected EXEC to succeed after UNWATCH. Got %+v", response)
+	}
+
+	if len(server.watchers) != 0 {
+		t.Errorf("Expected no watches to be left registered. Got %+v", server.watchers)
+	}
+}
@@ -0,0 +1,88 @@
+package internal
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+func getVersioned(t *testing.T, server *Server, key string) (uint64, string) {
+	response := server.execute(commands.Command{Identifier: commands.GET_COMMAND, Key: key, WithVersion: true})
+	if response.ErrorCode != commands.NO_ERROR_ERROR_CODE || len(response.Message) < commands.VERSION_SIZE {
+		t.Fatalf("Expected GET %s to respond with a version. Got %+v", key, response)
+	}
+	return binary.BigEndian.Uint64(response.Message), string(response.Message[commands.VERSION_SIZE:])
+}
+
+func TestVersionsGoUpWithEveryWrite(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+
+	set := commands.Command{Identifier: commands.SET_COMMAND, Key: "key", Value: []byte("a"), WithVersion: true}
+	response := server.execute(set)
+	first := binary.BigEndian.Uint64(response.Message)
+	version, value := getVersioned(t, server, "key")
+	if version != first || value != "a" {
+		t.Errorf("Expected GET to respond with the version SET did (%d). Got %d and %q", first, version, value)
+	}
+
+	server.execute(commands.Command{Identifier: commands.SET_COMMAND, Key: "other", Value: []byte("b")})
+	set.ExpectedVersion = first
+	set.Value = []byte("c")
+	response = server.execute(set)
+	if response.ErrorCode != commands.NO_ERROR_ERROR_CODE {
+		t.Fatalf("Expected SET at the current version to succeed. Got %+v", response)
+	}
+	second := binary.BigEndian.Uint64(response.Message)
+	if second <= first {
+		t.Errorf("Expected the version to go up. Went from %d to %d", first, second)
+	}
+
+	logged := len(writeLogger.logged)
+	set.Value = []byte("stale")
+	if response := server.execute(set); response.ErrorCode != commands.CONDITION_FAILED_ERROR_CODE {
+		t.Errorf("Expected SET at an old version to fail its condition. Got %+v", response)
+	}
+	deleteCommand := commands.Command{Identifier: commands.DELETE_COMMAND, Key: "key", ExpectedVersion: first}
+	if response := server.execute(deleteCommand); response.ErrorCode != commands.CONDITION_FAILED_ERROR_CODE {
+		t.Errorf("Expected DELETE at an old version to fail its condition. Got %+v", response)
+	}
+	if len(writeLogger.logged) != logged {
+		t.Errorf("Expected writes at an old version not to be logged. Got %+v", writeLogger.logged[logged:])
+	}
+
+	deleteCommand.ExpectedVersion = second
+	if response := server.execute(deleteCommand); response.ErrorCode != commands.NO_ERROR_ERROR_CODE {
+		t.Errorf("Expected DELETE at the current version to succeed. Got %+v", response)
+	}
+}
+
+func TestVersionsSurviveRestart(t *testing.T) {
+	server, writeLogger := newTestServer(t)
+	server.SnapshotPath = filepath.Join(t.TempDir(), "kv.snapshot")
+	server.commit(commands.CreateSetCommand("snapshotted", []byte("a")))
+	server.commit(commands.CreateSetCommand("other", []byte("b")))
+	// Compaction fails with the memory logger but the snapshot has already been written by then
+	server.snapshot()
+	server.commit(commands.CreateSetCommand("replayed", []byte("c")))
+	server.commit(commands.CreateExpireCommand("other", 0))
+
+	expected := map[string]uint64{}
+	for _, key := range []string{"snapshotted", "other", "replayed"} {
+		expected[key], _ = getVersioned(t, server, key)
+	}
+
+	restarted := &Server{StorageBackend: &storagebackend.SkipListStorageBackend{}, WriteLogger: writeLogger, SnapshotPath: server.SnapshotPath}
+	err := restarted.Init()
+	if err != nil {
+		t.Fatalf("Failed to init server. Got err = %s", err)
+	}
+	for key, version := range expected {
+		got, _ := getVersioned(t, restarted, key)
+		if got != version {
+			t.Errorf("Expected %s to be at version %d after restarting. Got %d", key, version, got)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+	storagebackend "github.com/willcruse/kvdb/server/v2/internal/storage-backend"
+)
+
+// Keys a connection is watching. EXEC fails if any of them changed after they were watched
+//
+// A write to a watched key marks the watch dirty as it's committed. That alone would miss keys that expire
+// so the version each key had when it was watched is checked again too. 0 means the key didn't exist
+type watch struct {
+	versions map[string]uint64
+	dirty    atomic.Bool
+}
+
+// Whether any watched key has changed. Must hold commitLock so nothing can change while the transaction is applied
+func (server *Server) watchBroken(w *watch) (bool, error) {
+	if w == nil {
+		return false, nil
+	}
+	if w.dirty.Load() {
+		return true, nil
+	}
+
+	for key, version := range w.versions {
+		current, err := server.currentVersion(key)
+		if err != nil {
+			return false, err
+		}
+		if current != version {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Version of the key or 0 if it doesn't exist
+func (server *Server) currentVersion(key string) (uint64, error) {
+	entry, err := server.StorageBackend.GetEntry(key)
+	if errors.Is(err, storagebackend.ErrKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("(Server) Failed to fetch version of %s. Error: %w", key, err)
+	}
+	return entry.Version, nil
+}
+
+// Adds keys to the session's watch, recording their current versions
+func (server *Server) watchKeys(sess *session, keys []string) error {
+	if sess.watch == nil {
+		sess.watch = &watch{versions: make(map[string]uint64)}
+	}
+
+	// Registered before the versions are read so a write in between is caught by one or the other
+	server.watchLock.Lock()
+	if server.watchers == nil {
+		server.watchers = make(map[string]map[*watch]struct{})
+	}
+	for _, key := range keys {
+		if server.watchers[key] == nil {
+			server.watchers[key] = make(map[*watch]struct{})
+		}
+		server.watchers[key][sess.watch] = struct{}{}
+	}
+	server.watchLock.Unlock()
+
+	for _, key := range keys {
+		if _, ok := sess.watch.versions[key]; ok {
+			continue
+		}
+		version, err := server.currentVersion(key)
+		if err != nil {
+			return err
+		}
+		sess.watch.versions[key] = version
+	}
+	return nil
+}
+
+// Stops watching every key the session watches
+func (server *Server) unwatch(sess *session) {
+	if sess.watch == nil {
+		return
+	}
+
+	server.watchLock.Lock()
+	for key := range sess.watch.versions {
+		delete(server.watchers[key], sess.watch)
+		if len(server.watchers[key]) == 0 {
+			delete(server.watchers, key)
+		}
+	}
+	server.watchLock.Unlock()
+
+	sess.watch = nil
+}
+
+// Marks every watch on a key the command writes as dirty. Called as the command is committed
+func (server *Server) touchWatched(command commands.Command) {
+	server.watchLock.RLock()
+	defer server.watchLock.RUnlock()
+
+	if len(server.watchers) == 0 {
+		return
+	}
+	for _, key := range commands.WrittenKeys(command) {
+		for w := range server.watchers[key] {
+			w.dirty.Store(true)
+		}
+	}
+}
+
+// Runs WATCH and UNWATCH for the session
+func (server *Server) executeWatch(sess *session, command commands.Command) commands.Response {
+	if command.Identifier == commands.UNWATCH_COMMAND {
+		server.unwatch(sess)
+		return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE}
+	}
+
+	if sess.transaction != nil {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "WATCH can't be used in a transaction")
+	}
+	if len(command.Keys) == 0 {
+		return commands.ErrorResponse(commands.USER_ERROR_ERROR_CODE, "at least one key is needed")
+	}
+
+	// Writes sent before WATCH finish first so they don't break the watch
+	sess.wait()
+	err := server.watchKeys(sess, command.Keys)
+	if err != nil {
+		log.Printf("handler_net_conn: Error watching keys %v\n", err)
+		return commands.ErrorResponse(commands.SERVER_ERROR_ERROR_CODE, "failed to watch %d keys", len(command.Keys))
+	}
+	return commands.Response{ErrorCode: commands.NO_ERROR_ERROR_CODE}
+}
@@ -0,0 +1,63 @@
+package writelogger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Implemented by loggers that can copy themselves while records are still being appended
+type BackupWriteLogger interface {
+	WriteOperationLogger
+	// Calls fn with the name, size and contents of each file making up the log as it is now
+	// Writing the files to a directory gives a log holding every record up to the returned sequence number
+	Backup(fn func(name string, size int64, contents io.Reader) error) (uint64, error)
+}
+
+// Copies the live segments then the MANIFEST
+//
+// Appends, rotation and compaction carry on while it copies. The segments are opened and their sizes taken
+// in one go under lock so later records are left out and segments compacted away part way through can still be read.
+func (sdl *SegmentedDiskLogger) Backup(fn func(name string, size int64, contents io.Reader) error) (uint64, error) {
+	sdl.lock.Lock()
+	segments := sdl.segments
+	lastSeq := sdl.lastSeq
+	sizes := make([]int64, len(segments))
+	files := make([]*os.File, 0, len(segments))
+	var err error
+	for i, seg := range segments {
+		sizes[i] = seg.size
+		var file *os.File
+		file, err = os.Open(seg.path)
+		if err != nil {
+			err = fmt.Errorf("(SegmentedDiskLogger) Failed to open segment %s for backup. Error: %w", seg.path, err)
+			break
+		}
+		files = append(files, file)
+	}
+	sdl.lock.Unlock()
+
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, seg := range segments {
+		err = fn(segmentFileName(seg.id), sizes[i], io.NewSectionReader(files[i], 0, sizes[i]))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	manifest := encodeManifest(segments)
+	err = fn(MANIFEST_FILE_NAME, int64(len(manifest)), strings.NewReader(manifest))
+	if err != nil {
+		return 0, err
+	}
+	return lastSeq, nil
+}
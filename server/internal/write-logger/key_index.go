@@ -0,0 +1,196 @@
+package writelogger
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+)
+
+// Implemented by loggers that index the records that wrote each key so its earlier values can be read back from the log
+type HistoryWriteLogger interface {
+	WriteOperationLogger
+	// Calls fn with each write to key logged at or before loggedBy (Unix milliseconds), newest first, until fn returns false
+	// Returns true if fn was called with every write and the log still holds every record since the first,
+	// so the key was never written before the oldest write fn was called with
+	KeyHistory(key string, loggedBy int64, fn func(write KeyWrite) bool) (bool, error)
+}
+
+// One logged change to a key
+type KeyWrite struct {
+	Seq uint64
+	// Unix milliseconds. 0 if it was logged before the write log held timestamps
+	LoggedAt int64
+	// The SET, DELETE, SETEX, EXPIRE or PERSIST of the key
+	// Writes to the key by MSET, MDEL or a transaction are split out of their record
+	Command commands.Command
+}
+
+// Where a record that wrote a key is in the log
+type recordLocation struct {
+	segmentID uint64
+	offset    int64
+	loggedAt  int64
+}
+
+// Where a key's writes are in the live segments, oldest first
+type keyIndexEntry struct {
+	// Only ever appended to or replaced with a copy so KeyHistory can read it without holding lock
+	locations []recordLocation
+	// Whether older writes were forgotten to keep it under MaxKeyHistory
+	trimmed bool
+}
+
+// Adds the record's location to every key it writes. Caller must hold lock
+func (sdl *SegmentedDiskLogger) indexRecord(command commands.Command, seg *segment, offset int64, loggedAt int64) {
+	location := recordLocation{segmentID: seg.id, offset: offset, loggedAt: loggedAt}
+	for _, key := range commands.WrittenKeys(command) {
+		history := sdl.keyIndex[key]
+		// A transaction can write the same key more than once
+		if len(history.locations) > 0 && history.locations[len(history.locations)-1] == location {
+			continue
+		}
+		history.locations = append(history.locations, location)
+		// Trimmed in bulk so a key written over and over isn't copied on every write
+		if len(history.locations) > 2*sdl.MaxKeyHistory {
+			history.locations = slices.Clone(history.locations[len(history.locations)-sdl.MaxKeyHistory:])
+			history.trimmed = true
+		}
+		sdl.keyIndex[key] = history
+
+		if seg.indexedKeys == nil {
+			seg.indexedKeys = make(map[string]struct{})
+		}
+		seg.indexedKeys[key] = struct{}{}
+	}
+}
+
+// Forgets the records in the dropped segments, which are every segment before firstID
+// Only the keys those segments wrote are visited. Caller must hold lock
+func (sdl *SegmentedDiskLogger) unindexSegments(dropped []*segment, firstID uint64) {
+	for _, seg := range dropped {
+		for key := range seg.indexedKeys {
+			history, ok := sdl.keyIndex[key]
+			if !ok {
+				continue
+			}
+			drop := 0
+			for drop < len(history.locations) && history.locations[drop].segmentID < firstID {
+				drop++
+			}
+			if drop == len(history.locations) {
+				delete(sdl.keyIndex, key)
+			} else if drop > 0 {
+				// Copied so the dropped locations aren't kept alive by the backing array
+				history.locations = slices.Clone(history.locations[drop:])
+				sdl.keyIndex[key] = history
+			}
+		}
+		seg.indexedKeys = nil
+	}
+}
+
+// Reads each record from disk as it's visited so only the index is held in memory
+// A segment compacted away part way through ends the history early
+func (sdl *SegmentedDiskLogger) KeyHistory(key string, loggedBy int64, fn func(write KeyWrite) bool) (bool, error) {
+	sdl.lock.Lock()
+	history := sdl.keyIndex[key]
+	locations := history.locations
+	segments := sdl.segments
+	complete := len(segments) > 0 && segments[0].baseSeq == 0 && !history.trimmed
+	sdl.lock.Unlock()
+
+	reader := recordReader{segments: segments, files: make(map[uint64]*os.File)}
+	defer reader.close()
+
+	for i := len(locations) - 1; i >= 0; i-- {
+		if locations[i].loggedAt > loggedBy {
+			continue
+		}
+
+		command, err := reader.read(locations[i])
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		write, ok := keyWrite(command, key)
+		if !ok {
+			return false, fmt.Errorf("(SegmentedDiskLogger) Record %d is indexed under %s but doesn't write it. Error: %w", command.Seq, key, ErrCorruptLog)
+		}
+		if !fn(KeyWrite{Seq: command.Seq, LoggedAt: command.LoggedAt, Command: write}) {
+			return false, nil
+		}
+	}
+
+	return complete, nil
+}
+
+// Reads records by location, keeping each segment it reads from open until close
+type recordReader struct {
+	segments []*segment
+	files    map[uint64]*os.File
+}
+
+func (rr *recordReader) read(location recordLocation) (commands.Command, error) {
+	index := slices.IndexFunc(rr.segments, func(seg *segment) bool { return seg.id == location.segmentID })
+	if index == -1 {
+		return commands.Command{}, fmt.Errorf("(SegmentedDiskLogger) Segment %d is no longer live. Error: %w", location.segmentID, os.ErrNotExist)
+	}
+	seg := rr.segments[index]
+
+	file, ok := rr.files[seg.id]
+	if !ok {
+		var err error
+		file, err = os.Open(seg.path)
+		if err != nil {
+			return commands.Command{}, fmt.Errorf("(SegmentedDiskLogger) Failed to open segment %s. Error: %w", seg.path, err)
+		}
+		rr.files[seg.id] = file
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(file, location.offset, math.MaxInt64-location.offset))
+	_, command, _, err := readRecord(reader, seg.formatVersion)
+	if err != nil {
+		return command, fmt.Errorf("(SegmentedDiskLogger) Failed to read record at offset %d of %s. Error: %w", location.offset, seg.path, err)
+	}
+	return command, nil
+}
+
+func (rr *recordReader) close() {
+	for _, file := range rr.files {
+		file.Close()
+	}
+}
+
+// The part of a record that wrote key. The last part if the record writes it more than once
+func keyWrite(command commands.Command, key string) (commands.Command, bool) {
+	var write commands.Command
+	found := false
+	switch command.Identifier {
+	case commands.MSET_COMMAND:
+		for i, written := range command.Keys {
+			if written == key {
+				write, found = commands.CreateSetCommand(key, command.Values[i]), true
+			}
+		}
+	case commands.MDEL_COMMAND:
+		write, found = commands.CreateDeleteCommand(key), slices.Contains(command.Keys, key)
+	case commands.EXEC_COMMAND:
+		for _, batched := range command.Batch {
+			if batched.Key == key {
+				write, found = batched, true
+			}
+		}
+	default:
+		write, found = command, command.Key == key
+	}
+	return write, found
+}
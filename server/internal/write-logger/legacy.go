@@ -0,0 +1,193 @@
+package writelogger
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+)
+
+// Makes a single file write log written before the log was split into segments the first segment of a new log in dir
+//
+// A binary log has the same header as a segment so it's copied as it is. A log in the text format used before the binary
+// format is converted, with every record logged at the old file's modification time. The old file is left where it was.
+// The segment is written under a temporary name and the manifest is written last, so if it fails part way
+// dir has no write log and the import can be run again. Fails if dir already has a write log
+func ImportLegacyLog(legacyPath string, dir string) error {
+	_, err := readManifest(dir)
+	if err == nil {
+		return fmt.Errorf("(SegmentedDiskLogger) %s already has a write log", dir)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	legacy, err := os.Open(legacyPath)
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to open %s. Error: %w", legacyPath, err)
+	}
+	defer legacy.Close()
+	info, err := legacy.Stat()
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to stat %s. Error: %w", legacyPath, err)
+	}
+
+	isText, err := isTextLog(legacy, info.Size())
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to read %s. Error: %w", legacyPath, err)
+	}
+	copyLog := func(dest io.Writer) error {
+		_, err := io.Copy(dest, legacy)
+		return err
+	}
+	if isText {
+		loggedAt := info.ModTime().UnixMilli()
+		copyLog = func(dest io.Writer) error {
+			return convertTextLog(legacy, legacyPath, loggedAt, dest)
+		}
+	} else {
+		_, _, err = readHeader(legacy, legacyPath)
+		if err != nil {
+			return fmt.Errorf("(SegmentedDiskLogger) Can't import %s. Error: %w", legacyPath, err)
+		}
+	}
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to create %s. Error: %w", dir, err)
+	}
+	path := filepath.Join(dir, segmentFileName(1))
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to create %s. Error: %w", tmpPath, err)
+	}
+	defer os.Remove(tmpPath)
+
+	err = copyLog(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to copy %s to %s. Error: %w", legacyPath, tmpPath, err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to move %s into place at %s. Error: %w", tmpPath, path, err)
+	}
+	seg, err := openSegment(dir, 1)
+	if err != nil {
+		return err
+	}
+	return writeManifest(dir, []*segment{seg})
+}
+
+// Whether file holds a log in the text format. An empty file is a text log nothing was written to
+func isTextLog(file *os.File, size int64) (bool, error) {
+	if size == 0 {
+		return true, nil
+	}
+	start := make([]byte, len("DELETE\n"))
+	n, err := file.ReadAt(start, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	start = start[:n]
+	return bytes.HasPrefix(start, []byte("SET\n")) || bytes.HasPrefix(start, []byte("DELETE\n")), nil
+}
+
+// Writes the writes in a text format log to dest as a segment with base sequence number 0
+//
+// Each write is its name on a line of its own followed by its key and, for SET, its value.
+// Keys and values are written as '<length in bytes> <bytes>\n' so they're read by length in case they hold a newline
+func convertTextLog(legacy io.Reader, legacyPath string, loggedAt int64, dest io.Writer) error {
+	reader := bufio.NewReader(legacy)
+	writer := bufio.NewWriter(dest)
+	_, err := writer.Write(encodeHeader(0))
+	if err != nil {
+		return err
+	}
+
+	for seq := uint64(1); ; seq++ {
+		command, err := readTextRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("(SegmentedDiskLogger) Failed to read write %d of text log %s. Error: %w", seq, legacyPath, err)
+		}
+
+		record, err := encodeRecord(seq, loggedAt, command)
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+// Returns io.EOF if the log ends cleanly between writes
+func readTextRecord(reader *bufio.Reader) (commands.Command, error) {
+	name, err := reader.ReadString('\n')
+	if err == io.EOF && name == "" {
+		return commands.Command{}, io.EOF
+	}
+	if err != nil {
+		return commands.Command{}, fmt.Errorf("write cut short. Error: %w", ErrCorruptLog)
+	}
+
+	switch name {
+	case "SET\n":
+		key, err := readTextField(reader)
+		if err != nil {
+			return commands.Command{}, err
+		}
+		value, err := readTextField(reader)
+		if err != nil {
+			return commands.Command{}, err
+		}
+		return commands.CreateSetCommand(string(key), value), nil
+	case "DELETE\n":
+		key, err := readTextField(reader)
+		if err != nil {
+			return commands.Command{}, err
+		}
+		return commands.CreateDeleteCommand(string(key)), nil
+	default:
+		return commands.Command{}, fmt.Errorf("expected SET or DELETE got %q. Error: %w", name, ErrCorruptLog)
+	}
+}
+
+func readTextField(reader *bufio.Reader) ([]byte, error) {
+	lengthField, err := reader.ReadString(' ')
+	if err != nil {
+		return nil, fmt.Errorf("write cut short. Error: %w", ErrCorruptLog)
+	}
+	length, err := strconv.Atoi(lengthField[:len(lengthField)-1])
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("expected a length got %q. Error: %w", lengthField, ErrCorruptLog)
+	}
+
+	// Read as it arrives rather than allocated up front in case the length is damaged
+	var field bytes.Buffer
+	_, err = io.CopyN(&field, reader, int64(length)+1)
+	if err != nil || field.Bytes()[length] != '\n' {
+		return nil, fmt.Errorf("field of length %d cut short. Error: %w", length, ErrCorruptLog)
+	}
+	return field.Bytes()[:length], nil
+}
@@ -0,0 +1,104 @@
+package writelogger
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Lists the live segments of the write log oldest first
+//
+// Manifest layout
+//
+//	KVMANIFEST 1
+//	wal-00000001.log
+//	wal-00000002.log
+//
+// The manifest is always replaced whole with a rename so it's never seen half written.
+// Segment files in the directory that it doesn't list are left over from a crash part way through rotating or compacting.
+const (
+	MANIFEST_FILE_NAME = "MANIFEST"
+	manifestHeader     = "KVMANIFEST 1"
+)
+
+// Returns the ids of the live segments. Returns an error wrapping os.ErrNotExist if there is no manifest
+func readManifest(dir string) ([]uint64, error) {
+	path := filepath.Join(dir, MANIFEST_FILE_NAME)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("(SegmentedDiskLogger) Failed to open manifest %s. Error: %w", path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	if !scanner.Scan() || scanner.Text() != manifestHeader {
+		return nil, fmt.Errorf("(SegmentedDiskLogger) %s is not a write log manifest. Error: %w", path, ErrCorruptLog)
+	}
+
+	var ids []uint64
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		id, ok := parseSegmentFileName(line)
+		if !ok {
+			return nil, fmt.Errorf("(SegmentedDiskLogger) Unexpected entry '%s' in manifest %s. Error: %w", line, path, ErrCorruptLog)
+		}
+		if len(ids) > 0 && id <= ids[len(ids)-1] {
+			return nil, fmt.Errorf("(SegmentedDiskLogger) Segment %s is out of order in manifest %s. Error: %w", line, path, ErrCorruptLog)
+		}
+		ids = append(ids, id)
+	}
+	if scanner.Err() != nil {
+		return nil, fmt.Errorf("(SegmentedDiskLogger) Failed to read manifest %s. Error: %w", path, scanner.Err())
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("(SegmentedDiskLogger) Manifest %s lists no segments. Error: %w", path, ErrCorruptLog)
+	}
+
+	return ids, nil
+}
+
+func encodeManifest(segments []*segment) string {
+	var contents strings.Builder
+	contents.WriteString(manifestHeader + "\n")
+	for _, seg := range segments {
+		contents.WriteString(segmentFileName(seg.id) + "\n")
+	}
+	return contents.String()
+}
+
+// Atomically replaces the manifest with one listing segments
+func writeManifest(dir string, segments []*segment) error {
+
+	path := filepath.Join(dir, MANIFEST_FILE_NAME)
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to create %s. Error: %w", tmpPath, err)
+	}
+	defer os.Remove(tmpPath)
+
+	_, err = file.WriteString(encodeManifest(segments))
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to write %s. Error: %w", tmpPath, err)
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to move manifest into place at %s. Error: %w", path, err)
+	}
+	SyncDir(dir)
+
+	return nil
+}
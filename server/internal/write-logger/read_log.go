@@ -0,0 +1,56 @@
+package writelogger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+)
+
+// Streams every record of the segmented write log in dir oldest first to fn without changing anything on disk
+//
+// Unlike Init and Replay an incomplete final record is skipped rather than truncated and segments left over
+// from a crash aren't deleted, so it's safe to read a copy of a data directory or one a running server is using.
+// Records appended while it's reading may or may not be seen and a segment compacted away part way through
+// fails the read. Stops and returns the error if fn fails.
+// Returns an error wrapping os.ErrNotExist if there is no write log in dir
+func ReadLog(dir string, fn func(command commands.Command) error) error {
+	ids, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+
+	var segments []*segment
+	for _, id := range ids {
+		seg, err := openSegment(dir, id)
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("(SegmentedDiskLogger) Segment %s is in the manifest but missing from %s. Error: %w", segmentFileName(id), dir, ErrCorruptLog)
+		}
+		if err != nil {
+			return err
+		}
+		segments = append(segments, seg)
+	}
+
+	lastSeq := segments[0].baseSeq
+	for i, seg := range segments {
+		if seg.baseSeq != lastSeq {
+			return fmt.Errorf("(SegmentedDiskLogger) Segment %s starts after sequence number %d but the segment before it ends at %d. Error: %w", seg.path, seg.baseSeq, lastSeq, ErrCorruptLog)
+		}
+
+		tornTail := rejectTornTail
+		if i == len(segments)-1 {
+			tornTail = ignoreTornTail
+		}
+
+		lastSeq, err = seg.replay(tornTail, func(command commands.Command, offset int64, recordSize int64) error {
+			return fn(command)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
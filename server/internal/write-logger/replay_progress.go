@@ -0,0 +1,64 @@
+package writelogger
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// How often Replay logs how far through the log it's got
+const REPLAY_PROGRESS_INTERVAL = 5 * time.Second
+
+type replayProgress struct {
+	totalBytes int64
+	start      time.Time
+	lastLogged time.Time
+	records    uint64
+	bytes      int64
+}
+
+func newReplayProgress(totalBytes int64) *replayProgress {
+	now := time.Now()
+	return &replayProgress{totalBytes: totalBytes, start: now, lastLogged: now}
+}
+
+// Called once per record with its size on disk
+func (rp *replayProgress) record(size int64) {
+	rp.records++
+	rp.bytes += size
+
+	if time.Since(rp.lastLogged) >= REPLAY_PROGRESS_INTERVAL {
+		rp.lastLogged = time.Now()
+		log.Printf("(SegmentedDiskLogger) Replaying write log. %s\n", rp)
+	}
+}
+
+func (rp *replayProgress) done() {
+	log.Printf("(SegmentedDiskLogger) Replayed write log in %s. %s\n", time.Since(rp.start).Round(time.Microsecond), rp)
+}
+
+func (rp *replayProgress) String() string {
+	elapsed := time.Since(rp.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(rp.records) / elapsed
+	}
+	return fmt.Sprintf("%d records, %s of %s at %.0f records/sec", rp.records, formatBytes(rp.bytes), formatBytes(rp.totalBytes), rate)
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	value := float64(bytes)
+	suffixes := []string{"KiB", "MiB", "GiB", "TiB"}
+	suffix := ""
+	for _, suffix = range suffixes {
+		value /= unit
+		if value < unit {
+			break
+		}
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
@@ -0,0 +1,578 @@
+package writelogger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+)
+
+// Segment file layout
+//
+// Header
+// | Magic "KVWL" (4) | Format Version (2) | Reserved (2) | Base Sequence Number (8) |
+//
+// Followed by any number of records
+// | Body Length (4) | CRC32C of Body (4) | Body (n) |
+//
+// Record body
+// | Sequence Number (8) | Logged At (8) | Opcode (1) | Key Length (4) | Key (n) | Value Length (4) | Value (n) |
+//
+// All integers are big endian. Logged At is when the record was appended in Unix milliseconds. It never goes backwards
+// from one record to the next even if the clock does. Format version 1 records have no Logged At and can still be replayed. Opcodes are the commands package command values.
+// SETEX and EXPIRE records put the absolute expiry (Unix milliseconds, 8 bytes) in front of the value.
+// MSET and MDEL records have an empty key. Their value is a commands.EncodeList list of each key, followed by its value for MSET.
+// EXEC records hold a whole transaction so it's replayed all or nothing. They have an empty key and their value is a list
+// of each write's opcode (1 byte), key and value in the order they were queued.
+// Sequence numbers start at base + 1 and go up by one per record.
+// A segment's base is the sequence number of the last record in the segment before it.
+const (
+	BINARY_LOG_MAGIC          = "KVWL"
+	BINARY_LOG_FORMAT_VERSION = 2
+
+	// Oldest format version that can still be replayed. Its records have no Logged At
+	untimestampedFormatVersion = 1
+
+	binaryLogHeaderSize       = 16
+	binaryRecordHeaderSize    = 8
+	binaryRecordBodyFixedSize = 8 + loggedAtSize + 1 + 4 + 4
+	loggedAtSize              = 8
+	expiresAtSize             = 8
+
+	segmentFilePrefix = "wal-"
+	segmentFileSuffix = ".log"
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrCorruptLog = errors.New("write log is corrupt")
+
+// One numbered file of the write log
+type segment struct {
+	id      uint64
+	path    string
+	baseSeq uint64
+	size    int64
+	// Format version of the segment's records. Only the current version is appended to
+	formatVersion uint16
+	// Only open for the active segment
+	file *os.File
+	// Keys written by the segment's records so they can be dropped from the key index when it's compacted away
+	indexedKeys map[string]struct{}
+}
+
+func segmentFileName(id uint64) string {
+	return fmt.Sprintf("%s%08d%s", segmentFilePrefix, id, segmentFileSuffix)
+}
+
+func parseSegmentFileName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, segmentFilePrefix) || !strings.HasSuffix(name, segmentFileSuffix) {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentFilePrefix), segmentFileSuffix), 10, 64)
+	return id, err == nil
+}
+
+// Creates an empty segment and fsyncs its header so it's complete before the manifest names it
+func createSegment(dir string, id uint64, baseSeq uint64) (*segment, error) {
+	path := filepath.Join(dir, segmentFileName(id))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("(SegmentedDiskLogger) Failed to create segment %s. Error: %w", path, err)
+	}
+
+	_, err = file.Write(encodeHeader(baseSeq))
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, fmt.Errorf("(SegmentedDiskLogger) Failed to write header to %s. Error: %w", path, err)
+	}
+
+	return &segment{id: id, path: path, baseSeq: baseSeq, size: binaryLogHeaderSize, formatVersion: BINARY_LOG_FORMAT_VERSION, file: file}, nil
+}
+
+// Checks the header of an existing segment without opening it for appends
+func openSegment(dir string, id uint64) (*segment, error) {
+	path := filepath.Join(dir, segmentFileName(id))
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("(SegmentedDiskLogger) Failed to open segment %s. Error: %w", path, err)
+	}
+	defer file.Close()
+
+	baseSeq, formatVersion, err := readHeader(file, path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("(SegmentedDiskLogger) Failed to stat %s. Error: %w", path, err)
+	}
+
+	return &segment{id: id, path: path, baseSeq: baseSeq, size: info.Size(), formatVersion: formatVersion}, nil
+}
+
+func (s *segment) openForAppend() error {
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to open %s for appending. Error: %w", s.path, err)
+	}
+	s.file = file
+	return nil
+}
+
+func (s *segment) close() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to close %s. Error: %w", s.path, err)
+	}
+	return nil
+}
+
+func (s *segment) isEmpty() bool {
+	return s.size <= binaryLogHeaderSize
+}
+
+func encodeHeader(baseSeq uint64) []byte {
+	header := make([]byte, binaryLogHeaderSize)
+	copy(header, BINARY_LOG_MAGIC)
+	binary.BigEndian.PutUint16(header[4:], BINARY_LOG_FORMAT_VERSION)
+	binary.BigEndian.PutUint64(header[8:], baseSeq)
+	return header
+}
+
+// Checks the header and returns the base sequence number and format version
+func readHeader(file *os.File, path string) (uint64, uint16, error) {
+	header := make([]byte, binaryLogHeaderSize)
+	_, err := file.ReadAt(header, 0)
+	if err == io.EOF {
+		return 0, 0, fmt.Errorf("(SegmentedDiskLogger) %s is too short to be a write log segment. Error: %w", path, ErrCorruptLog)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("(SegmentedDiskLogger) Failed to read header of %s. Error: %w", path, err)
+	}
+
+	if string(header[:4]) != BINARY_LOG_MAGIC {
+		return 0, 0, fmt.Errorf("(SegmentedDiskLogger) %s is not a write log segment. Error: %w", path, ErrCorruptLog)
+	}
+
+	version := binary.BigEndian.Uint16(header[4:])
+	if version < untimestampedFormatVersion || version > BINARY_LOG_FORMAT_VERSION {
+		return 0, 0, fmt.Errorf("(SegmentedDiskLogger) %s has unsupported format version %d", path, version)
+	}
+
+	return binary.BigEndian.Uint64(header[8:]), version, nil
+}
+
+// What segment.replay does with an incomplete record at the end of a segment
+type tornTailPolicy int
+
+const (
+	// Fails with ErrCorruptLog. Used for every segment but the active one
+	rejectTornTail tornTailPolicy = iota
+	// Drops it from the file so the segment can be appended to
+	truncateTornTail
+	// Skips it and leaves the file as it is
+	ignoreTornTail
+)
+
+// Streams every record in the segment to fn along with its offset and size on disk and returns the last sequence number read
+//
+// A crash part way through appending leaves an incomplete record at the end of the active segment.
+// That record was never acknowledged so tornTail decides whether it's dropped or fails the replay.
+// A bad record anywhere else means the log is damaged and replay fails with ErrCorruptLog. See isTornRecord
+func (s *segment) replay(tornTail tornTailPolicy, fn func(command commands.Command, offset int64, recordSize int64) error) (uint64, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return 0, fmt.Errorf("(SegmentedDiskLogger) Failed to open segment %s. Error: %w", s.path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("(SegmentedDiskLogger) Failed to stat %s. Error: %w", s.path, err)
+	}
+	fileSize := info.Size()
+
+	reader := bufio.NewReader(io.NewSectionReader(file, binaryLogHeaderSize, fileSize-binaryLogHeaderSize))
+	offset := int64(binaryLogHeaderSize)
+	expectedSeq := s.baseSeq + 1
+
+	for offset < fileSize {
+		seq, command, recordSize, err := readRecord(reader, s.formatVersion)
+		torn := err != nil && s.isTornRecord(file, offset, fileSize, expectedSeq)
+		if torn && tornTail == truncateTornTail {
+			log.Printf("(SegmentedDiskLogger) Dropping incomplete record at the end of %s. Offset %d. Error: %v\n", s.path, offset, err)
+			err = os.Truncate(s.path, offset)
+			if err != nil {
+				return 0, fmt.Errorf("(SegmentedDiskLogger) Failed to truncate incomplete record from %s. Error: %w", s.path, err)
+			}
+			break
+		}
+		if torn && tornTail == ignoreTornTail {
+			log.Printf("(SegmentedDiskLogger) Ignoring incomplete record at the end of %s. Offset %d. Error: %v\n", s.path, offset, err)
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			err = fmt.Errorf("%w. Error: %w", err, ErrCorruptLog)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("(SegmentedDiskLogger) Failed to read record at offset %d of %s. Error: %w", offset, s.path, err)
+		}
+
+		if seq != expectedSeq {
+			return 0, fmt.Errorf("(SegmentedDiskLogger) Expected sequence number %d at offset %d of %s got %d. Error: %w", expectedSeq, offset, s.path, seq, ErrCorruptLog)
+		}
+
+		err = fn(command, offset, recordSize)
+		if err != nil {
+			return 0, err
+		}
+		offset += recordSize
+		expectedSeq++
+	}
+
+	s.size = offset
+	return expectedSeq - 1, nil
+}
+
+// Whether the bad record at offset is the last thing written and was cut short by a crash rather than damaged
+//
+// Records are appended in a single write so a crash can only cut off the end of the last one. It's only
+// treated as torn if its header is cut short, or its header's length runs past the end of the file and the
+// part of its body that was written agrees with that length. Anything else, e.g. a damaged length in the
+// middle of the segment, would throw away complete records if it was truncated.
+func (s *segment) isTornRecord(file *os.File, offset int64, fileSize int64, expectedSeq uint64) bool {
+	if fileSize-offset < binaryRecordHeaderSize {
+		return true
+	}
+
+	recordHeader := make([]byte, binaryRecordHeaderSize)
+	_, err := file.ReadAt(recordHeader, offset)
+	if err != nil {
+		return false
+	}
+	bodyLength := binary.BigEndian.Uint32(recordHeader)
+	fixedSize := recordBodyFixedSize(s.formatVersion)
+	if bodyLength < fixedSize || offset+binaryRecordHeaderSize+int64(bodyLength) <= fileSize {
+		return false
+	}
+
+	written := make([]byte, fileSize-offset-binaryRecordHeaderSize)
+	_, err = file.ReadAt(written, offset+binaryRecordHeaderSize)
+	if err != nil {
+		return false
+	}
+	if len(written) >= 8 && binary.BigEndian.Uint64(written) != expectedSeq {
+		return false
+	}
+
+	// The key and value lengths give the body length the record was written with
+	keyLengthAt := int(fixedSize) - 2*commands.LENGTH_PREFIX_SIZE
+	if len(written) < keyLengthAt+commands.LENGTH_PREFIX_SIZE {
+		return true
+	}
+	keyLength := binary.BigEndian.Uint32(written[keyLengthAt:])
+	valueLengthAt := uint64(keyLengthAt) + commands.LENGTH_PREFIX_SIZE + uint64(keyLength)
+	if uint64(len(written)) < valueLengthAt+commands.LENGTH_PREFIX_SIZE {
+		return true
+	}
+	valueLength := binary.BigEndian.Uint32(written[valueLengthAt:])
+	return uint64(fixedSize)+uint64(keyLength)+uint64(valueLength) == uint64(bodyLength)
+}
+
+// Returns the record's size on disk alongside its contents so the caller can track offsets
+// A record cut short returns an error wrapping io.ErrUnexpectedEOF and one that fails its checksum wraps ErrCorruptLog
+func readRecord(reader *bufio.Reader, formatVersion uint16) (uint64, commands.Command, int64, error) {
+	var command commands.Command
+
+	recordHeader := make([]byte, binaryRecordHeaderSize)
+	_, err := io.ReadFull(reader, recordHeader)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, command, 0, fmt.Errorf("(SegmentedDiskLogger) Failed to read record header. Error: %w", err)
+	}
+
+	bodyLength := binary.BigEndian.Uint32(recordHeader)
+	checksum := binary.BigEndian.Uint32(recordHeader[4:])
+	recordSize := int64(binaryRecordHeaderSize) + int64(bodyLength)
+
+	if bodyLength < recordBodyFixedSize(formatVersion) {
+		return 0, command, recordSize, fmt.Errorf("(SegmentedDiskLogger) Record body of %d bytes is too short. Error: %w", bodyLength, ErrCorruptLog)
+	}
+
+	body := make([]byte, bodyLength)
+	_, err = io.ReadFull(reader, body)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, command, recordSize, fmt.Errorf("(SegmentedDiskLogger) Failed to read record body. Error: %w", err)
+	}
+
+	if crc32.Checksum(body, castagnoliTable) != checksum {
+		return 0, command, recordSize, fmt.Errorf("(SegmentedDiskLogger) Record checksum mismatch. Error: %w", ErrCorruptLog)
+	}
+
+	seq, command, err := decodeRecordBody(body, formatVersion)
+	return seq, command, recordSize, err
+}
+
+func recordBodyFixedSize(formatVersion uint16) uint32 {
+	if formatVersion == untimestampedFormatVersion {
+		return binaryRecordBodyFixedSize - loggedAtSize
+	}
+	return binaryRecordBodyFixedSize
+}
+
+// body must be at least recordBodyFixedSize bytes
+func decodeRecordBody(body []byte, formatVersion uint16) (uint64, commands.Command, error) {
+	var command commands.Command
+
+	seq := binary.BigEndian.Uint64(body)
+	body = body[8:]
+	var loggedAt int64
+	if formatVersion != untimestampedFormatVersion {
+		loggedAt = int64(binary.BigEndian.Uint64(body))
+		body = body[loggedAtSize:]
+	}
+	opcode := body[0]
+	bodyReader := bytes.NewReader(body[1:])
+
+	key, err := readLengthPrefixed(bodyReader)
+	if err != nil {
+		return 0, command, err
+	}
+	value, err := readLengthPrefixed(bodyReader)
+	if err != nil {
+		return 0, command, err
+	}
+
+	if bodyReader.Len() != 0 {
+		return 0, command, fmt.Errorf("(SegmentedDiskLogger) %d unexpected bytes at the end of record %d. Error: %w", bodyReader.Len(), seq, ErrCorruptLog)
+	}
+
+	switch opcode {
+	case commands.SET_COMMAND:
+		command = commands.CreateSetCommand(string(key), value)
+	case commands.DELETE_COMMAND:
+		command = commands.CreateDeleteCommand(string(key))
+	case commands.SETEX_COMMAND, commands.EXPIRE_COMMAND:
+		if len(value) < expiresAtSize {
+			return 0, command, fmt.Errorf("(SegmentedDiskLogger) Record %d is too short to hold an expiry. Error: %w", seq, ErrCorruptLog)
+		}
+		expiresAt := int64(binary.BigEndian.Uint64(value))
+		if opcode == commands.SETEX_COMMAND {
+			command = commands.CreateSetWithExpiryCommand(string(key), value[expiresAtSize:], expiresAt)
+		} else {
+			command = commands.CreateExpireCommand(string(key), expiresAt)
+		}
+	case commands.PERSIST_COMMAND:
+		command = commands.CreatePersistCommand(string(key))
+	case commands.MSET_COMMAND, commands.MDEL_COMMAND:
+		command, err = decodeMultiKeyValue(opcode, value)
+		if err != nil {
+			return 0, command, fmt.Errorf("(SegmentedDiskLogger) Failed to decode keys of record %d. %v. Error: %w", seq, err, ErrCorruptLog)
+		}
+	case commands.EXEC_COMMAND:
+		command, err = decodeTransactionValue(value)
+		if err != nil {
+			return 0, command, fmt.Errorf("(SegmentedDiskLogger) Failed to decode transaction in record %d. %v. Error: %w", seq, err, ErrCorruptLog)
+		}
+	default:
+		return 0, command, fmt.Errorf("(SegmentedDiskLogger) Unknown opcode %d in record %d. Error: %w", opcode, seq, ErrCorruptLog)
+	}
+	command.Seq = seq
+	command.LoggedAt = loggedAt
+
+	return seq, command, nil
+}
+
+func decodeMultiKeyValue(opcode uint8, value []byte) (commands.Command, error) {
+	elements, err := commands.DecodeList(value)
+	if err != nil {
+		return commands.Command{}, err
+	}
+
+	if opcode == commands.MDEL_COMMAND {
+		keys := make([]string, len(elements))
+		for i, key := range elements {
+			keys[i] = string(key)
+		}
+		return commands.CreateMultiDeleteCommand(keys), nil
+	}
+
+	if len(elements)%2 != 0 {
+		return commands.Command{}, fmt.Errorf("expected key value pairs. Got %d elements", len(elements))
+	}
+	keys := make([]string, 0, len(elements)/2)
+	values := make([][]byte, 0, len(elements)/2)
+	for i := 0; i < len(elements); i += 2 {
+		keys = append(keys, string(elements[i]))
+		values = append(values, elements[i+1])
+	}
+	return commands.CreateMultiSetCommand(keys, values), nil
+}
+
+func decodeTransactionValue(value []byte) (commands.Command, error) {
+	elements, err := commands.DecodeList(value)
+	if err != nil {
+		return commands.Command{}, err
+	}
+	if len(elements)%3 != 0 {
+		return commands.Command{}, fmt.Errorf("expected opcode, key and value for every write. Got %d elements", len(elements))
+	}
+
+	writes := make([]commands.Command, 0, len(elements)/3)
+	for i := 0; i < len(elements); i += 3 {
+		opcode, key, value := elements[i], string(elements[i+1]), elements[i+2]
+		if len(opcode) != 1 {
+			return commands.Command{}, fmt.Errorf("opcode of write %d is %d bytes", i/3, len(opcode))
+		}
+		switch opcode[0] {
+		case commands.SET_COMMAND:
+			writes = append(writes, commands.CreateSetCommand(key, value))
+		case commands.DELETE_COMMAND:
+			writes = append(writes, commands.CreateDeleteCommand(key))
+		default:
+			return commands.Command{}, fmt.Errorf("write %d has opcode %d which can't be in a transaction", i/3, opcode[0])
+		}
+	}
+	return commands.CreateTransactionCommand(writes), nil
+}
+
+// Whether the record's value is a commands.EncodeList list rather than the command's Value
+func hasListValue(command commands.Command) bool {
+	return commands.IsMultiKey(command.Identifier) || command.Identifier == commands.EXEC_COMMAND
+}
+
+// Elements of the value of an MSET, MDEL or EXEC record
+func listElements(command commands.Command) [][]byte {
+	if command.Identifier == commands.EXEC_COMMAND {
+		elements := make([][]byte, 0, 3*len(command.Batch))
+		for _, write := range command.Batch {
+			elements = append(elements, []byte{byte(write.Identifier)}, []byte(write.Key), write.Value)
+		}
+		return elements
+	}
+
+	elements := make([][]byte, 0, len(command.Keys)+len(command.Values))
+	for i, key := range command.Keys {
+		elements = append(elements, []byte(key))
+		if command.Identifier == commands.MSET_COMMAND {
+			elements = append(elements, command.Values[i])
+		}
+	}
+	return elements
+}
+
+func readLengthPrefixed(reader *bytes.Reader) ([]byte, error) {
+	var length uint32
+	err := binary.Read(reader, binary.BigEndian, &length)
+	if err != nil {
+		return nil, fmt.Errorf("(SegmentedDiskLogger) Failed to read length in record body. Error: %w", ErrCorruptLog)
+	}
+	if int64(length) > int64(reader.Len()) {
+		return nil, fmt.Errorf("(SegmentedDiskLogger) Length %d overruns record body. Error: %w", length, ErrCorruptLog)
+	}
+
+	buf := make([]byte, length)
+	_, err = io.ReadFull(reader, buf)
+	if err != nil {
+		return nil, fmt.Errorf("(SegmentedDiskLogger) Failed to read record field. Error: %w", ErrCorruptLog)
+	}
+	return buf, nil
+}
+
+func hasExpiry(command commands.Command) bool {
+	return command.Identifier == commands.SETEX_COMMAND || command.Identifier == commands.EXPIRE_COMMAND
+}
+
+func recordValueSize(command commands.Command) int {
+	if hasExpiry(command) {
+		return expiresAtSize + len(command.Value)
+	}
+	if hasListValue(command) {
+		size := commands.LENGTH_PREFIX_SIZE
+		for _, element := range listElements(command) {
+			size += commands.LENGTH_PREFIX_SIZE + len(element)
+		}
+		return size
+	}
+	return len(command.Value)
+}
+
+func recordSize(command commands.Command) int64 {
+	return int64(binaryRecordHeaderSize + binaryRecordBodyFixedSize + len(command.Key) + recordValueSize(command))
+}
+
+func encodeRecord(seq uint64, loggedAt int64, command commands.Command) ([]byte, error) {
+	switch command.Identifier {
+	case commands.SET_COMMAND, commands.DELETE_COMMAND, commands.SETEX_COMMAND, commands.EXPIRE_COMMAND, commands.PERSIST_COMMAND:
+	case commands.MSET_COMMAND, commands.MDEL_COMMAND:
+		if command.Identifier == commands.MSET_COMMAND && len(command.Values) != len(command.Keys) {
+			return nil, fmt.Errorf("(SegmentedDiskLogger) MSET has %d keys but %d values", len(command.Keys), len(command.Values))
+		}
+	case commands.EXEC_COMMAND:
+		for _, write := range command.Batch {
+			if write.Identifier != commands.SET_COMMAND && write.Identifier != commands.DELETE_COMMAND {
+				return nil, fmt.Errorf("(SegmentedDiskLogger) Command %d can't be written as part of a transaction", write.Identifier)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("(SegmentedDiskLogger) Command %d can't be written to the write log", command.Identifier)
+	}
+
+	valueSize := recordValueSize(command)
+	bodyLength := binaryRecordBodyFixedSize + len(command.Key) + valueSize
+	record := make([]byte, binaryRecordHeaderSize, binaryRecordHeaderSize+bodyLength)
+	record = binary.BigEndian.AppendUint64(record, seq)
+	record = binary.BigEndian.AppendUint64(record, uint64(loggedAt))
+	record = append(record, byte(command.Identifier))
+	record = binary.BigEndian.AppendUint32(record, uint32(len(command.Key)))
+	record = append(record, command.Key...)
+	record = binary.BigEndian.AppendUint32(record, uint32(valueSize))
+	if hasExpiry(command) {
+		record = binary.BigEndian.AppendUint64(record, uint64(command.ExpiresAt))
+	}
+	if hasListValue(command) {
+		record = append(record, commands.EncodeList(listElements(command))...)
+	} else {
+		record = append(record, command.Value...)
+	}
+
+	body := record[binaryRecordHeaderSize:]
+	binary.BigEndian.PutUint32(record, uint32(len(body)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(body, castagnoliTable))
+
+	return record, nil
+}
+
+// Makes new files and renames in dir durable. Best effort as not every platform supports fsync on directories
+func SyncDir(dir string) {
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer dirFile.Close()
+	dirFile.Sync()
+}
@@ -0,0 +1,482 @@
+package writelogger
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+)
+
+const (
+	DEFAULT_MAX_SEGMENT_SIZE = 64 * 1024 * 1024
+	DEFAULT_MAX_KEY_HISTORY  = 1000
+)
+
+// Write log split over numbered segment files in Dir
+//
+// Records are appended to the newest (active) segment. Once it would grow past MaxSegmentSize
+// it's fsynced and closed and a new segment is started. The MANIFEST file lists the live segments
+// so whole segments can be dropped by Compact without rewriting anything.
+type SegmentedDiskLogger struct {
+	// Directory holding the segments and manifest. Created if it doesn't exist
+	Dir string
+	// Size in bytes a segment is rotated at. A record bigger than this gets a segment to itself
+	// Defaults to DEFAULT_MAX_SEGMENT_SIZE if not set
+	MaxSegmentSize int64
+	SyncPolicy     SyncPolicy
+	// Only used by SYNC_INTERVAL. Defaults to DEFAULT_SYNC_INTERVAL if not set
+	SyncInterval time.Duration
+	// Most writes to each key kept in the key index. Once a key has twice this many the oldest are forgotten
+	// down to this many, so KeyHistory can't go back past them. Defaults to DEFAULT_MAX_KEY_HISTORY if not set
+	MaxKeyHistory int
+
+	lock sync.Mutex
+	// Live segments oldest first. The last one is the active segment
+	// Only replaced while holding both lock and the fsync slot
+	segments []*segment
+	// Sequence number of the last record logged. Only known once Replay has run
+	lastSeq uint64
+	// When the last record was logged (Unix milliseconds). Later records are never logged before it
+	lastLoggedAt int64
+	// Where each key's writes are in the live segments, oldest first. Built by Replay. See KeyHistory
+	keyIndex map[string]keyIndexEntry
+
+	// Guards the fields below. Never held while appending so fsyncs don't hold up writers
+	syncLock sync.Mutex
+	syncCond *sync.Cond
+	syncing  bool
+	// Every record up to and including this one has been fsynced
+	syncedSeq     uint64
+	stopSyncing   chan struct{}
+	syncerStopped chan struct{}
+}
+
+func (sdl *SegmentedDiskLogger) Init() error {
+	if sdl.Dir == "" {
+		return fmt.Errorf("(SegmentedDiskLogger) SegmentedDiskLogger has no Dir property")
+	}
+	if sdl.MaxSegmentSize <= 0 {
+		sdl.MaxSegmentSize = DEFAULT_MAX_SEGMENT_SIZE
+	}
+	if sdl.MaxKeyHistory <= 0 {
+		sdl.MaxKeyHistory = DEFAULT_MAX_KEY_HISTORY
+	}
+	err := os.MkdirAll(sdl.Dir, 0755)
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to create %s. Error: %w", sdl.Dir, err)
+	}
+	sdl.syncCond = sync.NewCond(&sdl.syncLock)
+	sdl.keyIndex = make(map[string]keyIndexEntry)
+
+	ids, err := readManifest(sdl.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		err = sdl.createLog()
+	} else if err == nil {
+		err = sdl.openLog(ids)
+	}
+	if err != nil {
+		return err
+	}
+
+	if sdl.SyncPolicy == SYNC_INTERVAL && sdl.SyncInterval <= 0 {
+		sdl.SyncInterval = DEFAULT_SYNC_INTERVAL
+	}
+
+	return nil
+}
+
+func (sdl *SegmentedDiskLogger) createLog() error {
+	entries, err := os.ReadDir(sdl.Dir)
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to list %s. Error: %w", sdl.Dir, err)
+	}
+	for _, entry := range entries {
+		if _, ok := parseSegmentFileName(entry.Name()); ok {
+			return fmt.Errorf("(SegmentedDiskLogger) %s has segments but no manifest. Error: %w", sdl.Dir, ErrCorruptLog)
+		}
+	}
+
+	first, err := createSegment(sdl.Dir, 1, 0)
+	if err != nil {
+		return err
+	}
+	sdl.segments = []*segment{first}
+	return writeManifest(sdl.Dir, sdl.segments)
+}
+
+func (sdl *SegmentedDiskLogger) openLog(ids []uint64) error {
+	err := sdl.removeOrphanedSegments(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		seg, err := openSegment(sdl.Dir, id)
+		if err != nil {
+			return err
+		}
+		sdl.segments = append(sdl.segments, seg)
+	}
+
+	active := sdl.segments[len(sdl.segments)-1]
+	sdl.lastSeq = active.baseSeq
+	return active.openForAppend()
+}
+
+// Deletes segments left behind by a crash part way through rotating or compacting
+func (sdl *SegmentedDiskLogger) removeOrphanedSegments(liveIDs []uint64) error {
+	live := make(map[uint64]bool, len(liveIDs))
+	for _, id := range liveIDs {
+		live[id] = true
+	}
+
+	entries, err := os.ReadDir(sdl.Dir)
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to list %s. Error: %w", sdl.Dir, err)
+	}
+	for _, entry := range entries {
+		id, ok := parseSegmentFileName(entry.Name())
+		if !ok || live[id] {
+			continue
+		}
+		log.Printf("(SegmentedDiskLogger) Removing segment %s as it isn't in the manifest\n", entry.Name())
+		err = os.Remove(filepath.Join(sdl.Dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("(SegmentedDiskLogger) Failed to remove orphaned segment %s. Error: %w", entry.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+func (sdl *SegmentedDiskLogger) Close() error {
+	if sdl.stopSyncing != nil {
+		close(sdl.stopSyncing)
+		<-sdl.syncerStopped
+	}
+
+	err := sdl.syncUpTo(sdl.currentSeq())
+	if err != nil {
+		log.Printf("(SegmentedDiskLogger) Failed final fsync before closing. Error: %v\n", err)
+	}
+
+	sdl.lock.Lock()
+	defer sdl.lock.Unlock()
+	return sdl.activeSegment().close()
+}
+
+// Caller must hold lock or the fsync slot
+func (sdl *SegmentedDiskLogger) activeSegment() *segment {
+	return sdl.segments[len(sdl.segments)-1]
+}
+
+// Streams every record from every live segment oldest first to fn and indexes the keys each one writes
+// Only one record is held in memory at a time. Progress is logged every REPLAY_PROGRESS_INTERVAL
+// Only the active segment may end in an incomplete record. See segment.replay
+func (sdl *SegmentedDiskLogger) Replay(fn func(command commands.Command) error) error {
+	if len(sdl.segments) == 0 {
+		err := fmt.Errorf("(SegmentedDiskLogger) Call to Replay with no segments open. Have you called `Init()`?")
+		return err
+	}
+
+	sdl.lock.Lock()
+	defer sdl.lock.Unlock()
+
+	var totalBytes int64
+	for _, seg := range sdl.segments {
+		totalBytes += seg.size - binaryLogHeaderSize
+	}
+	progress := newReplayProgress(totalBytes)
+	sdl.keyIndex = make(map[string]keyIndexEntry)
+
+	lastSeq := sdl.segments[0].baseSeq
+	for i, seg := range sdl.segments {
+		if seg.baseSeq != lastSeq {
+			return fmt.Errorf("(SegmentedDiskLogger) Segment %s starts after sequence number %d but the segment before it ends at %d. Error: %w", seg.path, seg.baseSeq, lastSeq, ErrCorruptLog)
+		}
+
+		replayRecord := func(command commands.Command, offset int64, recordSize int64) error {
+			progress.record(recordSize)
+			sdl.indexRecord(command, seg, offset, command.LoggedAt)
+			sdl.lastLoggedAt = max(sdl.lastLoggedAt, command.LoggedAt)
+			return fn(command)
+		}
+
+		tornTail := rejectTornTail
+		if i == len(sdl.segments)-1 {
+			tornTail = truncateTornTail
+		}
+
+		var err error
+		lastSeq, err = seg.replay(tornTail, replayRecord)
+		if err != nil {
+			return err
+		}
+	}
+	progress.done()
+
+	sdl.lastSeq = lastSeq
+	sdl.syncLock.Lock()
+	sdl.syncedSeq = sdl.lastSeq
+	sdl.syncLock.Unlock()
+
+	// Only started once the log can be appended to so a failed startup doesn't leave it running
+	if sdl.SyncPolicy == SYNC_INTERVAL && sdl.stopSyncing == nil {
+		sdl.stopSyncing = make(chan struct{})
+		sdl.syncerStopped = make(chan struct{})
+		go sdl.syncPeriodically()
+	}
+	return nil
+}
+
+// Replay must have been called first so the next sequence number is known
+func (sdl *SegmentedDiskLogger) Append(command commands.Command) (uint64, error) {
+	size := recordSize(command)
+	if sdl.needsRotation(size) {
+		err := sdl.rotate(size)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	sdl.lock.Lock()
+	defer sdl.lock.Unlock()
+
+	seq := sdl.lastSeq + 1
+	// Held back if the clock has gone backwards so records are always in time order
+	loggedAt := max(time.Now().UnixMilli(), sdl.lastLoggedAt)
+	record, err := encodeRecord(seq, loggedAt, command)
+	if err != nil {
+		return 0, err
+	}
+
+	// A single write so a crash can only ever leave the last record incomplete
+	active := sdl.activeSegment()
+	_, err = active.file.Write(record)
+	if err != nil {
+		err = fmt.Errorf("(SegmentedDiskLogger) Failed to save record to %s. Error: %v", active.path, err)
+		return 0, err
+	}
+
+	sdl.indexRecord(command, active, active.size, loggedAt)
+	active.size += int64(len(record))
+	sdl.lastSeq = seq
+	sdl.lastLoggedAt = loggedAt
+	return seq, nil
+}
+
+func (sdl *SegmentedDiskLogger) needsRotation(recordSize int64) bool {
+	sdl.lock.Lock()
+	defer sdl.lock.Unlock()
+	return sdl.needsRotationLocked(recordSize)
+}
+
+func (sdl *SegmentedDiskLogger) needsRotationLocked(recordSize int64) bool {
+	active := sdl.activeSegment()
+	// Only the current format is appended to so a segment written by an older version is moved on from
+	if active.formatVersion != BINARY_LOG_FORMAT_VERSION {
+		return true
+	}
+	return !active.isEmpty() && active.size+recordSize > sdl.MaxSegmentSize
+}
+
+// Concurrent appends can land between rotating and the record that triggered it
+// so segments may end up a few records past MaxSegmentSize
+func (sdl *SegmentedDiskLogger) rotate(recordSize int64) error {
+	sdl.claimSyncSlot()
+	sdl.lock.Lock()
+
+	var err error
+	if sdl.needsRotationLocked(recordSize) {
+		err = sdl.rotateLocked(sdl.lastSeq)
+	}
+
+	synced := sdl.lastSeq
+	sdl.lock.Unlock()
+	sdl.releaseSyncSlot(err == nil, synced)
+	return err
+}
+
+// Starts a new active segment whose records follow on from baseSeq
+// The old active segment is fsynced first so only the active segment can ever hold unsynced records
+// Caller must hold lock and the fsync slot
+func (sdl *SegmentedDiskLogger) rotateLocked(baseSeq uint64) error {
+	old := sdl.activeSegment()
+	err := old.file.Sync()
+	if err != nil {
+		return fmt.Errorf("(SegmentedDiskLogger) Failed to fsync %s before rotating. Error: %w", old.path, err)
+	}
+
+	next, err := createSegment(sdl.Dir, old.id+1, baseSeq)
+	if err != nil {
+		return err
+	}
+
+	segments := append(sdl.segments[:len(sdl.segments):len(sdl.segments)], next)
+	err = writeManifest(sdl.Dir, segments)
+	if err != nil {
+		next.close()
+		os.Remove(next.path)
+		return err
+	}
+
+	old.close()
+	sdl.segments = segments
+	sdl.lastSeq = baseSeq
+	return nil
+}
+
+func (sdl *SegmentedDiskLogger) currentSeq() uint64 {
+	sdl.lock.Lock()
+	defer sdl.lock.Unlock()
+	return sdl.lastSeq
+}
+
+func (sdl *SegmentedDiskLogger) LastSeq() uint64 {
+	return sdl.currentSeq()
+}
+
+// Drops every segment made up only of records up to and including upToSeq
+//
+// Nothing is rewritten so records up to upToSeq that share a segment with later ones are kept
+// and show up again in Replay. If upToSeq is at or past the last record a new segment is started
+// so every older segment can go and numbering jumps forward to upToSeq.
+func (sdl *SegmentedDiskLogger) Compact(upToSeq uint64) error {
+	sdl.claimSyncSlot()
+	sdl.lock.Lock()
+
+	err := sdl.compactLocked(upToSeq)
+
+	synced := sdl.lastSeq
+	sdl.lock.Unlock()
+	sdl.releaseSyncSlot(err == nil, synced)
+	return err
+}
+
+func (sdl *SegmentedDiskLogger) compactLocked(upToSeq uint64) error {
+	active := sdl.activeSegment()
+	if upToSeq >= sdl.lastSeq && !(active.isEmpty() && active.baseSeq == upToSeq) {
+		err := sdl.rotateLocked(upToSeq)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Every record in a segment comes before the base of the next one
+	drop := 0
+	for drop < len(sdl.segments)-1 && sdl.segments[drop+1].baseSeq <= upToSeq {
+		drop++
+	}
+	if drop == 0 {
+		return nil
+	}
+
+	kept := sdl.segments[drop:]
+	err := writeManifest(sdl.Dir, kept)
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range sdl.segments[:drop] {
+		err = os.Remove(seg.path)
+		if err != nil {
+			// It's no longer in the manifest so it'll be cleaned up on the next startup
+			log.Printf("(SegmentedDiskLogger) Failed to remove compacted segment %s. Error: %v\n", seg.path, err)
+		}
+	}
+	sdl.unindexSegments(sdl.segments[:drop], kept[0].id)
+	sdl.segments = kept
+
+	return nil
+}
+
+// Waits for any running fsync then stops new ones starting until releaseSyncSlot
+// Taken before swapping the active segment so nothing fsyncs a file after it's closed
+func (sdl *SegmentedDiskLogger) claimSyncSlot() {
+	sdl.syncLock.Lock()
+	for sdl.syncing {
+		sdl.syncCond.Wait()
+	}
+	sdl.syncing = true
+	sdl.syncLock.Unlock()
+}
+
+func (sdl *SegmentedDiskLogger) releaseSyncSlot(synced bool, syncedSeq uint64) {
+	sdl.syncLock.Lock()
+	sdl.syncing = false
+	if synced {
+		sdl.syncedSeq = max(sdl.syncedSeq, syncedSeq)
+	}
+	sdl.syncCond.Broadcast()
+	sdl.syncLock.Unlock()
+}
+
+// Under SYNC_ALWAYS waits for an fsync covering seq. Under the other policies the record
+// is already as durable as promised once Append has written it
+func (sdl *SegmentedDiskLogger) Sync(seq uint64) error {
+	if sdl.SyncPolicy != SYNC_ALWAYS {
+		return nil
+	}
+
+	return sdl.syncUpTo(seq)
+}
+
+// Group commit
+//
+// Only one fsync runs at a time. Callers that arrive while one is running wait for it to finish,
+// then one of them starts a new fsync covering everything appended so far and the rest wait on that.
+// However many writers are waiting, at most two fsyncs pass before all of them are durable.
+func (sdl *SegmentedDiskLogger) syncUpTo(seq uint64) error {
+	sdl.syncLock.Lock()
+	defer sdl.syncLock.Unlock()
+
+	for sdl.syncedSeq < seq {
+		if sdl.syncing {
+			sdl.syncCond.Wait()
+			continue
+		}
+
+		sdl.syncing = true
+		sdl.syncLock.Unlock()
+		// Holding the fsync slot stops the active segment being swapped out from under us
+		sdl.lock.Lock()
+		target := sdl.lastSeq
+		active := sdl.activeSegment()
+		sdl.lock.Unlock()
+		err := active.file.Sync()
+		sdl.syncLock.Lock()
+		sdl.syncing = false
+		sdl.syncCond.Broadcast()
+
+		if err != nil {
+			return fmt.Errorf("(SegmentedDiskLogger) Failed to fsync %s. Error: %w", active.path, err)
+		}
+		sdl.syncedSeq = max(sdl.syncedSeq, target)
+	}
+
+	return nil
+}
+
+func (sdl *SegmentedDiskLogger) syncPeriodically() {
+	defer close(sdl.syncerStopped)
+
+	ticker := time.NewTicker(sdl.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sdl.stopSyncing:
+			return
+		case <-ticker.C:
+			err := sdl.syncUpTo(sdl.currentSeq())
+			if err != nil {
+				log.Printf("(SegmentedDiskLogger) Periodic fsync failed. Error: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package writelogger
+
+import (
+	"fmt"
+	"time"
+)
+
+// How hard the write log works to make sure an acknowledged write survives a crash
+type SyncPolicy int
+
+const (
+	// fsync before any write is acknowledged. Concurrent writers share a single fsync
+	SYNC_ALWAYS SyncPolicy = iota
+	// fsync in the background every SyncInterval. Up to one interval of acknowledged writes can be lost on power loss
+	// Writes are applied and can be read by other clients before they're fsynced so a read can see a write that's then lost
+	SYNC_INTERVAL
+	// Leave flushing to the OS. Writes survive the server crashing but not the machine
+	// Like SYNC_INTERVAL reads can see writes that a power loss then loses
+	SYNC_NEVER
+)
+
+const DEFAULT_SYNC_INTERVAL = 100 * time.Millisecond
+
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "always":
+		return SYNC_ALWAYS, nil
+	case "interval":
+		return SYNC_INTERVAL, nil
+	case "never":
+		return SYNC_NEVER, nil
+	default:
+		return SYNC_ALWAYS, fmt.Errorf("(SyncPolicy) Unknown fsync policy %s. Expected 'always', 'interval' or 'never'", name)
+	}
+}
+
+func (sp SyncPolicy) String() string {
+	switch sp {
+	case SYNC_ALWAYS:
+		return "always"
+	case SYNC_INTERVAL:
+		return "interval"
+	case SYNC_NEVER:
+		return "never"
+	default:
+		return fmt.Sprintf("SyncPolicy(%d)", int(sp))
+	}
+}
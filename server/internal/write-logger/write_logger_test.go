@@ -0,0 +1,783 @@
+package writelogger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/willcruse/kvdb/server/v2/internal/commands"
+)
+
+// Contains a newline and bytes that aren't valid UTF-8
+var TEST_VALUE = []byte{'v', '\n', 0x00, 0xff}
+
+func newTestLogger(t *testing.T, dir string) *SegmentedDiskLogger {
+	logger := &SegmentedDiskLogger{Dir: dir}
+	err := logger.Init()
+	if err != nil {
+		t.Fatalf("Failed to init logger. Got err = %s", err)
+	}
+	_, err = replayAll(logger)
+	if err != nil {
+		t.Fatalf("Failed to replay logger. Got err = %s", err)
+	}
+	return logger
+}
+
+func replayAll(logger *SegmentedDiskLogger) ([]commands.Command, error) {
+	var replayed []commands.Command
+	err := logger.Replay(func(command commands.Command) error {
+		replayed = append(replayed, command)
+		return nil
+	})
+	return replayed, err
+}
+
+func appendTestCommands(t *testing.T, logger *SegmentedDiskLogger) {
+	for _, command := range []commands.Command{
+		commands.CreateSetCommand("key\none", TEST_VALUE),
+		commands.CreateDeleteCommand("key\none"),
+		commands.CreateSetCommand("key two", []byte{}),
+	} {
+		_, err := logger.Append(command)
+		if err != nil {
+			t.Fatalf("Failed to append %+v. Got err = %s", command, err)
+		}
+	}
+}
+
+func TestSegmentedDiskLoggerRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	logger := newTestLogger(t, dir)
+	appendTestCommands(t, logger)
+	logger.Close()
+
+	logger = &SegmentedDiskLogger{Dir: dir}
+	logger.Init()
+	replayed, err := replayAll(logger)
+	if err != nil {
+		t.Fatalf("Failed to replay. Got err = %s", err)
+	}
+
+	if len(replayed) != 3 {
+		t.Fatalf("Expected 3 commands to be replayed. Got %+v", replayed)
+	}
+	if replayed[0].Identifier != commands.SET_COMMAND || replayed[0].Key != "key\none" || !bytes.Equal(replayed[0].Value, TEST_VALUE) {
+		t.Errorf("First replayed command doesn't match what was logged. Got %+v", replayed[0])
+	}
+	if replayed[1].Identifier != commands.DELETE_COMMAND || replayed[1].Key != "key\none" {
+		t.Errorf("Second replayed command doesn't match what was logged. Got %+v", replayed[1])
+	}
+	if replayed[2].Identifier != commands.SET_COMMAND || replayed[2].Key != "key two" || len(replayed[2].Value) != 0 {
+		t.Errorf("Third replayed command doesn't match what was logged. Got %+v", replayed[2])
+	}
+}
+
+func TestSegmentedDiskLoggerExpiryRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	logger := newTestLogger(t, dir)
+	for _, command := range []commands.Command{
+		commands.CreateSetWithExpiryCommand("key", TEST_VALUE, 1700000000123),
+		commands.CreateExpireCommand("key", 1800000000456),
+		commands.CreatePersistCommand("key"),
+	} {
+		_, err := logger.Append(command)
+		if err != nil {
+			t.Fatalf("Failed to append %+v. Got err = %s", command, err)
+		}
+	}
+	logger.Close()
+
+	logger = &SegmentedDiskLogger{Dir: dir}
+	logger.Init()
+	replayed, err := replayAll(logger)
+	if err != nil || len(replayed) != 3 {
+		t.Fatalf("Expected 3 commands to be replayed. Got %+v and err = %s", replayed, err)
+	}
+	if replayed[0].Identifier != commands.SETEX_COMMAND || replayed[0].ExpiresAt != 1700000000123 || !bytes.Equal(replayed[0].Value, TEST_VALUE) {
+		t.Errorf("SETEX doesn't match what was logged. Got %+v", replayed[0])
+	}
+	if replayed[1].Identifier != commands.EXPIRE_COMMAND || replayed[1].ExpiresAt != 1800000000456 || len(replayed[1].Value) != 0 {
+		t.Errorf("EXPIRE doesn't match what was logged. Got %+v", replayed[1])
+	}
+	if replayed[2].Identifier != commands.PERSIST_COMMAND || replayed[2].Key != "key" {
+		t.Errorf("PERSIST doesn't match what was logged. Got %+v", replayed[2])
+	}
+}
+
+func TestSegmentedDiskLoggerMultiKeyRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	logger := newTestLogger(t, dir)
+	for _, command := range []commands.Command{
+		commands.CreateMultiSetCommand([]string{"a", "", "c"}, [][]byte{TEST_VALUE, []byte("empty key"), {}}),
+		commands.CreateMultiDeleteCommand([]string{"a", "c"}),
+	} {
+		_, err := logger.Append(command)
+		if err != nil {
+			t.Fatalf("Failed to append %+v. Got err = %s", command, err)
+		}
+	}
+	logger.Close()
+
+	logger = &SegmentedDiskLogger{Dir: dir}
+	logger.Init()
+	replayed, err := replayAll(logger)
+	if err != nil || len(replayed) != 2 {
+		t.Fatalf("Expected each multi key command to be replayed as one record. Got %+v and err = %s", replayed, err)
+	}
+	mset := replayed[0]
+	if mset.Identifier != commands.MSET_COMMAND || fmt.Sprint(mset.Keys) != "[a  c]" || len(mset.Values) != 3 ||
+		!bytes.Equal(mset.Values[0], TEST_VALUE) || string(mset.Values[1]) != "empty key" || len(mset.Values[2]) != 0 {
+		t.Errorf("MSET doesn't match what was logged. Got %+v", mset)
+	}
+	if replayed[1].Identifier != commands.MDEL_COMMAND || fmt.Sprint(replayed[1].Keys) != "[a c]" {
+		t.Errorf("MDEL doesn't match what was logged. Got %+v", replayed[1])
+	}
+}
+
+func TestSegmentedDiskLoggerTransactionRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	logger := newTestLogger(t, dir)
+	transaction := commands.CreateTransactionCommand([]commands.Command{
+		commands.CreateSetCommand("a", TEST_VALUE),
+		commands.CreateDeleteCommand("b"),
+		commands.CreateSetCommand("a", []byte{}),
+	})
+	_, err := logger.Append(transaction)
+	if err != nil {
+		t.Fatalf("Failed to append %+v. Got err = %s", transaction, err)
+	}
+	_, err = logger.Append(commands.CreateTransactionCommand([]commands.Command{commands.CreatePersistCommand("a")}))
+	if err == nil {
+		t.Errorf("Expected a transaction holding a PERSIST to be rejected")
+	}
+	logger.Close()
+
+	logger = &SegmentedDiskLogger{Dir: dir}
+	logger.Init()
+	replayed, err := replayAll(logger)
+	if err != nil || len(replayed) != 1 {
+		t.Fatalf("Expected the transaction to be replayed as one record. Got %+v and err = %s", replayed, err)
+	}
+	batch := replayed[0].Batch
+	if replayed[0].Identifier != commands.EXEC_COMMAND || len(batch) != 3 {
+		t.Fatalf("Transaction doesn't match what was logged. Got %+v", replayed[0])
+	}
+	if batch[0].Identifier != commands.SET_COMMAND || batch[0].Key != "a" || !bytes.Equal(batch[0].Value, TEST_VALUE) {
+		t.Errorf("First write doesn't match what was logged. Got %+v", batch[0])
+	}
+	if batch[1].Identifier != commands.DELETE_COMMAND || batch[1].Key != "b" {
+		t.Errorf("Second write doesn't match what was logged. Got %+v", batch[1])
+	}
+	if batch[2].Identifier != commands.SET_COMMAND || batch[2].Key != "a" || len(batch[2].Value) != 0 {
+		t.Errorf("Third write doesn't match what was logged. Got %+v", batch[2])
+	}
+}
+
+func TestSegmentedDiskLoggerReplayStopsOnError(t *testing.T) {
+	dir := t.TempDir()
+	logger := newTestLogger(t, dir)
+	appendTestCommands(t, logger)
+	logger.Close()
+
+	logger = &SegmentedDiskLogger{Dir: dir}
+	logger.Init()
+	stop := errors.New("stop")
+	calls := 0
+	err := logger.Replay(func(command commands.Command) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("Expected replay to stop at the first error. Got %d calls and err = %s", calls, err)
+	}
+}
+
+func TestSegmentedDiskLoggerDropsTornFinalRecord(t *testing.T) {
+	dir := t.TempDir()
+	logger := newTestLogger(t, dir)
+	appendTestCommands(t, logger)
+	logger.Close()
+
+	// Simulate a crash part way through writing the last record
+	truncateSegment(t, filepath.Join(dir, segmentFileName(1)), 3)
+
+	logger = newTestLogger(t, dir)
+	replayed, err := replayAll(logger)
+	if err != nil {
+		t.Fatalf("Expected a torn final record to be dropped. Got err = %s", err)
+	}
+	if len(replayed) != 2 {
+		t.Fatalf("Expected 2 commands to survive. Got %+v", replayed)
+	}
+
+	// New records must follow on from the last complete one
+	_, err = logger.Append(commands.CreateDeleteCommand("key two"))
+	if err != nil {
+		t.Fatalf("Failed to append after dropping torn record. Got err = %s", err)
+	}
+	logger.Close()
+
+	logger = newTestLogger(t, dir)
+	replayed, err = replayAll(logger)
+	if err != nil || len(replayed) != 3 || replayed[2].Identifier != commands.DELETE_COMMAND {
+		t.Errorf("Expected appended record to replay after the surviving ones. Got %+v and err = %s", replayed, err)
+	}
+}
+
+func TestReadLogLeavesTornFinalRecord(t *testing.T) {
+	dir := t.TempDir()
+	logger := newTestLogger(t, dir)
+	appendTestCommands(t, logger)
+	logger.Close()
+
+	segmentPath := filepath.Join(dir, segmentFileName(1))
+	size := truncateSegment(t, segmentPath, 3)
+
+	var seqs []uint64
+	err := ReadLog(dir, func(command commands.Command) error {
+		seqs = append(seqs, command.Seq)
+		return nil
+	})
+	if err != nil || !slices.Equal(seqs, []uint64{1, 2}) {
+		t.Fatalf("Expected the 2 complete records. Got %v and err = %v", seqs, err)
+	}
+	after, err := os.Stat(segmentPath)
+	if err != nil || after.Size() != size {
+		t.Errorf("Expected the segment to be left as it was. Size went from %d to %d. Error: %v", size, after.Size(), err)
+	}
+
+	err = ReadLog(t.TempDir(), func(command commands.Command) error { return nil })
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected os.ErrNotExist without a write log. Got err = %v", err)
+	}
+}
+
+func TestSegmentedDiskLoggerRejectsCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	logger := newTestLogger(t, dir)
+	appendTestCommands(t, logger)
+	logger.Close()
+
+	// Flip a byte inside the first record's key
+	corruptSegment(t, filepath.Join(dir, segmentFileName(1)), binaryLogHeaderSize+binaryRecordHeaderSize+22)
+
+	logger = &SegmentedDiskLogger{Dir: dir}
+	err := logger.Init()
+	if err != nil {
+		t.Fatalf("Failed to init logger. Got err = %s", err)
+	}
+	_, err = replayAll(logger)
+	if !errors.Is(err, ErrCorruptLog) {
+		t.Errorf("Expected corruption before the last record to fail replay with ErrCorruptLog. Got err = %s", err)
+	}
+}
+
+func TestSegmentedDiskLoggerRejectsCorruptLengthMidSegment(t *testing.T) {
+	dir := t.TempDir()
+	logger := newTestLogger(t, dir)
+	appendTestCommands(t, logger)
+	logger.Close()
+
+	// A damaged length in the first record's header makes it look like it runs off the end of the segment
+	segmentPath := filepath.Join(dir, segmentFileName(1))
+	corruptSegment(t, segmentPath, binaryLogHeaderSize+1)
+	before, err := os.Stat(segmentPath)
+	if err != nil {
+		t.Fatalf("Failed to stat segment. Got err = %s", err)
+	}
+
+	logger = &SegmentedDiskLogger{Dir: dir}
+	err = logger.Init()
+	if err != nil {
+		t.Fatalf("Failed to init logger. Got err = %s", err)
+	}
+	_, err = replayAll(logger)
+	if !errors.Is(err, ErrCorruptLog) {
+		t.Errorf("Expected a damaged length to fail replay with ErrCorruptLog. Got err = %v", err)
+	}
+	after, err := os.Stat(segmentPath)
+	if err != nil || after.Size() != before.Size() {
+		t.Errorf("Expected the segment not to be truncated. Size went from %d to %d. Error: %v", before.Size(), after.Size(), err)
+	}
+}
+
+// Cuts the last by bytes off a segment as if a crash stopped a write part way through and returns its new size
+func truncateSegment(t *testing.T, path string, by int64) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat %s. Got err = %s", path, err)
+	}
+	err = os.Truncate(path, info.Size()-by)
+	if err != nil {
+		t.Fatalf("Failed to truncate %s. Got err = %s", path, err)
+	}
+	return info.Size() - by
+}
+
+// Flips every bit of the byte at offset
+func corruptSegment(t *testing.T, path string, offset int) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s. Got err = %s", path, err)
+	}
+	contents[offset] ^= 0xff
+	err = os.WriteFile(path, contents, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write %s. Got err = %s", path, err)
+	}
+}
+
+func TestSegmentedDiskLoggerRejectsTextLog(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, MANIFEST_FILE_NAME), []byte(manifestHeader+"\n"+segmentFileName(1)+"\n"), 0644)
+	os.WriteFile(filepath.Join(dir, segmentFileName(1)), []byte("SET\n1 a\n1 b\n"), 0644)
+
+	logger := &SegmentedDiskLogger{Dir: dir}
+	err := logger.Init()
+	if !errors.Is(err, ErrCorruptLog) {
+		t.Errorf("Expected a text log to be rejected. Got err = %s", err)
+	}
+}
+
+func TestSegmentedDiskLoggerRequiresManifest(t *testing.T) {
+	dir := t.TempDir()
+	logger := newTestLogger(t, dir)
+	appendTestCommands(t, logger)
+	logger.Close()
+
+	os.Remove(filepath.Join(dir, MANIFEST_FILE_NAME))
+	logger = &SegmentedDiskLogger{Dir: dir}
+	err := logger.Init()
+	if !errors.Is(err, ErrCorruptLog) {
+		t.Errorf("Expected segments without a manifest to be rejected rather than replaced. Got err = %s", err)
+	}
+}
+
+func TestSegmentedDiskLoggerRotates(t *testing.T) {
+	dir := t.TempDir()
+	logger := &SegmentedDiskLogger{Dir: dir, MaxSegmentSize: 64}
+	logger.Init()
+	replayAll(logger)
+	for range 10 {
+		_, err := logger.Append(commands.CreateSetCommand("key", TEST_VALUE))
+		if err != nil {
+			t.Fatalf("Failed to append. Got err = %s", err)
+		}
+	}
+	logger.Close()
+
+	ids, err := readManifest(dir)
+	if err != nil || len(ids) < 2 {
+		t.Fatalf("Expected the log to rotate into several segments. Got %v and err = %s", ids, err)
+	}
+
+	// Left behind by a crash part way through rotating
+	os.WriteFile(filepath.Join(dir, segmentFileName(ids[len(ids)-1]+1)), encodeHeader(10), 0644)
+
+	logger = &SegmentedDiskLogger{Dir: dir, MaxSegmentSize: 64}
+	logger.Init()
+	replayed, err := replayAll(logger)
+	if err != nil || len(replayed) != 10 || replayed[9].Seq != 10 {
+		t.Errorf("Expected all 10 records to replay across segments. Got %+v and err = %s", replayed, err)
+	}
+	_, err = logger.Append(commands.CreateDeleteCommand("key"))
+	if err != nil {
+		t.Errorf("Expected the orphaned segment to be cleaned up so rotation can carry on. Got err = %s", err)
+	}
+	logger.Close()
+}
+
+func TestSegmentedDiskLoggerSequenceNumbers(t *testing.T) {
+	dir := t.TempDir()
+	logger := newTestLogger(t, dir)
+	appendTestCommands(t, logger)
+	logger.Close()
+
+	logger = newTestLogger(t, dir)
+	seq, err := logger.Append(commands.CreateDeleteCommand("key two"))
+	if err != nil || seq != 4 {
+		t.Errorf("Expected sequence numbers to carry on after replay. Got %d and err = %s", seq, err)
+	}
+
+	err = logger.Sync(seq)
+	if err != nil {
+		t.Errorf("Failed to sync. Got err = %s", err)
+	}
+	if logger.syncedSeq != seq {
+		t.Errorf("Expected SYNC_ALWAYS to fsync up to %d. Got %d", seq, logger.syncedSeq)
+	}
+}
+
+func TestSegmentedDiskLoggerCompact(t *testing.T) {
+	dir := t.TempDir()
+	// Small enough that every record gets its own segment
+	logger := &SegmentedDiskLogger{Dir: dir, MaxSegmentSize: 1}
+	logger.Init()
+	replayAll(logger)
+	appendTestCommands(t, logger)
+
+	err := logger.Compact(2)
+	if err != nil {
+		t.Fatalf("Failed to compact. Got err = %s", err)
+	}
+	seq, err := logger.Append(commands.CreateDeleteCommand("key two"))
+	if err != nil || seq != 4 {
+		t.Errorf("Expected appends after compaction to carry on from 4. Got %d and err = %s", seq, err)
+	}
+	logger.Close()
+
+	logger = &SegmentedDiskLogger{Dir: dir}
+	logger.Init()
+	replayed, err := replayAll(logger)
+	if err != nil {
+		t.Fatalf("Failed to replay. Got err = %s", err)
+	}
+	if len(replayed) != 2 || replayed[0].Seq != 3 || replayed[1].Seq != 4 {
+		t.Errorf("Expected only records 3 and 4 to survive compaction. Got %+v", replayed)
+	}
+
+	// Compacting past the end moves the log on so new records don't reuse covered sequence numbers
+	err = logger.Compact(10)
+	if err != nil {
+		t.Fatalf("Failed to compact past the end. Got err = %s", err)
+	}
+	seq, err = logger.Append(commands.CreateDeleteCommand("key two"))
+	if err != nil || seq != 11 {
+		t.Errorf("Expected appends to carry on from 11. Got %d and err = %s", seq, err)
+	}
+	logger.Close()
+
+	ids, _ := readManifest(dir)
+	if len(ids) != 1 {
+		t.Errorf("Expected compacting past the end to leave only the active segment. Got %v", ids)
+	}
+}
+
+func TestSegmentedDiskLoggerConcurrentSync(t *testing.T) {
+	// Small segments so fsyncs race with rotation
+	logger := &SegmentedDiskLogger{Dir: t.TempDir(), MaxSegmentSize: 128}
+	logger.Init()
+	replayAll(logger)
+	defer logger.Close()
+
+	var wg sync.WaitGroup
+	for range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			seq, err := logger.Append(commands.CreateSetCommand("key", TEST_VALUE))
+			if err != nil {
+				t.Errorf("Failed to append. Got err = %s", err)
+				return
+			}
+			err = logger.Sync(seq)
+			if err != nil {
+				t.Errorf("Failed to sync. Got err = %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if logger.syncedSeq != 32 {
+		t.Errorf("Expected all 32 records to be synced. Got %d", logger.syncedSeq)
+	}
+}
+
+func keyHistory(t *testing.T, logger *SegmentedDiskLogger, key string, loggedBy int64) ([]KeyWrite, bool) {
+	var writes []KeyWrite
+	complete, err := logger.KeyHistory(key, loggedBy, func(write KeyWrite) bool {
+		writes = append(writes, write)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Failed to read history of %s. Got err = %s", key, err)
+	}
+	return writes, complete
+}
+
+func TestSegmentedDiskLoggerKeyHistory(t *testing.T) {
+	dir := t.TempDir()
+	// Small enough that every record gets its own segment
+	logger := &SegmentedDiskLogger{Dir: dir, MaxSegmentSize: 1}
+	logger.Init()
+	replayAll(logger)
+	for _, command := range []commands.Command{
+		commands.CreateSetCommand("key", []byte("1")),
+		commands.CreateMultiSetCommand([]string{"other", "key"}, [][]byte{[]byte("x"), []byte("2")}),
+		commands.CreateSetCommand("other", []byte("y")),
+		commands.CreateTransactionCommand([]commands.Command{commands.CreateSetCommand("key", []byte("3")), commands.CreateDeleteCommand("key")}),
+	} {
+		_, err := logger.Append(command)
+		if err != nil {
+			t.Fatalf("Failed to append %+v. Got err = %s", command, err)
+		}
+	}
+	logger.Close()
+
+	logger = &SegmentedDiskLogger{Dir: dir, MaxSegmentSize: 1}
+	logger.Init()
+	replayAll(logger)
+	defer logger.Close()
+
+	writes, complete := keyHistory(t, logger, "key", math.MaxInt64)
+	if len(writes) != 3 || !complete {
+		t.Fatalf("Expected every write to key to be read back from the index built on replay. Got %+v and complete = %v", writes, complete)
+	}
+	if writes[0].Seq != 4 || writes[0].Command.Identifier != commands.DELETE_COMMAND {
+		t.Errorf("Expected the transaction's last write to key first. Got %+v", writes[0])
+	}
+	if writes[1].Seq != 2 || string(writes[1].Command.Value) != "2" || writes[2].Seq != 1 || string(writes[2].Command.Value) != "1" {
+		t.Errorf("Expected the older writes newest first. Got %+v", writes[1:])
+	}
+	if writes[2].LoggedAt == 0 || writes[2].LoggedAt > writes[0].LoggedAt {
+		t.Errorf("Expected writes to carry the time they were logged in order. Got %+v", writes)
+	}
+
+	writes, _ = keyHistory(t, logger, "key", writes[2].LoggedAt-1)
+	if len(writes) != 0 {
+		t.Errorf("Expected no writes logged before the first. Got %+v", writes)
+	}
+
+	err := logger.Compact(2)
+	if err != nil {
+		t.Fatalf("Failed to compact. Got err = %s", err)
+	}
+	writes, complete = keyHistory(t, logger, "key", math.MaxInt64)
+	if len(writes) != 1 || writes[0].Seq != 4 || complete {
+		t.Errorf("Expected only the write after compaction to be left and the history to be incomplete. Got %+v and complete = %v", writes, complete)
+	}
+}
+
+func TestSegmentedDiskLoggerKeyIndexIsBounded(t *testing.T) {
+	logger := &SegmentedDiskLogger{Dir: t.TempDir(), MaxSegmentSize: 1, MaxKeyHistory: 2}
+	logger.Init()
+	replayAll(logger)
+	defer logger.Close()
+	logger.Append(commands.CreateSetCommand("gone", []byte("x")))
+	for i := range 5 {
+		logger.Append(commands.CreateSetCommand("key", []byte(fmt.Sprint(i))))
+	}
+
+	writes, complete := keyHistory(t, logger, "key", math.MaxInt64)
+	if len(writes) < 2 || len(writes) > 4 || string(writes[0].Command.Value) != "4" || complete {
+		t.Errorf("Expected only the latest writes to key to be kept and the history to be incomplete. Got %+v and complete = %v", writes, complete)
+	}
+
+	err := logger.Compact(1)
+	if err != nil {
+		t.Fatalf("Failed to compact. Got err = %s", err)
+	}
+	if _, ok := logger.keyIndex["gone"]; ok {
+		t.Errorf("Expected keys only written in compacted segments to be dropped from the index")
+	}
+}
+
+func TestSegmentedDiskLoggerReplaysFormatVersion1(t *testing.T) {
+	dir := t.TempDir()
+	header := encodeHeader(0)
+	binary.BigEndian.PutUint16(header[4:], untimestampedFormatVersion)
+	// Version 1 records are the same minus Logged At
+	record, _ := encodeRecord(1, 0, commands.CreateSetCommand("key", TEST_VALUE))
+	body := slices.Delete(record[binaryRecordHeaderSize:], 8, 8+loggedAtSize)
+	record = binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	record = binary.BigEndian.AppendUint32(record, crc32.Checksum(body, castagnoliTable))
+	record = append(record, body...)
+	os.WriteFile(filepath.Join(dir, segmentFileName(1)), append(header, record...), 0644)
+	os.WriteFile(filepath.Join(dir, MANIFEST_FILE_NAME), []byte(manifestHeader+"\n"+segmentFileName(1)+"\n"), 0644)
+
+	logger := &SegmentedDiskLogger{Dir: dir}
+	logger.Init()
+	replayed, err := replayAll(logger)
+	if err != nil || len(replayed) != 1 || replayed[0].Key != "key" || replayed[0].LoggedAt != 0 {
+		t.Fatalf("Expected the version 1 record to be replayed without a time. Got %+v and err = %v", replayed, err)
+	}
+
+	seq, err := logger.Append(commands.CreateDeleteCommand("key"))
+	if err != nil || seq != 2 {
+		t.Fatalf("Expected appending to carry on from 2. Got %d and err = %v", seq, err)
+	}
+	logger.Close()
+
+	ids, _ := readManifest(dir)
+	if len(ids) != 2 {
+		t.Errorf("Expected appending to start a segment in the current format. Got %v", ids)
+	}
+	logger = &SegmentedDiskLogger{Dir: dir}
+	logger.Init()
+	replayed, err = replayAll(logger)
+	if err != nil || len(replayed) != 2 || replayed[1].LoggedAt == 0 {
+		t.Errorf("Expected both records to be replayed and the new one to have a time. Got %+v and err = %v", replayed, err)
+	}
+}
+
+func TestImportLegacyLogBecomesFirstSegment(t *testing.T) {
+	legacyPath := filepath.Join(t.TempDir(), "kv.db")
+	header := encodeHeader(4)
+	binary.BigEndian.PutUint16(header[4:], untimestampedFormatVersion)
+	record, _ := encodeRecord(5, 0, commands.CreateSetCommand("key", TEST_VALUE))
+	body := slices.Delete(record[binaryRecordHeaderSize:], 8, 8+loggedAtSize)
+	record = binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	record = binary.BigEndian.AppendUint32(record, crc32.Checksum(body, castagnoliTable))
+	record = append(record, body...)
+	err := os.WriteFile(legacyPath, append(header, record...), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write legacy log. Got err = %s", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "data")
+	err = ImportLegacyLog(legacyPath, dir)
+	if err != nil {
+		t.Fatalf("Failed to import legacy log. Got err = %s", err)
+	}
+	logger := &SegmentedDiskLogger{Dir: dir}
+	err = logger.Init()
+	if err != nil {
+		t.Fatalf("Failed to init logger. Got err = %s", err)
+	}
+	defer logger.Close()
+	replayed, err := replayAll(logger)
+	if err != nil || len(replayed) != 1 || replayed[0].Seq != 5 || replayed[0].Key != "key" {
+		t.Fatalf("Expected the legacy record to be replayed. Got %+v and err = %v", replayed, err)
+	}
+	_, err = os.Stat(legacyPath)
+	if err != nil {
+		t.Errorf("Expected the legacy log to be left in place. Got err = %v", err)
+	}
+
+	err = ImportLegacyLog(legacyPath, dir)
+	if err == nil {
+		t.Errorf("Expected importing into a directory with a write log to fail")
+	}
+}
+
+// Written the way the text format logger did
+const TEXT_LOG = "SET\n3 foo\n3 bar\nSET\n4 poem\n10 roses\nare \nDELETE\n3 foo\nSET\n3 baz\n1 1\n"
+
+func TestImportLegacyLogConvertsTextLog(t *testing.T) {
+	legacyPath := filepath.Join(t.TempDir(), "kv.db")
+	err := os.WriteFile(legacyPath, []byte(TEXT_LOG), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write legacy log. Got err = %s", err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "data")
+	err = ImportLegacyLog(legacyPath, dir)
+	if err != nil {
+		t.Fatalf("Failed to import text log. Got err = %s", err)
+	}
+	logger := &SegmentedDiskLogger{Dir: dir}
+	err = logger.Init()
+	if err != nil {
+		t.Fatalf("Failed to init logger. Got err = %s", err)
+	}
+	defer logger.Close()
+	replayed, err := replayAll(logger)
+	if err != nil || len(replayed) != 4 {
+		t.Fatalf("Expected the 4 text log writes to be replayed. Got %+v and err = %v", replayed, err)
+	}
+	if replayed[1].Key != "poem" || string(replayed[1].Value) != "roses\nare " || replayed[2].Identifier != commands.DELETE_COMMAND || replayed[3].Seq != 4 {
+		t.Errorf("Expected the text log writes in order. Got %+v", replayed)
+	}
+
+	seq, err := logger.Append(commands.CreateSetCommand("new", TEST_VALUE))
+	if err != nil || seq != 5 {
+		t.Errorf("Expected new writes to follow on from the imported ones. Got %d and err = %v", seq, err)
+	}
+}
+
+func TestImportLegacyLogRejectsDamagedTextLog(t *testing.T) {
+	legacyPath := filepath.Join(t.TempDir(), "kv.db")
+	err := os.WriteFile(legacyPath, []byte(TEXT_LOG[:len(TEXT_LOG)-3]), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write legacy log. Got err = %s", err)
+	}
+
+	dir := t.TempDir()
+	err = ImportLegacyLog(legacyPath, dir)
+	if !errors.Is(err, ErrCorruptLog) {
+		t.Errorf("Expected a text log cut short to be rejected. Got err = %v", err)
+	}
+	_, err = readManifest(dir)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected no write log to be created. Got err = %v", err)
+	}
+}
+
+func TestImportLegacyLogRejectsUnknownFormat(t *testing.T) {
+	legacyPath := filepath.Join(t.TempDir(), "kv.db")
+	err := os.WriteFile(legacyPath, []byte("SET key value\n"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write legacy log. Got err = %s", err)
+	}
+
+	dir := t.TempDir()
+	err = ImportLegacyLog(legacyPath, dir)
+	if !errors.Is(err, ErrCorruptLog) {
+		t.Errorf("Expected a log without a binary header to be rejected. Got err = %v", err)
+	}
+	_, err = readManifest(dir)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected no write log to be created. Got err = %v", err)
+	}
+}
+
+func TestSegmentedDiskLoggerBackupLeavesOutLaterRecords(t *testing.T) {
+	logger := &SegmentedDiskLogger{Dir: t.TempDir(), MaxSegmentSize: 64}
+	err := logger.Init()
+	if err != nil {
+		t.Fatalf("Failed to init logger. Got err = %s", err)
+	}
+	replayAll(logger)
+	appendTestCommands(t, logger)
+
+	backupDir := t.TempDir()
+	seq, err := logger.Backup(func(name string, size int64, contents io.Reader) error {
+		// Appended while the backup is running
+		logger.Append(commands.CreateSetCommand("later", TEST_VALUE))
+		data, err := io.ReadAll(contents)
+		if err != nil || int64(len(data)) != size {
+			return fmt.Errorf("read %d bytes of %s expected %d. Error: %v", len(data), name, size, err)
+		}
+		return os.WriteFile(filepath.Join(backupDir, name), data, 0644)
+	})
+	if err != nil || seq != 3 {
+		t.Fatalf("Expected a backup up to sequence number 3. Got %d and err = %v", seq, err)
+	}
+	logger.Close()
+
+	replayed, err := replayAll(newTestLogger(t, backupDir))
+	if err != nil || len(replayed) != 3 {
+		t.Errorf("Expected the 3 records logged before the backup. Got %+v and err = %v", replayed, err)
+	}
+}
+
+func TestSegmentedDiskLoggerOnlySyncsPeriodicallyOnceReplayed(t *testing.T) {
+	dir := t.TempDir()
+	logger := &SegmentedDiskLogger{Dir: dir, SyncPolicy: SYNC_INTERVAL}
+	err := logger.Init()
+	if err != nil {
+		t.Fatalf("Failed to init logger. Got err = %s", err)
+	}
+	if logger.stopSyncing != nil {
+		t.Errorf("Expected no background fsyncs before Replay so a failed startup can't leave them running")
+	}
+
+	_, err = replayAll(logger)
+	if err != nil {
+		t.Fatalf("Failed to replay logger. Got err = %s", err)
+	}
+	if logger.stopSyncing == nil {
+		t.Errorf("Expected background fsyncs to start once replayed")
+	}
+	logger.Close()
+}
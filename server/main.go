@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/willcruse/kvdb/server/v2/internal"
 	listener "github.com/willcruse/kvdb/server/v2/internal/listener"
@@ -14,21 +16,47 @@ import (
 )
 
 const (
-	DEFAULT_PORT          = 1337
-	DEFAULT_LOG_FILE_PATH = "kv.db"
+	DEFAULT_PORT            = 1337
+	DEFAULT_DATA_DIR        = "kv-data"
+	DEFAULT_STORAGE_BACKEND = "sharded"
+	// 0 disables periodic snapshots
+	DEFAULT_SNAPSHOT_INTERVAL = 5 * time.Minute
+	// Where versions before --data-dir kept the write log and snapshot by default
+	LEGACY_LOG_FILE_PATH = "kv.db"
+	LEGACY_SNAPSHOT_PATH = "kv.snapshot"
 )
 
 type Config struct {
-	Port        int
-	LogFilePath string
-	Help        bool
+	Port             int
+	DataDir          string
+	MaxSegmentSize   int64
+	MaxMessageSize   int
+	StorageBackend   string
+	ShardCount       int
+	SyncPolicy       writelogger.SyncPolicy
+	SyncInterval     time.Duration
+	SnapshotInterval time.Duration
+	MVCCRetention    time.Duration
+	// Data directory to rebuild DataDir from before starting. See internal.Recover
+	RecoverFrom   string
+	RecoverTarget internal.RecoveryTarget
+	// Exit once DataDir has been recovered instead of serving it
+	RecoverOnly bool
+	// Backup directory or archive made by BACKUP to copy into DataDir before starting. See internal.Restore
+	RestoreFrom string
+	// Where older versions kept the write log and snapshot. Migrated into DataDir on startup. See internal.MigrateLegacyFiles
+	LegacyLogFilePath  string
+	LegacySnapshotPath string
+	// Directory BACKUP writes into on the server. Only streamed backups are allowed if not set
+	BackupDir string
+	Help      bool
 }
 
 // Basic argument parser
 // Fails on some uses e.g.
-// --log-file-path --port will use '--port' as the filename
+// --data-dir --port will use '--port' as the directory
 func configFromArgs(args []string) (Config, error) {
-	config := Config{Port: DEFAULT_PORT, LogFilePath: DEFAULT_LOG_FILE_PATH, Help: false}
+	config := Config{Port: DEFAULT_PORT, DataDir: DEFAULT_DATA_DIR, MaxSegmentSize: writelogger.DEFAULT_MAX_SEGMENT_SIZE, MaxMessageSize: internal.DEFAULT_MAX_MESSAGE_SIZE, StorageBackend: DEFAULT_STORAGE_BACKEND, ShardCount: storagebackend.DEFAULT_SHARD_COUNT, SyncPolicy: writelogger.SYNC_ALWAYS, SyncInterval: writelogger.DEFAULT_SYNC_INTERVAL, SnapshotInterval: DEFAULT_SNAPSHOT_INTERVAL, MVCCRetention: storagebackend.DEFAULT_MVCC_RETENTION, LegacyLogFilePath: LEGACY_LOG_FILE_PATH, LegacySnapshotPath: LEGACY_SNAPSHOT_PATH, Help: false}
 
 	// First arg is binary path
 	for i := 1; i < len(args); i++ {
@@ -52,13 +80,149 @@ func configFromArgs(args []string) (Config, error) {
 				return config, fmt.Errorf("(config-parsing) Failed to parse port number from %s. Error: %+v", portArg, err)
 			}
 			config.Port = portNum
+		case "data-dir":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected directory to follow --data-dir option. Did you add a directory?")
+			}
+			config.DataDir = args[i]
+		// Replaced by --data-dir but still read so data kept somewhere other than the defaults can be migrated
 		case "log-file-path":
 			i++
 			if i >= len(args) {
 				return config, fmt.Errorf("(config-parsing) Expected filepath to follow --log-file-path option. Did you add a filepath?")
 			}
-			logFilePath := args[i]
-			config.LogFilePath = logFilePath
+			config.LegacyLogFilePath = args[i]
+		case "snapshot-path":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected filepath to follow --snapshot-path option. Did you add a filepath?")
+			}
+			config.LegacySnapshotPath = args[i]
+		case "max-segment-size":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected size in bytes to follow --max-segment-size option. Did you specify a size?")
+			}
+			sizeArg := args[i]
+			size, err := strconv.ParseInt(sizeArg, 10, 64)
+			if err != nil || size <= 0 {
+				return config, fmt.Errorf("(config-parsing) Failed to parse max segment size from %s. Expected a positive integer. Error: %+v", sizeArg, err)
+			}
+			config.MaxSegmentSize = size
+		case "max-message-size":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected size in bytes to follow --max-message-size option. Did you specify a size?")
+			}
+			sizeArg := args[i]
+			size, err := strconv.Atoi(sizeArg)
+			if err != nil || size <= 0 {
+				return config, fmt.Errorf("(config-parsing) Failed to parse max message size from %s. Expected a positive integer. Error: %+v", sizeArg, err)
+			}
+			config.MaxMessageSize = size
+		case "storage-backend":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected backend name to follow --storage-backend option. Did you specify a backend?")
+			}
+			config.StorageBackend = args[i]
+		case "shard-count":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected shard count to follow --shard-count option. Did you specify a count?")
+			}
+			countArg := args[i]
+			count, err := strconv.Atoi(countArg)
+			if err != nil || count <= 0 {
+				return config, fmt.Errorf("(config-parsing) Failed to parse shard count from %s. Expected a positive integer. Error: %+v", countArg, err)
+			}
+			config.ShardCount = count
+		case "fsync":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected policy to follow --fsync option. Did you specify 'always', 'interval' or 'never'?")
+			}
+			policy, err := writelogger.ParseSyncPolicy(args[i])
+			if err != nil {
+				return config, fmt.Errorf("(config-parsing) %w", err)
+			}
+			config.SyncPolicy = policy
+		case "fsync-interval-ms":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected milliseconds to follow --fsync-interval-ms option. Did you specify an interval?")
+			}
+			intervalArg := args[i]
+			intervalMs, err := strconv.Atoi(intervalArg)
+			if err != nil || intervalMs <= 0 {
+				return config, fmt.Errorf("(config-parsing) Failed to parse fsync interval from %s. Expected a positive integer. Error: %+v", intervalArg, err)
+			}
+			config.SyncInterval = time.Duration(intervalMs) * time.Millisecond
+		case "snapshot-interval-s":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected seconds to follow --snapshot-interval-s option. Did you specify an interval?")
+			}
+			intervalArg := args[i]
+			intervalS, err := strconv.Atoi(intervalArg)
+			if err != nil || intervalS < 0 {
+				return config, fmt.Errorf("(config-parsing) Failed to parse snapshot interval from %s. Expected a non-negative integer. Error: %+v", intervalArg, err)
+			}
+			config.SnapshotInterval = time.Duration(intervalS) * time.Second
+		case "mvcc-retention-s":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected seconds to follow --mvcc-retention-s option. Did you specify a retention?")
+			}
+			retentionArg := args[i]
+			retentionS, err := strconv.Atoi(retentionArg)
+			if err != nil || retentionS <= 0 {
+				return config, fmt.Errorf("(config-parsing) Failed to parse MVCC retention from %s. Expected a positive integer. Error: %+v", retentionArg, err)
+			}
+			config.MVCCRetention = time.Duration(retentionS) * time.Second
+		case "recover-from":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected directory to follow --recover-from option. Did you add a directory?")
+			}
+			config.RecoverFrom = args[i]
+		case "recover-to-seq":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected sequence number to follow --recover-to-seq option. Did you specify a sequence number?")
+			}
+			seqArg := args[i]
+			seq, err := strconv.ParseUint(seqArg, 10, 64)
+			if err != nil || seq == 0 {
+				return config, fmt.Errorf("(config-parsing) Failed to parse sequence number from %s. Expected a positive integer. Error: %+v", seqArg, err)
+			}
+			config.RecoverTarget.Seq = seq
+		case "recover-to-time":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected time to follow --recover-to-time option. Did you specify a time?")
+			}
+			timeArg := args[i]
+			at, err := parseTime(timeArg)
+			if err != nil {
+				return config, fmt.Errorf("(config-parsing) Failed to parse time from %s. Expected RFC3339 or Unix milliseconds. Error: %+v", timeArg, err)
+			}
+			config.RecoverTarget.Time = at
+		case "restore-from":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected backup directory or archive to follow --restore-from option. Did you add a backup?")
+			}
+			config.RestoreFrom = args[i]
+		case "backup-dir":
+			i++
+			if i >= len(args) {
+				return config, fmt.Errorf("(config-parsing) Expected directory to follow --backup-dir option. Did you add a directory?")
+			}
+			config.BackupDir = args[i]
+		case "recover-only":
+			config.RecoverOnly = true
 		case "help":
 			config.Help = true
 		default:
@@ -67,9 +231,51 @@ func configFromArgs(args []string) (Config, error) {
 		}
 	}
 
+	if config.RecoverTarget.Seq != 0 && config.RecoverTarget.Time != 0 {
+		return config, fmt.Errorf("(config-parsing) Expected only one of --recover-to-seq and --recover-to-time")
+	}
+	recovering := config.RecoverTarget.Seq != 0 || config.RecoverTarget.Time != 0
+	if (config.RecoverFrom != "") != recovering {
+		return config, fmt.Errorf("(config-parsing) --recover-from needs --recover-to-seq or --recover-to-time and they need --recover-from")
+	}
+	if config.RestoreFrom != "" && recovering {
+		return config, fmt.Errorf("(config-parsing) Expected only one of --restore-from and --recover-from. A backup directory can be passed to --recover-from")
+	}
+	if config.RecoverOnly && !recovering {
+		return config, fmt.Errorf("(config-parsing) --recover-only needs --recover-from")
+	}
+
 	return config, nil
 }
 
+// Parses an RFC3339 time or Unix milliseconds into Unix milliseconds
+func parseTime(arg string) (int64, error) {
+	ms, err := strconv.ParseInt(arg, 10, 64)
+	if err == nil && ms > 0 {
+		return ms, nil
+	}
+	at, err := time.Parse(time.RFC3339Nano, arg)
+	if err != nil {
+		return 0, err
+	}
+	return at.UnixMilli(), nil
+}
+
+func storageBackendFromConfig(config Config) (storagebackend.StorageBackend, error) {
+	switch config.StorageBackend {
+	case "map":
+		return &storagebackend.MapStorageBackend{}, nil
+	case "sharded":
+		return &storagebackend.ShardedMapStorageBackend{ShardCount: config.ShardCount}, nil
+	case "skiplist":
+		return &storagebackend.SkipListStorageBackend{}, nil
+	case "mvcc":
+		return &storagebackend.MVCCStorageBackend{ShardCount: config.ShardCount, Retention: config.MVCCRetention}, nil
+	default:
+		return nil, fmt.Errorf("(config) Unknown storage backend %s. Expected 'map', 'sharded', 'skiplist' or 'mvcc'", config.StorageBackend)
+	}
+}
+
 func main() {
 	config, err := configFromArgs(os.Args)
 	if err != nil {
@@ -77,12 +283,42 @@ func main() {
 	}
 
 	if config.Help {
-		log.Println("KVDB\nOptions:\n--help: display this message and exit\n--port <INT> Port to run the server on\n--log-file-path <FILE_PATH> Filepath to store the write log to")
+		log.Println("KVDB\nOptions:\n--help: display this message and exit\n--port <INT> Port to run the server on\n--data-dir <DIR> Directory to store the write log and snapshots in\n--max-segment-size <INT> Size in bytes at which the write log moves on to a new segment file\n--max-message-size <INT> Max size in bytes of a request's key and value combined\n--storage-backend <map|sharded|skiplist|mvcc> In memory store to use. skiplist keeps keys in order for RANGE. mvcc keeps old versions for SNAPSHOT reads\n--shard-count <INT> Number of shards for the sharded and mvcc storage backends\n--fsync <always|interval|never> When to fsync the write log\n--fsync-interval-ms <INT> How often to fsync with --fsync interval\n--snapshot-interval-s <INT> How often to snapshot and compact the write log. 0 to only snapshot on BGSAVE\n--mvcc-retention-s <INT> How long a SNAPSHOT can be read from with the mvcc storage backend\n--recover-from <DIR> Rebuild --data-dir, which must be new or empty, from this data directory as it was at --recover-to-seq or --recover-to-time\n--recover-to-seq <INT> Keep writes up to and including this write log sequence number\n--recover-to-time <RFC3339|UNIX MS> Keep writes logged at or before this time\n--recover-only Exit once recovered instead of starting the server\n--restore-from <DIR|TAR> Copy a backup made by BACKUP into --data-dir, which must be new or empty, then start the server\n--log-file-path <FILE> Write log kept by older versions to migrate into an empty --data-dir (default kv.db)\n--snapshot-path <FILE> Snapshot kept by older versions to migrate along with --log-file-path (default kv.snapshot)\n--backup-dir <DIR> Directory BACKUP <NAME> writes backups into. Without it backups can only be streamed to the client with DUMP")
 		os.Exit(0)
 	}
 
-	sb := &storagebackend.MapStorageBackend{}
-	opLogger := &writelogger.StringDiskLogger{FileName: config.LogFilePath}
+	if config.RestoreFrom != "" {
+		err = internal.Restore(config.RestoreFrom, config.DataDir)
+		if err != nil {
+			log.Fatalf("Failed to restore %s. Error: %v\n", config.RestoreFrom, err)
+		}
+	}
+
+	if config.RecoverFrom != "" {
+		_, err = internal.Recover(config.RecoverFrom, config.DataDir, config.RecoverTarget)
+		if err != nil {
+			log.Fatalf("Failed to recover %s. Error: %v\n", config.RecoverFrom, err)
+		}
+		if config.RecoverOnly {
+			os.Exit(0)
+		}
+	}
+
+	_, err = internal.MigrateLegacyFiles(config.LegacyLogFilePath, config.LegacySnapshotPath, config.DataDir)
+	if err != nil {
+		log.Fatalf("Failed to migrate %s into %s. Error: %v\n", config.LegacyLogFilePath, config.DataDir, err)
+	}
+
+	sb, err := storageBackendFromConfig(config)
+	if err != nil {
+		log.Fatalf("Failed to create storage backend. Error = %+v\n", err)
+	}
+	opLogger := &writelogger.SegmentedDiskLogger{
+		Dir:            config.DataDir,
+		MaxSegmentSize: config.MaxSegmentSize,
+		SyncPolicy:     config.SyncPolicy,
+		SyncInterval:   config.SyncInterval,
+	}
 
 	serverAddress := fmt.Sprintf(":%d", config.Port)
 	tcpListener := listener.TCPListener{
@@ -90,11 +326,18 @@ func main() {
 	}
 
 	server := internal.Server{
-		Listener:       &tcpListener,
-		StorageBackend: sb,
-		WriteLogger:    opLogger,
+		Listener:         &tcpListener,
+		StorageBackend:   sb,
+		WriteLogger:      opLogger,
+		MaxMessageSize:   config.MaxMessageSize,
+		SnapshotPath:     filepath.Join(config.DataDir, internal.SNAPSHOT_FILE_NAME),
+		SnapshotInterval: config.SnapshotInterval,
+		BackupDir:        config.BackupDir,
 	}
 	err = server.Init()
+	if err != nil {
+		log.Fatalf("Failed to initialise server. Error: %v\n", err)
+	}
 	log.Printf("Starting server on %s\n", serverAddress)
 	err = server.Listen()
 	if err != nil {